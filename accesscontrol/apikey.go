@@ -0,0 +1,235 @@
+package accesscontrol
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+const (
+	// APIKeysPath has the API keys of users (along with the hashes of their tokens), keyed by their IDs.
+	APIKeysPath = "/api-keys"
+	// APIKeyPrefix of the tokens of API keys. Hydra's tokens (`<key>.<signature>`) never have a
+	// dot this early, so API keys cannot be mistaken for them.
+	APIKeyPrefix = "ak."
+
+	apiKeyIDLength     = 16
+	apiKeySecretLength = 40
+	apiKeyNameLength   = 64
+)
+
+var (
+	// ErrorAPIKeyNotFound occurs when revoking an API key which doesn't exist (or belongs to another user).
+	ErrorAPIKeyNotFound = errors.New("api key: key doesn't exist")
+	// ErrorAPIKeyExpiry occurs when an API key expires in the past, or later than allowed
+	// (see `config.EnvAPIKeyMaxTTL`).
+	ErrorAPIKeyExpiry = errors.New("api key: invalid expiry")
+)
+
+// APIKey of a user, for scripts and jobs which cannot go through the OAuth flow. Keys only allow
+// the scopes they're created with, and only as long as the user's roles allow them as well.
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Subject   string    `json:"subject"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// apiKeyRecord has the key along with the hash of its token. The tokens themselves are only
+// returned when the keys are created.
+type apiKeyRecord struct {
+	APIKey
+	Hash string `json:"hash"`
+}
+
+// Validate this API key for possible errors.
+func (k *APIKey) Validate() error {
+	k.Name = strings.TrimSpace(k.Name)
+	if k.Name == "" || len(k.Name) > apiKeyNameLength {
+		return errors.New("api key: name should have 1 to 64 characters")
+	}
+
+	if len(k.Scopes) == 0 {
+		return errors.New("api key: at least one scope is required")
+	}
+
+	scopes := *new([]string)
+	seen := make(map[string]bool)
+	for _, scope := range k.Scopes {
+		scope = strings.ToLower(scope)
+		if seen[scope] {
+			continue // filter duplicates
+		}
+
+		if _, exists := scopeNameMap[scope]; !exists {
+			return errors.New("scope " + scope + " doesn't exist")
+		}
+
+		seen[scope] = true
+		scopes = append(scopes, scope)
+	}
+
+	k.Scopes = scopes
+	return nil
+}
+
+// allowsScope checks whether the key has been created with the given scope.
+func (k *APIKey) allowsScope(name string) bool {
+	for _, scope := range k.Scopes {
+		if scope == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CreateAPIKey for the given subject, and return it along with its token. The subject should be
+// authorized for all of the key's scopes. Keys without an expiry are valid for the longest
+// allowed duration.
+func (c *Controller) CreateAPIKey(subject string, key APIKey) (*APIKey, string, error) {
+	if rootTokenHash == nil {
+		return nil, "", errors.New("scopes haven't been initialized")
+	}
+
+	if err := key.Validate(); err != nil {
+		return nil, "", err
+	}
+
+	for _, scope := range key.Scopes {
+		if allowed, err := util.IsSubjectAuthorized(subject, scope); err != nil {
+			return nil, "", err
+		} else if !allowed {
+			return nil, "", errors.New("api key: not authorized for scope " + scope)
+		}
+	}
+
+	maxTTL := config.Default.APIKeyMaxTTL
+	if maxTTL <= 0 {
+		maxTTL = config.DefaultAPIKeyMaxTTL
+	}
+
+	now := time.Now().UTC()
+	if key.ExpiresAt.IsZero() {
+		key.ExpiresAt = now.Add(maxTTL)
+	} else if !key.ExpiresAt.After(now) || key.ExpiresAt.After(now.Add(maxTTL)) {
+		return nil, "", ErrorAPIKeyExpiry
+	}
+
+	key.ID = util.RandomAlphaNumeric(apiKeyIDLength)
+	key.Subject = subject
+	key.CreatedAt = now
+	key.ExpiresAt = key.ExpiresAt.UTC()
+
+	token := APIKeyPrefix + key.ID + "." + util.RandomAlphaNumeric(apiKeySecretLength)
+	record := apiKeyRecord{APIKey: key, Hash: hashAPIKey(token)}
+	if err := util.GetStore(APIKeysPath).Set(key.ID, record); err != nil {
+		return nil, "", err
+	}
+
+	return &key, token, nil
+}
+
+// ListAPIKeys of the given subject which haven't expired. Expired keys are removed along the way.
+func (c *Controller) ListAPIKeys(subject string) ([]APIKey, error) {
+	keys := *new([]APIKey)
+	err := scanAPIKeys(func(record apiKeyRecord) bool {
+		if record.Subject == subject && time.Now().Before(record.ExpiresAt) {
+			keys = append(keys, record.APIKey)
+		}
+
+		return false
+	})
+
+	return keys, err
+}
+
+// RevokeAPIKey of the given subject.
+func (c *Controller) RevokeAPIKey(subject, id string) error {
+	var record apiKeyRecord
+	if err := util.GetStore(APIKeysPath).Get(id, &record); err == util.ErrorKeyNotFound {
+		return ErrorAPIKeyNotFound
+	} else if err != nil {
+		return err
+	} else if record.Subject != subject {
+		return ErrorAPIKeyNotFound
+	}
+
+	return util.GetStore(APIKeysPath).Remove(id)
+}
+
+// IsAPIKey checks whether the given token belongs to an API key (rather than Hydra).
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// lookupAPIKey for the given token. Expired keys, and the keys of deleted users, are invalid.
+func lookupAPIKey(token string) (*APIKey, error) {
+	parts := strings.Split(strings.TrimPrefix(token, APIKeyPrefix), ".")
+	if !IsAPIKey(token) || len(parts) != 2 || len(parts[0]) != apiKeyIDLength {
+		return nil, util.ErrorInvalidToken
+	}
+
+	var record apiKeyRecord
+	if err := util.GetStore(APIKeysPath).Get(parts[0], &record); err == util.ErrorKeyNotFound {
+		return nil, util.ErrorInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(token)), []byte(record.Hash)) != 1 || !time.Now().Before(record.ExpiresAt) {
+		return nil, util.ErrorInvalidToken
+	}
+
+	if _, err := usersController.FindUserResourceByID(record.Subject); err != nil {
+		return nil, util.ErrorInvalidToken
+	}
+
+	return &record.APIKey, nil
+}
+
+// removeAPIKeys of the given subject.
+func removeAPIKeys(subject string) error {
+	return scanAPIKeys(func(record apiKeyRecord) bool { return record.Subject == subject })
+}
+
+// scanAPIKeys in the store, and remove the ones matching the given function along with the
+// expired ones.
+func scanAPIKeys(remove func(record apiKeyRecord) bool) error {
+	store := util.GetStore(APIKeysPath)
+	ids, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, id := range ids {
+		var record apiKeyRecord
+		if err := store.Get(id, &record); err == util.ErrorKeyNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if remove(record) || !now.Before(record.ExpiresAt) {
+			if err := store.Remove(id); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// hashAPIKey with SHA-256. The tokens are random, so they don't need a slower hash.
+func hashAPIKey(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
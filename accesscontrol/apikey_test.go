@@ -0,0 +1,91 @@
+package accesscontrol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/users"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+func TestAPIKeys(t *testing.T) {
+	config.Default.DatabaseURL = util.StoreMemory
+	require.NoError(t, util.InitializeStore())
+	_, err := usersController.Import(users.UserResource{ID: "APIKEYS", Email: "apikeys@example.com", Verified: true, Firstname: "Foo"})
+	require.NoError(t, err)
+
+	c := &Controller{}
+	defer c.Reset()
+	_, err = setScopes([]Scope{
+		{Name: "users.read", Method: "GET", URI: "/users/:id"},
+		{Name: "users.write", Method: "PUT", URI: "/users/:id"},
+	})
+	require.NoError(t, err)
+
+	_, _, err = c.CreateAPIKey("APIKEYS", APIKey{Name: "ci", Scopes: []string{"users.read"}})
+	assert.Error(t, err, "keys shouldn't be created before initializing scopes")
+
+	key := APIKey{Name: " ci ", Scopes: []string{"Users.Read", "users.read"}}
+	require.NoError(t, key.Validate())
+	assert.Equal(t, "ci", key.Name)
+	assert.Equal(t, []string{"users.read"}, key.Scopes)
+	assert.Error(t, (&APIKey{Name: "ci", Scopes: []string{"roles.read"}}).Validate())
+	assert.Error(t, (&APIKey{Name: "ci"}).Validate())
+
+	// Keys are created with Keto, so this one is stored as is.
+	key.ID, key.Subject, key.ExpiresAt = "0123456789abcdef", "APIKEYS", time.Now().Add(time.Hour)
+	token := APIKeyPrefix + key.ID + ".secret"
+	require.NoError(t, util.GetStore(APIKeysPath).Set(key.ID, apiKeyRecord{APIKey: key, Hash: hashAPIKey(token)}))
+	assert.True(t, IsAPIKey(token))
+	assert.False(t, IsAPIKey("hydra.token"))
+
+	found, err := lookupAPIKey(token)
+	require.NoError(t, err)
+	assert.Equal(t, "APIKEYS", found.Subject)
+	_, err = lookupAPIKey(token + "x")
+	assert.Equal(t, util.ErrorInvalidToken, err)
+	_, err = lookupAPIKey(APIKeyPrefix + "x.secret")
+	assert.Equal(t, util.ErrorInvalidToken, err)
+
+	// Scopes which the key hasn't been created with aren't allowed, regardless of the roles.
+	rootTokenHash = new(string)
+	err = c.AuthorizeToken(token, Scope{Method: "PUT", URI: "/users/foo"})
+	assert.EqualError(t, err, "access: invalid token or unauthorized")
+
+	keys, err := c.ListAPIKeys("APIKEYS")
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, key.ID, keys[0].ID)
+
+	assert.Equal(t, ErrorAPIKeyNotFound, c.RevokeAPIKey("OTHER", key.ID))
+	require.NoError(t, c.RevokeAPIKey("APIKEYS", key.ID))
+	_, err = lookupAPIKey(token)
+	assert.Equal(t, util.ErrorInvalidToken, err)
+
+	// Expired keys are invalid, and they're removed when listing keys.
+	key.ExpiresAt = time.Now().Add(-time.Minute)
+	require.NoError(t, util.GetStore(APIKeysPath).Set(key.ID, apiKeyRecord{APIKey: key, Hash: hashAPIKey(token)}))
+	_, err = lookupAPIKey(token)
+	assert.Equal(t, util.ErrorInvalidToken, err)
+	keys, err = c.ListAPIKeys("APIKEYS")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+	ids, err := util.GetStore(APIKeysPath).List()
+	require.NoError(t, err)
+	assert.Empty(t, ids)
+
+	// Keys are removed along with purged users, even without Keto.
+	key.ExpiresAt = time.Now().Add(time.Hour)
+	require.NoError(t, util.GetStore(APIKeysPath).Set(key.ID, apiKeyRecord{APIKey: key, Hash: hashAPIKey(token)}))
+	_, err = usersController.RemoveUserResource("APIKEYS", nil)
+	require.NoError(t, err)
+	purged, err := usersController.PurgeDeletedResources()
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	ids, err = util.GetStore(APIKeysPath).List()
+	require.NoError(t, err)
+	assert.Empty(t, ids)
+}
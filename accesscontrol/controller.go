@@ -1,6 +1,7 @@
 package accesscontrol
 
 import (
+	"crypto/subtle"
 	"errors"
 	"log"
 
@@ -8,11 +9,15 @@ import (
 	"gitlab.com/omnijar/arusha/util"
 )
 
+const (
+	roleVersionsPath = "/role-versions"
+)
+
 var (
-	allScopes    []Scope
-	scopeNameMap map[string]int
-	scopeTree    *ScopeRouteTree
-	rootToken    *string
+	allScopes     []Scope
+	scopeNameMap  map[string]int
+	scopeTree     *ScopeRouteTree
+	rootTokenHash *string
 	// ErrorScopesInitialized occurs when scopes have already been initialized.
 	ErrorScopesInitialized = errors.New("scopes have already been initialized. Please perform an update request to update them")
 	usersController        = users.NewController()
@@ -21,35 +26,36 @@ var (
 // Controller for managing scopes for access control.
 type Controller struct{}
 
+func init() {
+	// Remove purged users from the roles they're members of (if Keto has been configured), along
+	// with their API keys.
+	users.OnPurge(func(user users.UserResource) error {
+		if err := removeAPIKeys(user.ID); err != nil {
+			return err
+		}
+
+		if err := util.RemoveSubjectFromRoles(user.ID); err != nil && err != util.ErrorRBACNotInitialized {
+			return err
+		}
+
+		return nil
+	})
+}
+
 // InitializeScopes for this controller. Each call will replace all existing scopes.
 // If this method fails, then `Reset` should be called to clear unusable scopes from memory.
 func (c *Controller) InitializeScopes(scopes []Scope) (*string, error) {
-	if rootToken != nil {
+	if rootTokenHash != nil {
 		return nil, ErrorScopesInitialized
 	}
 
-	allScopes = *new([]Scope)
-	scopeNames := *new([]string)
-	scopeNameMap = make(map[string]int)
-	scopeTree = NewScopeRouteTree()
-
-	for _, scope := range scopes {
-		if err := scope.Validate(); err != nil {
-			return nil, err
-		}
-
-		if _, exists := scopeNameMap[scope.Name]; exists {
-			return nil, errors.New("scope: " + scope.Name + " already exists")
-		}
-
-		scopeIdx := len(allScopes)
-		allScopes = append(allScopes, scope)
-		scopeNames = append(scopeNames, scope.Name)
-		scopeNameMap[scope.Name] = scopeIdx
-		scopeTree.AddRoute(scope.Method, scope.URI, scopeIdx)
+	scopeNames, err := setScopes(scopes)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := util.InitializeRootHydraClient(scopeNames); err != nil {
+	secret, err := util.InitializeRootHydraClient(scopeNames, "")
+	if err != nil {
 		return nil, err
 	}
 
@@ -57,14 +63,21 @@ func (c *Controller) InitializeScopes(scopes []Scope) (*string, error) {
 		return nil, err
 	}
 
+	// Only the hash of the root token is kept, so that the scopes can be restored (after
+	// restarts or from backups) without exposing the token.
 	token := util.RandomAlphaNumeric(64)
-	rootToken = &token
-	return rootToken, nil
+	state := ScopeState{Scopes: allScopes, RootTokenHash: hashRootToken(token), RootClientSecret: secret}
+	if err := util.GetStore(scopesPath).Set(scopeStateKey, state); err != nil {
+		return nil, err
+	}
+
+	rootTokenHash = &state.RootTokenHash
+	return &token, nil
 }
 
 // GetScopes from this controller. This requires the scopes to be initialized first.
 func (c *Controller) GetScopes() ([]Scope, error) {
-	if rootToken == nil {
+	if rootTokenHash == nil {
 		return nil, errors.New("scopes haven't been initialized")
 	}
 
@@ -76,9 +89,11 @@ func (c *Controller) Reset() {
 	allScopes = nil
 	scopeNameMap = nil
 	scopeTree = nil
+	rootTokenHash = nil
 }
 
-// AuthorizeToken for the given action.
+// AuthorizeToken for the given action. The token is either from Hydra or of an API key, and
+// API keys only allow the scopes they've been created with (on top of the subject's roles).
 func (c *Controller) AuthorizeToken(token string, scope Scope) error {
 	if err := scope.ValidateMethodAndURI(); err != nil {
 		return err
@@ -100,7 +115,17 @@ func (c *Controller) AuthorizeToken(token string, scope Scope) error {
 		return util.ErrorInvalidToken
 	}
 
-	subject, err := util.AuthorizeToken(token)
+	var key *APIKey
+	var subject *string
+	var err error
+	if IsAPIKey(token) {
+		if key, err = lookupAPIKey(token); err == nil {
+			subject = &key.Subject
+		}
+	} else {
+		subject, err = util.AuthorizeToken(token)
+	}
+
 	if err != nil {
 		return err
 	}
@@ -108,6 +133,10 @@ func (c *Controller) AuthorizeToken(token string, scope Scope) error {
 	// FIXME: We're checking each scope. Is this the only way with Keto?
 	for _, scopeIdx := range scopeIndices {
 		scopeName := allScopes[scopeIdx].Name
+		if key != nil && !key.allowsScope(scopeName) {
+			continue
+		}
+
 		if allowed, err := util.IsSubjectAuthorized(*subject, scopeName); allowed {
 			if err != nil {
 				log.Printf(err.Error())
@@ -122,12 +151,12 @@ func (c *Controller) AuthorizeToken(token string, scope Scope) error {
 
 // IsRootToken matching the given subject token?
 func (c *Controller) IsRootToken(token string) bool {
-	if rootToken == nil {
+	if rootTokenHash == nil {
 		log.Println("access: scopes haven't been initialized. all requests will be allowed.")
 		return true
 	}
 
-	return token == *rootToken
+	return subtle.ConstantTimeCompare([]byte(hashRootToken(token)), []byte(*rootTokenHash)) == 1
 }
 
 // CreateRole using the given data.
@@ -140,33 +169,80 @@ func (c *Controller) CreateRole(role Role) (*Role, error) {
 		return nil, err
 	}
 
+	role.Version = 1
+	if err := util.GetStore(roleVersionsPath).Set(role.ID, role.Version); err != nil {
+		return nil, err
+	}
+
 	return &role, nil
 }
 
-// UpdateRole using the given data.
-func (c *Controller) UpdateRole(id string, role Role) (*Role, error) {
+// UpdateRole using the given data. If a version is given, then it should match the current
+// version of the role (see `util.CheckVersion` for its limits).
+func (c *Controller) UpdateRole(id string, role Role, version *int) (*Role, error) {
 	if err := role.Validate(); err != nil {
 		return nil, err
 	}
 
+	current, err := c.getRoleVersion(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := util.CheckVersion(version, current); err != nil {
+		return nil, err
+	}
+
 	if err := util.UpdateRole(id, role.ID, role.Description, role.Members, role.Scopes); err != nil {
 		return nil, err
 	}
 
+	store := util.GetStore(roleVersionsPath)
+	if role.ID != id {
+		if err := store.Remove(id); err != nil {
+			return nil, err
+		}
+	}
+
+	role.Version = current + 1
+	if err := store.Set(role.ID, role.Version); err != nil {
+		return nil, err
+	}
+
 	return &role, nil
 }
 
-// DeleteRole using the given ID.
-func (c *Controller) DeleteRole(id string) error {
+// DeleteRole using the given ID. If a version is given, then it should match the current
+// version of the role.
+func (c *Controller) DeleteRole(id string, version *int) error {
 	if id == util.AdminRole {
 		return errors.New("admin role cannot be deleted")
 	}
 
+	current, err := c.getRoleVersion(id)
+	if err != nil {
+		return err
+	}
+
+	if err := util.CheckVersion(version, current); err != nil {
+		return err
+	}
+
 	if err := util.DeleteRole(id); err != nil {
 		return err
 	}
 
-	return nil
+	return util.GetStore(roleVersionsPath).Remove(id)
+}
+
+// getRoleVersion for the given ID. Roles created before versioning have version 0.
+func (c *Controller) getRoleVersion(id string) (int, error) {
+	var version int
+	if err := util.GetStore(roleVersionsPath).Get(id, &version); err != nil && err != util.ErrorKeyNotFound {
+		return 0, err
+	}
+
+	return version, nil
 }
 
 // ListRoles from Arusha.
@@ -178,11 +254,17 @@ func (c *Controller) ListRoles() ([]Role, error) {
 
 	arushaRoles := *new([]Role)
 	for i := range roles {
+		version, err := c.getRoleVersion(roles[i].Id)
+		if err != nil {
+			return nil, err
+		}
+
 		role := Role{
 			ID:          roles[i].Id,
 			Description: policies[i].Description,
 			Members:     roles[i].Members,
 			Scopes:      policies[i].Resources,
+			Version:     version,
 		}
 
 		arushaRoles = append(arushaRoles, role)
@@ -198,10 +280,16 @@ func (c *Controller) GetRole(id string) (*Role, error) {
 		return nil, err
 	}
 
+	version, err := c.getRoleVersion(role.Id)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Role{
 		ID:          role.Id,
 		Description: policy.Description,
 		Members:     role.Members,
 		Scopes:      policy.Resources,
+		Version:     version,
 	}, nil
 }
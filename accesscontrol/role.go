@@ -5,12 +5,14 @@ import (
 	"strings"
 )
 
-// Role contains the access information (scopes) for members.
+// Role contains the access information (scopes) for members. The version is incremented
+// on every update (for detecting concurrent modifications).
 type Role struct {
 	ID          string   `json:"name"`
 	Description string   `json:"description"`
 	Members     []string `json:"members"`
 	Scopes      []string `json:"scopes"`
+	Version     int      `json:"version"`
 }
 
 // Validate this role for possible errors.
@@ -21,6 +21,10 @@ const (
 	ScopesSelfPath = ScopesPath + "/init"
 	// ScopesAuthorizePath for authorizing a request to the given URL.
 	ScopesAuthorizePath = ScopesPath + "/authorize"
+	// APIKeysRoutePath for creating and listing the API keys of the user of the bearer token.
+	APIKeysRoutePath = "/api-keys"
+	// APIKeyRoutePath for revoking an API key of the user of the bearer token.
+	APIKeyRoutePath = APIKeysRoutePath + "/:id"
 )
 
 var (
@@ -50,6 +54,11 @@ func (h *RouteHandler) SetRoutes(r *httprouter.Router) {
 	r.GET(RolePath, h.GetRole)
 	r.PUT(RolePath, h.UpdateRole)
 	r.DELETE(RolePath, h.DeleteRole)
+	r.OPTIONS(APIKeysRoutePath, util.PassEmptyBody)
+	r.POST(APIKeysRoutePath, h.CreateAPIKey)
+	r.GET(APIKeysRoutePath, h.ListAPIKeys)
+	r.OPTIONS(APIKeyRoutePath, util.PassEmptyBody)
+	r.DELETE(APIKeyRoutePath, h.RevokeAPIKey)
 }
 
 // InitializeScopes for this Arusha instance. This can only be done once.
@@ -171,7 +180,8 @@ func (h *RouteHandler) CreateRole(w http.ResponseWriter, r *http.Request, params
 	json.NewEncoder(w).Encode(newRole)
 }
 
-// UpdateRole corresponding to an ID with the given scopes and members.
+// UpdateRole corresponding to an ID with the given scopes and members. If the If-Match header
+// is set, then it should match the current version of the role.
 func (h *RouteHandler) UpdateRole(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	roleID := params.ByName("id")
 	var role Role
@@ -186,23 +196,37 @@ func (h *RouteHandler) UpdateRole(w http.ResponseWriter, r *http.Request, params
 		return
 	}
 
-	newRole, err := controller.UpdateRole(roleID, role)
+	version, err := util.ParseIfMatch(r)
 	if err != nil {
 		util.RespondHTTPError(w, err, http.StatusBadRequest)
 		return
 	}
 
+	newRole, err := controller.UpdateRole(roleID, role, version)
+	if err != nil {
+		util.RespondHTTPError(w, err, util.StatusCodeForError(err, http.StatusBadRequest))
+		return
+	}
+
+	util.SetETag(w, newRole.Version)
 	json.NewEncoder(w).Encode(newRole)
 }
 
-// DeleteRole corresponding to an ID.
+// DeleteRole corresponding to an ID. If the If-Match header is set, then it should match the
+// current version of the role.
 func (h *RouteHandler) DeleteRole(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	roleID := params.ByName("id")
-	if err := controller.DeleteRole(roleID); err != nil {
+	version, err := util.ParseIfMatch(r)
+	if err != nil {
 		util.RespondHTTPError(w, err, http.StatusBadRequest)
 		return
 	}
 
+	if err := controller.DeleteRole(roleID, version); err != nil {
+		util.RespondHTTPError(w, err, util.StatusCodeForError(err, http.StatusBadRequest))
+		return
+	}
+
 	util.RespondHTTPStatusOK(w)
 }
 
@@ -233,5 +257,75 @@ func (h *RouteHandler) GetRole(w http.ResponseWriter, r *http.Request, params ht
 		return
 	}
 
+	util.SetETag(w, role.Version)
 	json.NewEncoder(w).Encode(role)
 }
+
+// CreateAPIKey for the user of the bearer token, and respond with the key along with its token.
+// The token is only returned here. Keys can only be managed with tokens from Hydra, so that
+// leaked keys cannot be used for creating more of them.
+func (h *RouteHandler) CreateAPIKey(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	subject, err := util.AuthorizeToken(util.BearerToken(r))
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	var key APIKey
+	if r.Body == nil {
+		util.RespondHTTPError(w, util.ErrorHTTPNoBody, http.StatusBadRequest)
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&key); err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	created, token, err := controller.CreateAPIKey(*subject, key)
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		*APIKey
+		Token string `json:"token"`
+	}{created, token})
+}
+
+// ListAPIKeys of the user of the bearer token.
+func (h *RouteHandler) ListAPIKeys(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	subject, err := util.AuthorizeToken(util.BearerToken(r))
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	keys, err := controller.ListAPIKeys(*subject)
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(keys)
+}
+
+// RevokeAPIKey of the user of the bearer token.
+func (h *RouteHandler) RevokeAPIKey(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	subject, err := util.AuthorizeToken(util.BearerToken(r))
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	if err := controller.RevokeAPIKey(*subject, params.ByName("id")); err == ErrorAPIKeyNotFound {
+		util.RespondHTTPError(w, err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		util.RespondHTTPError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	util.RespondHTTPStatusOK(w)
+}
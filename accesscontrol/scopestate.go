@@ -0,0 +1,130 @@
+package accesscontrol
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"gitlab.com/omnijar/arusha/util"
+)
+
+const (
+	scopesPath    = "/scopes"
+	scopeStateKey = "state"
+)
+
+// ScopeState has the scopes of this Arusha instance along with the hash of its root token,
+// and the secret of its root client in Hydra. It's kept in the store, so that scopes survive
+// restarts and can be backed up, and so that all hosts share the same client.
+type ScopeState struct {
+	Scopes           []Scope `json:"scopes"`
+	RootTokenHash    string  `json:"rootTokenHash"`
+	RootClientSecret string  `json:"rootClientSecret,omitempty"`
+}
+
+// LoadScopes which have been initialized previously (if any). This also loads the root
+// client in Hydra for the scopes, without replacing it.
+func (c *Controller) LoadScopes() error {
+	state, err := c.GetScopeState()
+	if err != nil || state == nil {
+		return err
+	}
+
+	return c.loadScopeState(state, false)
+}
+
+// loadScopeState into memory, along with the root client in Hydra. The client is replaced when
+// restoring the state (or when its secret hasn't been kept, for scopes initialized before the
+// secret was kept in the state), otherwise it's reused.
+func (c *Controller) loadScopeState(state *ScopeState, replaceClient bool) error {
+	scopeNames, err := setScopes(state.Scopes)
+	if err != nil {
+		c.Reset()
+		return err
+	}
+
+	if replaceClient || state.RootClientSecret == "" {
+		secret, err := util.InitializeRootHydraClient(scopeNames, state.RootClientSecret)
+		if err != nil {
+			c.Reset()
+			return err
+		}
+
+		state.RootClientSecret = secret
+		if err := util.GetStore(scopesPath).Set(scopeStateKey, state); err != nil {
+			c.Reset()
+			return err
+		}
+	} else if err := util.LoadRootHydraClient(scopeNames, state.RootClientSecret); err != nil {
+		c.Reset()
+		return err
+	}
+
+	rootTokenHash = &state.RootTokenHash
+	return nil
+}
+
+// GetScopeState from the store (or nil, if the scopes haven't been initialized).
+func (c *Controller) GetScopeState() (*ScopeState, error) {
+	var state ScopeState
+	if err := util.GetStore(scopesPath).Get(scopeStateKey, &state); err == util.ErrorKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// RestoreScopes from a previous state (e.g., from a backup). This replaces the existing scopes.
+func (c *Controller) RestoreScopes(state ScopeState) error {
+	if state.RootTokenHash == "" {
+		return errors.New("scopes: root token is missing in the state")
+	}
+
+	return c.loadScopeState(&state, true)
+}
+
+// RestoreRole from a backup. This replaces the existing role (if any) and keeps its version.
+func (c *Controller) RestoreRole(role Role) error {
+	if err := util.DeleteRole(role.ID); err != nil && err != util.ErrorRoleNotFound {
+		return err
+	}
+
+	if err := util.CreateRole(role.ID, role.Description, role.Members, role.Scopes); err != nil {
+		return err
+	}
+
+	return util.GetStore(roleVersionsPath).Set(role.ID, role.Version)
+}
+
+// setScopes in memory (after validating them) and return their names.
+func setScopes(scopes []Scope) ([]string, error) {
+	allScopes = *new([]Scope)
+	scopeNames := *new([]string)
+	scopeNameMap = make(map[string]int)
+	scopeTree = NewScopeRouteTree()
+
+	for _, scope := range scopes {
+		if err := scope.Validate(); err != nil {
+			return nil, err
+		}
+
+		if _, exists := scopeNameMap[scope.Name]; exists {
+			return nil, errors.New("scope: " + scope.Name + " already exists")
+		}
+
+		scopeIdx := len(allScopes)
+		allScopes = append(allScopes, scope)
+		scopeNames = append(scopeNames, scope.Name)
+		scopeNameMap[scope.Name] = scopeIdx
+		scopeTree.AddRoute(scope.Method, scope.URI, scopeIdx)
+	}
+
+	return scopeNames, nil
+}
+
+// hashRootToken with SHA-256.
+func hashRootToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
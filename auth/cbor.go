@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+const (
+	// maxCBORDepth of nested arrays and maps (WebAuthn data is only a few levels deep).
+	maxCBORDepth = 16
+)
+
+var (
+	// ErrorInvalidCBOR occurs when decoding malformed (or unsupported) CBOR data.
+	ErrorInvalidCBOR = errors.New("auth: invalid CBOR data")
+)
+
+// decodeCBOR decodes the first CBOR item in the data, and returns it along with the number of
+// bytes it has taken. Only the subset of CBOR used by WebAuthn is supported (definite lengths,
+// no tags or floats). Items are decoded to `int64`, `[]byte`, `string`, `bool`, nil,
+// `[]interface{}` and `map[interface{}]interface{}` (with `int64` or `string` keys).
+func decodeCBOR(data []byte) (interface{}, int, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (interface{}, int, error) {
+	if len(data) == 0 || depth > maxCBORDepth {
+		return nil, 0, ErrorInvalidCBOR
+	}
+
+	major, info := data[0]>>5, data[0]&0x1f
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, 1, nil
+		case 21:
+			return true, 1, nil
+		case 22:
+			return nil, 1, nil
+		default:
+			return nil, 0, ErrorInvalidCBOR
+		}
+	}
+
+	argument, offset, err := decodeCBORArgument(data, info)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch major {
+	case 0, 1:
+		if argument > math.MaxInt64 {
+			return nil, 0, ErrorInvalidCBOR
+		}
+
+		if major == 1 {
+			return -1 - int64(argument), offset, nil
+		}
+
+		return int64(argument), offset, nil
+	case 2, 3:
+		if argument > uint64(len(data)-offset) {
+			return nil, 0, ErrorInvalidCBOR
+		}
+
+		end := offset + int(argument)
+		if major == 3 {
+			return string(data[offset:end]), end, nil
+		}
+
+		return append([]byte{}, data[offset:end]...), end, nil
+	case 4:
+		// Every item takes at least a byte, so this also bounds the allocation.
+		if argument > uint64(len(data)-offset) {
+			return nil, 0, ErrorInvalidCBOR
+		}
+
+		items := make([]interface{}, argument)
+		for i := range items {
+			item, size, err := decodeCBORItem(data[offset:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			items[i], offset = item, offset+size
+		}
+
+		return items, offset, nil
+	case 5:
+		if argument > uint64(len(data)-offset) {
+			return nil, 0, ErrorInvalidCBOR
+		}
+
+		items := make(map[interface{}]interface{}, argument)
+		for i := uint64(0); i < argument; i++ {
+			key, size, err := decodeCBORItem(data[offset:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, 0, ErrorInvalidCBOR
+			}
+
+			value, valueSize, err := decodeCBORItem(data[offset+size:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			items[key], offset = value, offset+size+valueSize
+		}
+
+		return items, offset, nil
+	default:
+		return nil, 0, ErrorInvalidCBOR
+	}
+}
+
+// decodeCBORArgument (the length or value) following the initial byte of an item, and return it
+// along with the offset of the item's content.
+func decodeCBORArgument(data []byte, info byte) (uint64, int, error) {
+	switch {
+	case info < 24:
+		return uint64(info), 1, nil
+	case info > 27:
+		return 0, 0, ErrorInvalidCBOR
+	}
+
+	size := 1 << (info - 24)
+	if len(data) < 1+size {
+		return 0, 0, ErrorInvalidCBOR
+	}
+
+	switch size {
+	case 1:
+		return uint64(data[1]), 2, nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(data[1:])), 3, nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(data[1:])), 5, nil
+	default:
+		return binary.BigEndian.Uint64(data[1:]), 9, nil
+	}
+}
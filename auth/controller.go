@@ -2,83 +2,150 @@ package auth
 
 import (
 	"errors"
+	"log"
 
 	"gitlab.com/omnijar/arusha/users"
 	"gitlab.com/omnijar/arusha/util"
 )
 
 const (
-	credentialsPath = "/credentials"
+	// CredentialsPath has the secret hashes of users.
+	CredentialsPath = "/credentials"
 )
 
 var (
+	// ErrorEmailNotVerified occurs when an unverified email is used for logging in or
+	// resetting the secret.
+	ErrorEmailNotVerified = errors.New("auth: email hasn't been verified")
+	// ErrorUnsupportedSecretHash occurs when importing a secret hash in an unknown format.
+	ErrorUnsupportedSecretHash = errors.New("auth: unsupported secret hash")
+
 	usersController = users.NewController()
 )
 
 // Controller blah
 type Controller struct{}
 
-// FIXME: Instead of hashing the secret directly, prefer salted hashing.
+func init() {
+	// Remove the credentials (along with the history of secrets, second factors and failed logins)
+	// of purged users.
+	users.OnPurge(func(user users.UserResource) error {
+		if err := util.GetStore(CredentialHistoryPath).Remove(user.ID); err != nil {
+			return err
+		}
 
-// Add a credential to the auth service.
-func (c *Controller) Add(credential Credential) (*users.UserResource, error) {
-	if err := credential.ValidateToken(); err != nil {
-		return nil, err
-	}
+		if err := util.GetStore(TOTPPath).Remove(user.ID); err != nil {
+			return err
+		}
+
+		if err := util.GetStore(WebAuthnPath).Remove(user.ID); err != nil {
+			return err
+		}
 
+		if err := util.GetStore(RecoveryCodesPath).Remove(user.ID); err != nil {
+			return err
+		}
+
+		if err := lockoutStore(LockoutKindUser).Remove(user.ID); err != nil {
+			return err
+		}
+
+		if err := util.RemoveLoginSessions(user.ID); err != nil {
+			return err
+		}
+
+		return util.GetStore(CredentialsPath).Remove(user.ID)
+	})
+}
+
+// Add a credential to the auth service. The secret should meet the secret policy, and the email
+// verification token (or code) is consumed once the credential can be created. Wrong codes count
+// as failed logins of the user and the source address.
+func (c *Controller) Add(credential Credential, address string) (*users.UserResource, error) {
 	// FIXME: We're checking the token anyway, do we really need another route?
 
-	emailVault := util.GetVaultClient(users.VaultEmailVerifyPath)
-	var email string
-	if emailExists := emailVault.Get(credential.Token, &email); !emailExists {
-		return nil, errors.New("auth: invalid token")
+	token, err := lookupVerification(credential, address)
+	if err != nil {
+		return nil, err
 	}
 
 	credential.ID = ""
-	credential.Email = email
+	credential.Email = token.Value
 	user, err := c.getResource(&credential)
 	if err != nil {
 		return nil, err
 	}
 
-	if !user.Verified {
-		usersController.VerifyEmail(email)
-		// return nil, errors.New("auth: credentials cannot be created before verifying email")
+	if user.ID != token.Subject {
+		return nil, util.ErrorTokenInvalid
 	}
 
-	emailVault.Remove(credential.Token)
-
-	secretVault := util.GetVaultClient(credentialsPath)
+	if err := CurrentSecretPolicy().Check(credential.Secret, user); err != nil {
+		return nil, err
+	}
 
 	var hash string
-	if hashExists := secretVault.Get(user.ID, &hash); hashExists {
+	if err := util.GetStore(CredentialsPath).Get(user.ID, &hash); err == nil {
 		return nil, errors.New("auth: credentials have already been created")
+	} else if err != util.ErrorKeyNotFound {
+		return nil, err
+	}
+
+	if err := consumeVerification(credential); err != nil {
+		return nil, err
+	}
+
+	if !user.IsVerifiedEmail(token.Value) {
+		if err := usersController.VerifyEmail(token.Value); err != nil {
+			return nil, err
+		}
+		// return nil, errors.New("auth: credentials cannot be created before verifying email")
+	}
+
+	if err := c.setSecret(user.ID, credential.Secret); err != nil {
+		return nil, err
 	}
 
-	hash = HashSecret(credential.Secret)
-	secretVault.Set(user.ID, hash)
 	return user, nil
 }
 
-// VerifyEmailToken for verifying registered emails.
-func (c *Controller) VerifyEmailToken(credential Credential) (*users.UserResource, error) {
-	if err := credential.ValidateToken(); err != nil {
+// VerifyEmailToken for verifying registered emails, with either the token from the link or the
+// email and the code sent along with it. The token (or code) is only consumed if the user already
+// has credentials, since new users need it for creating their credentials (see `Add`).
+func (c *Controller) VerifyEmailToken(credential Credential, address string) (*users.UserResource, error) {
+	token, err := lookupVerification(credential, address)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := usersController.FindUserResourceByEmail(token.Value)
+	if err != nil {
 		return nil, err
+	} else if user.ID != token.Subject {
+		return nil, util.ErrorTokenInvalid
 	}
 
-	vault := util.GetVaultClient(users.VaultEmailVerifyPath)
+	hash, err := c.GetSecretHash(user.ID)
+	if err != nil {
+		return nil, err
+	}
 
-	var email string
-	if emailExists := vault.Get(credential.Token, &email); !emailExists {
-		return nil, errors.New("auth: invalid token")
+	if hash != nil {
+		if err := consumeVerification(credential); err != nil {
+			return nil, err
+		}
 	}
 
-	usersController.VerifyEmail(email)
+	if err := usersController.VerifyEmail(token.Value); err != nil {
+		return nil, err
+	}
 
-	return usersController.FindUserResourceByEmail(email)
+	return usersController.FindUserResourceByEmail(token.Value)
 }
 
-// ResetSecret of a credential in the auth service.
+// ResetSecret of a credential in the auth service. The new secret should meet the secret policy,
+// and it shouldn't match any of the user's recent secrets. The token is only consumed once the
+// new secret has passed these checks, so that the user can retry with another one.
 func (c *Controller) ResetSecret(credential Credential) error {
 	if err := credential.ValidateSecret(); err != nil {
 		return err
@@ -88,23 +155,83 @@ func (c *Controller) ResetSecret(credential Credential) error {
 		return err
 	}
 
-	tokenVault := util.GetVaultClient(users.VaultResetTokenPath)
+	token, err := util.LookupToken(util.TokenPurposeResetSecret, credential.Token)
+	if err != nil {
+		return err
+	}
 
-	var userID string
-	if userExists := tokenVault.Get(credential.Token, &userID); !userExists {
-		return errors.New("auth: invalid token")
+	user, err := usersController.FindUserResourceByID(token.Subject)
+	if err != nil {
+		return err
 	}
 
-	tokenVault.Remove(credential.Token)
+	if err := CurrentSecretPolicy().Check(credential.Secret, user); err != nil {
+		return err
+	}
 
-	secretVault := util.GetVaultClient(credentialsPath)
-	hash := HashSecret(credential.Secret)
-	secretVault.Set(userID, hash)
+	if err := checkSecretReuse(user.ID, credential.Secret); err != nil {
+		return err
+	}
 
-	return nil
+	if _, err := util.ConsumeToken(util.TokenPurposeResetSecret, credential.Token); err != nil {
+		return err
+	}
+
+	if err := c.setSecret(user.ID, credential.Secret); err != nil {
+		return err
+	}
+
+	// The user has proven their identity, so the lockout (if any) is cleared as well.
+	return c.ClearLockout(LockoutKindUser, user.ID)
+}
+
+// ChangeSecret of the given (logged in) user, who has to supply the current secret as well. Like
+// `ResetSecret`, the new secret should meet the policy and it shouldn't match any recent secrets.
+// Wrong secrets count as failed logins. Once it's changed, any pending secret reset tokens are
+// revoked, and the user is notified by email.
+func (c *Controller) ChangeSecret(userID string, credential Credential) (*users.UserResource, error) {
+	user, err := usersController.FindUserResourceByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkLockout(LockoutKindUser, user.ID); err != nil {
+		return nil, err
+	}
+
+	var hash string
+	if err := util.GetStore(CredentialsPath).Get(user.ID, &hash); err == util.ErrorKeyNotFound {
+		return nil, errors.New("auth: credentials don't exist. cannot change secret")
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !CheckSecretHash(credential.Secret, hash) {
+		recordLoginFailure(LockoutKindUser, user.ID)
+		return nil, errors.New("auth: wrong secret")
+	}
+
+	if err := CurrentSecretPolicy().Check(credential.NewSecret, user); err != nil {
+		return nil, err
+	}
+
+	if err := c.setSecret(user.ID, credential.NewSecret); err != nil {
+		return nil, err
+	}
+
+	if err := util.RevokeTokens(func(token util.Token) bool {
+		return token.Purpose == util.TokenPurposeResetSecret && token.Subject == user.ID
+	}); err != nil {
+		return nil, err
+	}
+
+	go util.SendSecretChangedMail(user.Email)
+
+	return user, nil
 }
 
 // InitiateSecretReset sends a mail to the suspect's registered email to verify their identity.
+// Any of the user's verified emails can be used.
 func (c *Controller) InitiateSecretReset(credential Credential) error {
 	if err := credential.ValidateEmail(); err != nil {
 		return err
@@ -115,35 +242,152 @@ func (c *Controller) InitiateSecretReset(credential Credential) error {
 		return err
 	}
 
-	token := util.GenerateRandomToken()
-	vault := util.GetVaultClient(users.VaultResetTokenPath)
-	vault.Set(token, user.ID)
-	go util.SendSecretResetMail(user.Email, token)
+	if !user.IsVerifiedEmail(credential.Email) {
+		return ErrorEmailNotVerified
+	}
+
+	token, err := util.MintToken(nil, util.TokenPurposeResetSecret, user.ID, credential.Email)
+	if err != nil {
+		return err
+	}
+
+	go util.SendSecretResetMail(credential.Email, token)
 
 	return nil
 }
 
-// Login user to service.
-func (c *Controller) Login(credential Credential) (*users.UserResource, error) {
+// Login user to service. Failed logins are tracked for the user and the source address (if
+// known), and logins are blocked for a while after too many failures.
+func (c *Controller) Login(credential Credential, address string) (*users.UserResource, error) {
+	if err := checkLockout(LockoutKindAddress, address); err != nil {
+		return nil, err
+	}
+
 	user, err := c.getResource(&credential)
 	if err != nil {
+		recordLoginFailure(LockoutKindAddress, address)
 		return nil, err
 	}
 
-	vault := util.GetVaultClient(credentialsPath)
+	if err := checkLockout(LockoutKindUser, user.ID); err != nil {
+		return nil, err
+	}
+
+	// Only verified emails can be used for logging in.
+	if credential.ID == "" && !user.IsVerifiedEmail(credential.Email) {
+		return nil, ErrorEmailNotVerified
+	}
+
+	store := util.GetStore(CredentialsPath)
 
 	var hash string
-	if hashExists := vault.Get(user.ID, &hash); !hashExists {
+	if err := store.Get(user.ID, &hash); err == util.ErrorKeyNotFound {
 		return nil, errors.New("auth: credentials don't exist. cannot login")
+	} else if err != nil {
+		return nil, err
 	}
 
 	if isMatchingSecret := CheckSecretHash(credential.Secret, hash); !isMatchingSecret {
+		recordLoginFailure(LockoutKindUser, user.ID)
+		recordLoginFailure(LockoutKindAddress, address)
 		return nil, errors.New("auth: wrong secret")
 	}
 
+	if err := lockoutStore(LockoutKindUser).Remove(user.ID); err != nil {
+		log.Printf("auth: error clearing failed logins of user %s: %s", user.ID, err)
+	}
+
+	// Older (or weaker) hashes are replaced while the secret is at hand. This shouldn't
+	// block the login, since the existing hash still works.
+	if NeedsRehash(hash) {
+		if rehashed, err := HashSecret(credential.Secret); err != nil {
+			log.Printf("auth: error rehashing secret of user %s: %s", user.ID, err)
+		} else if err := store.Set(user.ID, rehashed); err != nil {
+			log.Printf("auth: error storing rehashed secret of user %s: %s", user.ID, err)
+		}
+	}
+
 	return user, nil
 }
 
+// ImportSecretHash for the given user. The hash should be in one of the supported formats
+// (see `IsSupportedSecretHash`), and it replaces the existing one (if any).
+func (c *Controller) ImportSecretHash(userID, hash string) error {
+	if !IsSupportedSecretHash(hash) {
+		return ErrorUnsupportedSecretHash
+	}
+
+	return util.GetStore(CredentialsPath).Set(userID, hash)
+}
+
+// GetSecretHash of the given user (or nil, if the user hasn't set a secret).
+func (c *Controller) GetSecretHash(userID string) (*string, error) {
+	var hash string
+	if err := util.GetStore(CredentialsPath).Get(userID, &hash); err == util.ErrorKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &hash, nil
+}
+
+// lookupVerification of an email without consuming it, with either the token or the email and
+// the code of the credential.
+func lookupVerification(credential Credential, address string) (*util.Token, error) {
+	if credential.Code == "" {
+		if err := credential.ValidateToken(); err != nil {
+			return nil, err
+		}
+
+		return util.LookupToken(util.TokenPurposeVerifyEmail, credential.Token)
+	}
+
+	if err := credential.ValidateEmail(); err != nil {
+		return nil, err
+	}
+
+	return checkCode(util.TokenPurposeVerifyEmail, credential, address)
+}
+
+// checkCode of the credential for the given purpose without consuming it. Codes are short, so
+// like secrets, wrong ones count as failed logins of the user (if the email belongs to one) and
+// the source address, and they're refused while either of them is locked out.
+func checkCode(purpose string, credential Credential, address string) (*util.Token, error) {
+	if err := checkLockout(LockoutKindAddress, address); err != nil {
+		return nil, err
+	}
+
+	userID := ""
+	if user, err := usersController.FindUserResourceByEmail(credential.Email); err == nil {
+		userID = user.ID
+	}
+
+	if err := checkLockout(LockoutKindUser, userID); err != nil {
+		return nil, err
+	}
+
+	token, err := util.CheckCode(purpose, credential.Email, credential.Code)
+	if err == util.ErrorCodeInvalid {
+		recordLoginFailure(LockoutKindUser, userID)
+		recordLoginFailure(LockoutKindAddress, address)
+	}
+
+	return token, err
+}
+
+// consumeVerification of an email (see `lookupVerification`).
+func consumeVerification(credential Credential) error {
+	var err error
+	if credential.Code == "" {
+		_, err = util.ConsumeToken(util.TokenPurposeVerifyEmail, credential.Token)
+	} else {
+		_, err = util.ConsumeCode(util.TokenPurposeVerifyEmail, credential.Email, credential.Code)
+	}
+
+	return err
+}
+
 // GetResource gets the user resource for the given credential.
 func (c *Controller) getResource(credential *Credential) (*users.UserResource, error) {
 	if err := credential.Validate(); err != nil {
@@ -1,19 +1,12 @@
 package auth
 
 import (
-	"crypto/sha256"
 	"errors"
-	"fmt"
 	"strings"
 
 	"gitlab.com/omnijar/arusha/util"
 )
 
-const (
-	// MinSecretLength is the minimum length required for user's secret.
-	MinSecretLength = 8
-)
-
 // Credential has a number of purposes in an incoming payload.
 //
 // - For verifying an user's email, the Token field is set.
@@ -25,11 +18,18 @@ const (
 // with the verification link).
 // - When resetting the password, the Token (obtained from verification link) and (new) Secret
 // are set. If the token is valid and hasn't expired, then the secret is updated.
+// - When changing the password of a logged in user, the (current) Secret and the NewSecret are set.
+// - When logging in with a second factor, the Token (from the login's challenge) and either
+// the Code (e.g., from an authenticator app), the WebAuthn Assertion or a RecoveryCode are set.
 type Credential struct {
-	ID     string `json:"id"`
-	Email  string `json:"email"`
-	Secret string `json:"secret"`
-	Token  string `json:"token"`
+	ID           string            `json:"id"`
+	Email        string            `json:"email"`
+	Secret       string            `json:"secret"`
+	NewSecret    string            `json:"newSecret"`
+	Token        string            `json:"token"`
+	Code         string            `json:"code"`
+	RecoveryCode string            `json:"recoveryCode"`
+	Assertion    *WebAuthnResponse `json:"assertion,omitempty"`
 }
 
 // ValidateEmail validates the email field.
@@ -42,10 +42,11 @@ func (c *Credential) ValidateEmail() error {
 	return nil
 }
 
-// ValidateSecret validates the secret field.
+// ValidateSecret validates the secret field. Only empty secrets are rejected here, since new
+// secrets are checked against the secret policy (see `SecretPolicy`).
 func (c *Credential) ValidateSecret() error {
-	if len(c.Secret) < MinSecretLength {
-		return errors.New("credential: secret is too short")
+	if c.Secret == "" {
+		return errors.New("credential: secret required")
 	}
 
 	return nil
@@ -74,15 +75,3 @@ func (c *Credential) Validate() error {
 
 	return c.ValidateSecret()
 }
-
-// HashSecret hashes a given string as a secret with SHA-256.
-func HashSecret(secret string) string {
-	bytes := sha256.Sum256([]byte(secret))
-	return fmt.Sprintf("%x", bytes)
-}
-
-// CheckSecretHash compares a secret and a hash to ensure they match.
-func CheckSecretHash(secret, hash string) bool {
-	bytes := sha256.Sum256([]byte(secret))
-	return fmt.Sprintf("%x", bytes) == hash
-}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"errors"
+	"time"
+
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+const (
+	// CredentialHistoryPath has the hashes of the secrets replaced by users.
+	CredentialHistoryPath = "/credential-history"
+)
+
+var (
+	// ErrorSecretReused occurs when a new secret matches one of the user's recent secrets.
+	ErrorSecretReused = errors.New("auth: secret has been used recently. please choose another one")
+)
+
+// secretHistoryEntry is a secret hash replaced by the user.
+type secretHistoryEntry struct {
+	Hash       string    `json:"hash"`
+	ReplacedAt time.Time `json:"replacedAt"`
+}
+
+// setSecret of the user. The current secret (if any) is moved to the history, and the new secret
+// shouldn't match any of the recent secrets (including the current one).
+func (c *Controller) setSecret(userID, secret string) error {
+	history, err := recentSecrets(userID)
+	if err != nil {
+		return err
+	}
+
+	if isReusedSecret(secret, history) {
+		return ErrorSecretReused
+	}
+
+	hash, err := HashSecret(secret)
+	if err != nil {
+		return err
+	}
+
+	// The current secret counts as one of the recent secrets.
+	size := config.Default.SecretHistorySize - 1
+	if size < 0 {
+		size = 0
+	}
+
+	if len(history) > size {
+		history = history[:size]
+	}
+
+	tx := util.NewStoreTransaction()
+	if err := tx.Set(util.GetStore(CredentialsPath), userID, hash); err != nil {
+		return err
+	}
+
+	historyStore := util.GetStore(CredentialHistoryPath)
+	if len(history) == 0 {
+		err = tx.Remove(historyStore, userID)
+	} else {
+		err = tx.Set(historyStore, userID, history)
+	}
+
+	return tx.RollbackOnError(err)
+}
+
+// checkSecretReuse fails with `ErrorSecretReused` if the secret matches any of the user's recent
+// secrets, without changing anything.
+func checkSecretReuse(userID, secret string) error {
+	history, err := recentSecrets(userID)
+	if err != nil {
+		return err
+	}
+
+	if isReusedSecret(secret, history) {
+		return ErrorSecretReused
+	}
+
+	return nil
+}
+
+// recentSecrets of the user - the history, preceded by the current secret (if any, and if the
+// history is enabled).
+func recentSecrets(userID string) ([]secretHistoryEntry, error) {
+	var current string
+	if err := util.GetStore(CredentialsPath).Get(userID, &current); err == util.ErrorKeyNotFound {
+		current = ""
+	} else if err != nil {
+		return nil, err
+	}
+
+	history, err := loadSecretHistory(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if current != "" && config.Default.SecretHistorySize > 0 {
+		history = append([]secretHistoryEntry{{Hash: current, ReplacedAt: time.Now().UTC()}}, history...)
+	}
+
+	return history, nil
+}
+
+func isReusedSecret(secret string, history []secretHistoryEntry) bool {
+	for _, entry := range history {
+		if CheckSecretHash(secret, entry.Hash) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadSecretHistory of the user, without the entries older than the history period (if any).
+func loadSecretHistory(userID string) ([]secretHistoryEntry, error) {
+	var history []secretHistoryEntry
+	if config.Default.SecretHistorySize <= 0 {
+		return history, nil
+	}
+
+	if err := util.GetStore(CredentialHistoryPath).Get(userID, &history); err != nil && err != util.ErrorKeyNotFound {
+		return nil, err
+	}
+
+	if config.Default.SecretHistoryPeriod <= 0 {
+		return history, nil
+	}
+
+	cutoff := time.Now().Add(-config.Default.SecretHistoryPeriod)
+	recent := *new([]secretHistoryEntry)
+	for _, entry := range history {
+		if entry.ReplacedAt.After(cutoff) {
+			recent = append(recent, entry)
+		}
+	}
+
+	return recent, nil
+}
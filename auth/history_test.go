@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/users"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+func TestSecretHistory(t *testing.T) {
+	config.Default.DatabaseURL = util.StoreMemory
+	require.NoError(t, util.InitializeStore())
+	config.Default.Argon2Memory, config.Default.Argon2Iterations, config.Default.Argon2Parallelism = 1024, 1, 1
+	config.Default.SecretHistorySize, config.Default.SecretHistoryPeriod = 3, 0
+	defer func() {
+		config.Default.Argon2Memory, config.Default.Argon2Iterations, config.Default.Argon2Parallelism = 0, 0, 0
+		config.Default.SecretHistorySize, config.Default.SecretHistoryPeriod = 0, 0
+	}()
+
+	_, err := usersController.Import(users.UserResource{ID: "HISTORY", Email: "history@example.com", Verified: true, Firstname: "Foo"})
+	require.NoError(t, err)
+
+	c := &Controller{}
+	reset := func(secret string) error {
+		token, err := util.MintToken(nil, util.TokenPurposeResetSecret, "HISTORY", "history@example.com")
+		require.NoError(t, err)
+		return c.ResetSecret(Credential{Token: token, Secret: secret})
+	}
+
+	for _, secret := range []string{"first-secret", "second-secret", "third-secret"} {
+		require.NoError(t, reset(secret))
+	}
+
+	// The last 3 secrets (including the current one) cannot be reused.
+	for _, secret := range []string{"first-secret", "second-secret", "third-secret"} {
+		assert.Equal(t, ErrorSecretReused, reset(secret), secret)
+	}
+
+	_, err = c.Login(Credential{ID: "HISTORY", Secret: "third-secret"}, "")
+	require.NoError(t, err, "rejected secrets shouldn't replace the current one")
+
+	// The token can be used again after a rejected secret, but only until the secret is reset.
+	token, err := util.MintToken(nil, util.TokenPurposeResetSecret, "HISTORY", "history@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, ErrorSecretReused, c.ResetSecret(Credential{Token: token, Secret: "third-secret"}))
+	require.NoError(t, c.ResetSecret(Credential{Token: token, Secret: "fourth-secret"}))
+	assert.Equal(t, util.ErrorTokenInvalid, c.ResetSecret(Credential{Token: token, Secret: "fifth-secret"}))
+
+	require.NoError(t, reset("first-secret"))
+	assert.Equal(t, ErrorSecretReused, reset("fourth-secret"))
+
+	// Replaced secrets are forgotten after the history period.
+	config.Default.SecretHistoryPeriod = time.Nanosecond
+	require.NoError(t, reset("fourth-secret"))
+
+	config.Default.SecretHistorySize = 0
+	require.NoError(t, reset("fourth-secret"))
+
+	// The policy decides the length of new secrets.
+	assert.IsType(t, &PolicyError{}, reset("fifth"))
+	config.Default.SecretMinLength = 5
+	defer func() { config.Default.SecretMinLength = 0 }()
+	require.NoError(t, reset("fifth"))
+	_, err = c.Login(Credential{ID: "HISTORY", Secret: "fifth"}, "")
+	require.NoError(t, err)
+}
+
+func TestChangeSecret(t *testing.T) {
+	config.Default.DatabaseURL = util.StoreMemory
+	require.NoError(t, util.InitializeStore())
+	config.Default.Argon2Memory, config.Default.Argon2Iterations, config.Default.Argon2Parallelism = 1024, 1, 1
+	config.Default.SecretHistorySize, config.Default.LockoutThreshold, config.Default.LockoutDuration = 3, 3, time.Hour
+	defer func() {
+		config.Default.Argon2Memory, config.Default.Argon2Iterations, config.Default.Argon2Parallelism = 0, 0, 0
+		config.Default.SecretHistorySize, config.Default.LockoutThreshold, config.Default.LockoutDuration = 0, 0, 0
+	}()
+
+	_, err := usersController.Import(users.UserResource{ID: "CHANGE", Email: "change@example.com", Verified: true, Firstname: "Foo"})
+	require.NoError(t, err)
+
+	c := &Controller{}
+	_, err = c.ChangeSecret("CHANGE", Credential{Secret: "first-secret", NewSecret: "second-secret"})
+	assert.Error(t, err, "users without credentials cannot change their secret")
+	require.NoError(t, c.setSecret("CHANGE", "first-secret"))
+
+	_, err = c.ChangeSecret("CHANGE", Credential{Secret: "wrong-secret", NewSecret: "second-secret"})
+	assert.EqualError(t, err, "auth: wrong secret")
+	_, err = c.ChangeSecret("CHANGE", Credential{Secret: "first-secret", NewSecret: "first-secret"})
+	assert.Equal(t, ErrorSecretReused, err)
+	_, err = c.ChangeSecret("CHANGE", Credential{Secret: "first-secret", NewSecret: "short"})
+	assert.IsType(t, &PolicyError{}, err)
+
+	// Pending reset tokens are revoked once the secret is changed.
+	token, err := util.MintToken(nil, util.TokenPurposeResetSecret, "CHANGE", "change@example.com")
+	require.NoError(t, err)
+	user, err := c.ChangeSecret("CHANGE", Credential{Secret: "first-secret", NewSecret: "second-secret"})
+	require.NoError(t, err)
+	assert.Equal(t, "CHANGE", user.ID)
+	_, err = util.LookupToken(util.TokenPurposeResetSecret, token)
+	assert.Equal(t, util.ErrorTokenInvalid, err)
+	_, err = c.Login(Credential{ID: "CHANGE", Secret: "second-secret"}, "")
+	require.NoError(t, err)
+
+	// Wrong secrets count as failed logins.
+	for i := 0; i < 3; i++ {
+		_, err = c.ChangeSecret("CHANGE", Credential{Secret: "wrong-secret", NewSecret: "third-secret"})
+		assert.Error(t, err)
+	}
+
+	_, err = c.ChangeSecret("CHANGE", Credential{Secret: "second-secret", NewSecret: "third-secret"})
+	assert.IsType(t, &LockoutError{}, err)
+	require.NoError(t, c.ClearLockout(LockoutKindUser, "CHANGE"))
+}
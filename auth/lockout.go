@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+const (
+	// UserLockoutsPath has the failed logins of users.
+	UserLockoutsPath = "/lockouts/users"
+	// AddressLockoutsPath has the failed logins from source addresses.
+	AddressLockoutsPath = "/lockouts/addresses"
+	// LockoutKindUser is the kind of failed logins tracked per user.
+	LockoutKindUser = "user"
+	// LockoutKindAddress is the kind of failed logins tracked per source address.
+	LockoutKindAddress = "address"
+)
+
+// LoginFailures of a user or a source address. Failures are forgotten once the lockout duration
+// has passed since the last one (or the lockout has ended).
+//
+// NOTE: The store doesn't support atomic increments, so concurrent failures could be undercounted.
+type LoginFailures struct {
+	Kind        string     `json:"kind"`
+	Key         string     `json:"key"`
+	Failures    int        `json:"failures"`
+	LastFailure time.Time  `json:"lastFailure"`
+	LockedUntil *time.Time `json:"lockedUntil,omitempty"`
+}
+
+// LockoutError occurs when logins are blocked after too many failures, either temporarily (with
+// the backoff after each failure) or until the lockout ends.
+type LockoutError struct {
+	Kind       string
+	Locked     bool
+	RetryAfter time.Duration
+}
+
+func (e *LockoutError) Error() string {
+	retryAfter := e.RetryAfter.Round(time.Second)
+	if retryAfter < time.Second {
+		retryAfter = time.Second
+	}
+
+	switch {
+	case e.Kind == LockoutKindAddress:
+		return fmt.Sprintf("auth: too many failed logins from this address. try again in %s", retryAfter)
+	case e.Locked:
+		return fmt.Sprintf("auth: account is locked after too many failed logins. try again in %s", retryAfter)
+	default:
+		return fmt.Sprintf("auth: too many failed logins. try again in %s", retryAfter)
+	}
+}
+
+// ListLockouts of users and source addresses which are currently locked out.
+func (c *Controller) ListLockouts() ([]LoginFailures, error) {
+	lockouts := *new([]LoginFailures)
+	for _, kind := range []string{LockoutKindUser, LockoutKindAddress} {
+		keys, err := lockoutStore(kind).List()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			failures, err := loadLoginFailures(kind, key)
+			if err != nil {
+				return nil, err
+			}
+
+			if failures != nil && failures.LockedUntil != nil {
+				lockouts = append(lockouts, *failures)
+			}
+		}
+	}
+
+	sort.Slice(lockouts, func(i, j int) bool {
+		return lockouts[i].LockedUntil.Before(*lockouts[j].LockedUntil)
+	})
+
+	return lockouts, nil
+}
+
+// ClearLockout of a user or a source address, along with its failed logins.
+func (c *Controller) ClearLockout(kind, key string) error {
+	if kind != LockoutKindUser && kind != LockoutKindAddress {
+		return fmt.Errorf("auth: unknown lockout kind '%s'", kind)
+	}
+
+	return lockoutStore(kind).Remove(key)
+}
+
+// checkLockout of a user or a source address (ignored if the key is empty).
+func checkLockout(kind, key string) error {
+	if key == "" {
+		return nil
+	}
+
+	failures, err := loadLoginFailures(kind, key)
+	if err != nil || failures == nil {
+		return err
+	}
+
+	now := time.Now()
+	if failures.LockedUntil != nil {
+		return &LockoutError{Kind: kind, Locked: true, RetryAfter: failures.LockedUntil.Sub(now)}
+	}
+
+	// Only users have a backoff, since an address could be shared by many users.
+	if kind == LockoutKindUser {
+		if wait := failures.LastFailure.Add(loginBackoff(failures.Failures)).Sub(now); wait > 0 {
+			return &LockoutError{Kind: kind, RetryAfter: wait}
+		}
+	}
+
+	return nil
+}
+
+// recordLoginFailure of a user or a source address (ignored if the key is empty), and lock it out
+// if it has reached the threshold. Errors are only logged, since they shouldn't change the
+// response of the login.
+func recordLoginFailure(kind, key string) {
+	threshold := config.Default.LockoutThreshold
+	if kind == LockoutKindAddress {
+		threshold = config.Default.LockoutAddressThreshold
+	}
+
+	if key == "" || (threshold <= 0 && (kind == LockoutKindAddress || config.Default.LoginBackoff <= 0)) {
+		return
+	}
+
+	failures, err := loadLoginFailures(kind, key)
+	if err != nil {
+		log.Printf("auth: error loading failed logins of %s %s: %s", kind, key, err)
+		return
+	} else if failures == nil {
+		failures = &LoginFailures{Kind: kind, Key: key}
+	}
+
+	failures.Failures++
+	failures.LastFailure = time.Now().UTC()
+	if threshold > 0 && failures.Failures >= threshold {
+		lockedUntil := failures.LastFailure.Add(config.Default.LockoutDuration)
+		failures.LockedUntil = &lockedUntil
+		log.Printf("auth: locked out %s %s until %s after %d failed logins", kind, key, lockedUntil, failures.Failures)
+	}
+
+	if err := lockoutStore(kind).Set(key, failures); err != nil {
+		log.Printf("auth: error recording failed login of %s %s: %s", kind, key, err)
+	}
+}
+
+// loadLoginFailures of a user or a source address, or nil if there aren't any recent failures.
+func loadLoginFailures(kind, key string) (*LoginFailures, error) {
+	var failures LoginFailures
+	if err := lockoutStore(kind).Get(key, &failures); err == util.ErrorKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if failures.LockedUntil != nil && !now.Before(*failures.LockedUntil) {
+		return nil, nil
+	}
+
+	if failures.LockedUntil == nil && now.After(failures.LastFailure.Add(config.Default.LockoutDuration)) {
+		return nil, nil
+	}
+
+	return &failures, nil
+}
+
+// loginBackoff after the given number of failures. The backoff doubles with every failure, and
+// it never exceeds the lockout duration.
+func loginBackoff(failures int) time.Duration {
+	backoff := config.Default.LoginBackoff
+	for i := 1; i < failures && backoff < config.Default.LockoutDuration; i++ {
+		backoff *= 2
+	}
+
+	if backoff > config.Default.LockoutDuration {
+		backoff = config.Default.LockoutDuration
+	}
+
+	return backoff
+}
+
+func lockoutStore(kind string) util.Store {
+	if kind == LockoutKindAddress {
+		return util.GetStore(AddressLockoutsPath)
+	}
+
+	return util.GetStore(UserLockoutsPath)
+}
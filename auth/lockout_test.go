@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/users"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+func TestLoginLockout(t *testing.T) {
+	config.Default.DatabaseURL = util.StoreMemory
+	require.NoError(t, util.InitializeStore())
+	config.Default.LockoutThreshold, config.Default.LockoutAddressThreshold = 3, 4
+	config.Default.LockoutDuration, config.Default.LoginBackoff = time.Hour, 0
+	defer func() {
+		config.Default.LockoutThreshold, config.Default.LockoutAddressThreshold = 0, 0
+		config.Default.LockoutDuration, config.Default.LoginBackoff = 0, 0
+	}()
+
+	for _, id := range []string{"LOCKOUT-1", "LOCKOUT-2"} {
+		_, err := usersController.Import(users.UserResource{ID: id, Email: id + "@example.com", Verified: true, Firstname: "Foo"})
+		require.NoError(t, err)
+		hash, err := HashSecret("correct-secret")
+		require.NoError(t, err)
+		require.NoError(t, util.GetStore(CredentialsPath).Set(id, hash))
+	}
+
+	c := &Controller{}
+	login := func(id, secret, address string) error {
+		_, err := c.Login(Credential{ID: id, Secret: secret}, address)
+		return err
+	}
+
+	// A successful login clears the failures.
+	assert.Error(t, login("LOCKOUT-1", "wrong-secret", "10.0.0.1"))
+	assert.Error(t, login("LOCKOUT-1", "wrong-secret", "10.0.0.1"))
+	require.NoError(t, login("LOCKOUT-1", "correct-secret", "10.0.0.2"))
+
+	for i := 0; i < 3; i++ {
+		assert.Error(t, login("LOCKOUT-1", "wrong-secret", "10.0.0.3"))
+	}
+
+	err := login("LOCKOUT-1", "correct-secret", "10.0.0.2")
+	require.IsType(t, &LockoutError{}, err)
+	assert.True(t, err.(*LockoutError).Locked)
+	assert.Contains(t, err.Error(), "account is locked")
+
+	lockouts, err := c.ListLockouts()
+	require.NoError(t, err)
+	require.Len(t, lockouts, 1)
+	assert.Equal(t, "LOCKOUT-1", lockouts[0].Key)
+
+	require.NoError(t, c.ClearLockout(LockoutKindUser, "LOCKOUT-1"))
+	require.NoError(t, login("LOCKOUT-1", "correct-secret", "10.0.0.2"))
+
+	// Failures for other users (and unknown users) count against the address.
+	assert.Error(t, login("LOCKOUT-2", "wrong-secret", "10.0.0.1"))
+	assert.Error(t, login("UNKNOWN", "wrong-secret", "10.0.0.1"))
+	err = login("LOCKOUT-2", "correct-secret", "10.0.0.1")
+	require.IsType(t, &LockoutError{}, err)
+	assert.Equal(t, LockoutKindAddress, err.(*LockoutError).Kind)
+	require.NoError(t, login("LOCKOUT-2", "correct-secret", "10.0.0.2"))
+
+	require.NoError(t, c.ClearLockout(LockoutKindAddress, "10.0.0.1"))
+	require.NoError(t, login("LOCKOUT-2", "correct-secret", "10.0.0.1"))
+	assert.Error(t, c.ClearLockout("other", "10.0.0.1"))
+
+	// Failures are followed by an exponential backoff.
+	config.Default.LoginBackoff = time.Minute
+	assert.Error(t, login("LOCKOUT-2", "wrong-secret", ""))
+	err = login("LOCKOUT-2", "correct-secret", "")
+	require.IsType(t, &LockoutError{}, err)
+	assert.False(t, err.(*LockoutError).Locked)
+	assert.Equal(t, 4*time.Minute, loginBackoff(3))
+	assert.Equal(t, time.Hour, loginBackoff(20))
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"errors"
+	"log"
+
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/users"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+var (
+	// ErrorLoginLinksNotConfigured occurs when requesting a login link without a configured URL.
+	ErrorLoginLinksNotConfigured = errors.New("auth: login links haven't been configured")
+
+	// sendLoginLinkMail is replaced in tests.
+	sendLoginLinkMail = util.SendLoginLinkMail
+)
+
+// SendLoginLink for the given login challenge (from Hydra) to the email of the credential, along
+// with a code which can be entered instead. Unknown (or unverified) emails are only logged, so
+// that the result doesn't reveal whether an account exists.
+func (c *Controller) SendLoginLink(credential Credential, loginChallenge string) error {
+	if config.Default.LoginLinkURL == "" {
+		return ErrorLoginLinksNotConfigured
+	}
+
+	if err := credential.ValidateEmail(); err != nil {
+		return err
+	}
+
+	user, err := usersController.FindUserResourceByEmail(credential.Email)
+	if err != nil {
+		log.Printf("auth: not sending login link for login request %s (%s)", loginChallenge, err)
+		return nil
+	} else if !user.IsVerifiedEmail(credential.Email) {
+		log.Printf("auth: not sending login link for login request %s to unverified email of user %s", loginChallenge, user.ID)
+		return nil
+	}
+
+	token, err := util.MintToken(nil, util.TokenPurposeLoginLink, user.ID, loginChallenge)
+	if err != nil {
+		return err
+	}
+
+	code, err := util.MintCode(nil, util.TokenPurposeLoginLink, credential.Email, user.ID, loginChallenge)
+	if err != nil {
+		return err
+	}
+
+	go sendLoginLinkMail(credential.Email, token, code, loginChallenge)
+
+	return nil
+}
+
+// VerifyLoginLink with either the token from the link or the email and the code, and return
+// the user. These only work for the login challenge (from Hydra) for which they were sent, and
+// they're consumed once they're accepted. Wrong codes count as failed logins of the user and
+// the source address.
+func (c *Controller) VerifyLoginLink(credential Credential, loginChallenge, address string) (*users.UserResource, error) {
+	var token *util.Token
+	var err error
+	if credential.Code == "" {
+		if err := credential.ValidateToken(); err != nil {
+			return nil, err
+		}
+
+		token, err = util.LookupToken(util.TokenPurposeLoginLink, credential.Token)
+	} else {
+		if err := credential.ValidateEmail(); err != nil {
+			return nil, err
+		}
+
+		token, err = checkCode(util.TokenPurposeLoginLink, credential, address)
+	}
+
+	if err != nil {
+		return nil, err
+	} else if token.Value != loginChallenge {
+		return nil, util.ErrorTokenInvalid
+	}
+
+	if err := checkLockout(LockoutKindUser, token.Subject); err != nil {
+		return nil, err
+	}
+
+	if credential.Code == "" {
+		_, err = util.ConsumeToken(util.TokenPurposeLoginLink, credential.Token)
+	} else {
+		_, err = util.ConsumeCode(util.TokenPurposeLoginLink, credential.Email, credential.Code)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return usersController.FindUserResourceByID(token.Subject)
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/users"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+func TestLoginLink(t *testing.T) {
+	config.Default.DatabaseURL = util.StoreMemory
+	require.NoError(t, util.InitializeStore())
+
+	sent := make(chan [4]string, 1)
+	sendLoginLinkMail = func(recipient, token, code, loginChallenge string) {
+		sent <- [4]string{recipient, token, code, loginChallenge}
+	}
+	defer func() { sendLoginLinkMail = util.SendLoginLinkMail }()
+
+	_, err := usersController.Import(users.UserResource{ID: "LINK", Email: "link@example.com", Verified: true, Firstname: "Foo"})
+	require.NoError(t, err)
+	_, err = usersController.Import(users.UserResource{ID: "UNVERIFIED", Email: "unverified@example.com", Firstname: "Bar"})
+	require.NoError(t, err)
+
+	c := &Controller{}
+	assert.Equal(t, ErrorLoginLinksNotConfigured, c.SendLoginLink(Credential{Email: "link@example.com"}, "login-1"))
+	config.Default.LoginLinkURL = "https://example.com/login"
+	defer func() { config.Default.LoginLinkURL = "" }()
+
+	// Unknown (or unverified) emails look the same, but don't get mails.
+	require.NoError(t, c.SendLoginLink(Credential{Email: "nobody@example.com"}, "login-1"))
+	require.NoError(t, c.SendLoginLink(Credential{Email: "unverified@example.com"}, "login-1"))
+	assert.Len(t, sent, 0)
+
+	require.NoError(t, c.SendLoginLink(Credential{Email: "Link@example.com"}, "login-1"))
+	mail := <-sent
+	assert.Equal(t, "link@example.com", mail[0])
+	assert.Len(t, mail[2], config.DefaultEmailCodeLength)
+	assert.Equal(t, "login-1", mail[3])
+
+	_, err = c.VerifyLoginLink(Credential{Token: mail[1]}, "login-2", "10.0.0.9")
+	assert.Equal(t, util.ErrorTokenInvalid, err, "links should only work for their own login")
+	user, err := c.VerifyLoginLink(Credential{Token: mail[1]}, "login-1", "10.0.0.9")
+	require.NoError(t, err)
+	assert.Equal(t, "LINK", user.ID)
+	_, err = c.VerifyLoginLink(Credential{Token: mail[1]}, "login-1", "10.0.0.9")
+	assert.Equal(t, util.ErrorTokenInvalid, err, "links shouldn't be used twice")
+
+	// The code works instead of the link.
+	require.NoError(t, c.SendLoginLink(Credential{Email: "link@example.com"}, "login-3"))
+	mail = <-sent
+	_, err = c.VerifyLoginLink(Credential{Email: "link@example.com", Code: mail[2]}, "login-4", "10.0.0.9")
+	assert.Equal(t, util.ErrorTokenInvalid, err)
+	user, err = c.VerifyLoginLink(Credential{Email: "LINK@example.com", Code: mail[2]}, "login-3", "10.0.0.9")
+	require.NoError(t, err)
+	assert.Equal(t, "LINK", user.ID)
+	_, err = c.VerifyLoginLink(Credential{Email: "link@example.com", Code: mail[2]}, "login-3", "10.0.0.9")
+	assert.Equal(t, util.ErrorCodeInvalid, err, "codes shouldn't be used twice")
+
+	// Wrong codes count as failed logins.
+	config.Default.LockoutThreshold, config.Default.LockoutDuration = 2, time.Hour
+	defer func() { config.Default.LockoutThreshold, config.Default.LockoutDuration = 0, 0 }()
+	require.NoError(t, c.SendLoginLink(Credential{Email: "link@example.com"}, "login-5"))
+	mail = <-sent
+	for i := 0; i < 2; i++ {
+		_, err = c.VerifyLoginLink(Credential{Email: "link@example.com", Code: "x"}, "login-5", "10.0.0.9")
+		assert.Equal(t, util.ErrorCodeInvalid, err)
+	}
+
+	_, err = c.VerifyLoginLink(Credential{Email: "link@example.com", Code: mail[2]}, "login-5", "10.0.0.9")
+	assert.IsType(t, &LockoutError{}, err)
+	require.NoError(t, c.ClearLockout(LockoutKindUser, "LINK"))
+}
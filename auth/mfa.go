@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"log"
+
+	"gitlab.com/omnijar/arusha/users"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+const (
+	// SecondFactorTOTP is the second factor with codes from an authenticator app.
+	SecondFactorTOTP = "totp"
+	// SecondFactorWebAuthn is the second factor with a WebAuthn credential (see `BeginWebAuthnLogin`).
+	SecondFactorWebAuthn = "webauthn"
+	// SecondFactorRecovery is the second factor with one of the user's recovery codes (for when
+	// the other factors have been lost).
+	SecondFactorRecovery = "recovery"
+)
+
+// SecondFactorChallenge is returned instead of accepting the login, when the user has a second
+// factor. The token should be sent back along with the second factor (see `VerifySecondFactor`).
+type SecondFactorChallenge struct {
+	Status  string   `json:"status"`
+	Token   string   `json:"token"`
+	Methods []string `json:"methods"`
+}
+
+// BeginSecondFactor for a login of the given user (after the first factor has been verified).
+// This returns nil if the user doesn't have a second factor, and the login can be accepted.
+// The challenge is only valid for the given login challenge (from Hydra).
+func (c *Controller) BeginSecondFactor(user *users.UserResource, loginChallenge string) (*SecondFactorChallenge, error) {
+	methods, err := secondFactorMethods(user.ID)
+	if err != nil || len(methods) == 0 {
+		return nil, err
+	}
+
+	token, err := util.MintToken(nil, util.TokenPurposeSecondFactor, user.ID, loginChallenge)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SecondFactorChallenge{Status: "mfa_required", Token: token, Methods: methods}, nil
+}
+
+// VerifySecondFactor of a login with the token from `BeginSecondFactor`, and either the code,
+// the WebAuthn assertion or a recovery code. Wrong codes (or assertions) count as failed logins
+// (see `Login`), and the token is consumed once the second factor is accepted. The user is
+// notified by email whenever a recovery code is used.
+func (c *Controller) VerifySecondFactor(credential Credential, loginChallenge string) (*users.UserResource, error) {
+	if err := credential.ValidateToken(); err != nil {
+		return nil, err
+	}
+
+	token, err := util.LookupToken(util.TokenPurposeSecondFactor, credential.Token)
+	if err != nil {
+		return nil, err
+	} else if token.Value != loginChallenge {
+		return nil, util.ErrorTokenInvalid
+	}
+
+	if err := checkLockout(LockoutKindUser, token.Subject); err != nil {
+		return nil, err
+	}
+
+	remainingCodes := -1
+	if credential.Assertion != nil {
+		_, _, err = verifyWebAuthnAssertion(*credential.Assertion, loginChallenge, token.Subject)
+	} else if credential.RecoveryCode != "" {
+		remainingCodes, err = useRecoveryCode(token.Subject, credential.RecoveryCode)
+	} else {
+		err = verifyTOTPFactor(token.Subject, credential.Code)
+	}
+
+	if err != nil {
+		if err == ErrorInvalidCode || err == ErrorWebAuthnInvalid || err == ErrorWebAuthnSignCount {
+			recordLoginFailure(LockoutKindUser, token.Subject)
+		}
+
+		return nil, err
+	}
+
+	if _, err := util.ConsumeToken(util.TokenPurposeSecondFactor, credential.Token); err != nil {
+		return nil, err
+	}
+
+	if err := lockoutStore(LockoutKindUser).Remove(token.Subject); err != nil {
+		log.Printf("auth: error clearing failed logins of user %s: %s", token.Subject, err)
+	}
+
+	user, err := usersController.FindUserResourceByID(token.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	if remainingCodes >= 0 {
+		log.Printf("auth: user %s logged in with a recovery code (%d left)", user.ID, remainingCodes)
+		go util.SendRecoveryCodeUsedMail(user.Email, remainingCodes)
+	}
+
+	return user, nil
+}
+
+// secondFactorMethods enabled for the user.
+func secondFactorMethods(userID string) ([]string, error) {
+	var methods []string
+	if enabled, err := hasTOTP(userID); err != nil {
+		return nil, err
+	} else if enabled {
+		methods = append(methods, SecondFactorTOTP)
+	}
+
+	if enabled, err := hasWebAuthn(userID); err != nil {
+		return nil, err
+	} else if enabled {
+		methods = append(methods, SecondFactorWebAuthn)
+	}
+
+	// Recovery codes are only offered along with another factor.
+	if len(methods) > 0 {
+		if enabled, err := hasRecoveryCodes(userID); err != nil {
+			return nil, err
+		} else if enabled {
+			methods = append(methods, SecondFactorRecovery)
+		}
+	}
+
+	return methods, nil
+}
+
+// verifyTOTPFactor code of the user, if they have enabled TOTP.
+func verifyTOTPFactor(userID, code string) error {
+	record, err := loadTOTPSecret(userID)
+	if err != nil {
+		return err
+	} else if record == nil || !record.Confirmed {
+		return ErrorTOTPNotEnrolled
+	}
+
+	return verifyTOTP(userID, record, code)
+}
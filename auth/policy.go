@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/users"
+)
+
+const (
+	// RuleMinLength is violated by secrets shorter than the minimum length.
+	RuleMinLength = "minLength"
+	// RuleMaxLength is violated by secrets longer than the maximum length.
+	RuleMaxLength = "maxLength"
+	// RuleCharacterClasses is violated by secrets without enough character classes.
+	RuleCharacterClasses = "characterClasses"
+	// RuleBannedWords is violated by secrets containing the user's names or emails.
+	RuleBannedWords = "bannedWords"
+	// RuleEntropy is violated by secrets whose estimated entropy is too low.
+	RuleEntropy = "entropy"
+	// RuleBreached is violated by secrets found in the breached secrets file.
+	RuleBreached = "breached"
+
+	// minBannedWordLength is the length of the shortest word banned from secrets, so that short
+	// names don't end up banning common substrings.
+	minBannedWordLength = 3
+)
+
+// SecretPolicy has the rules for new secrets. Zero values disable the corresponding rules.
+type SecretPolicy struct {
+	MinLength           int
+	MaxLength           int
+	MinCharacterClasses int
+	MinEntropy          int
+	BreachedSecretsFile string
+}
+
+// PolicyViolation is a rule violated by a secret.
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PolicyError has all the rules violated by a secret.
+type PolicyError struct {
+	Violations []PolicyViolation `json:"violations"`
+}
+
+func (e *PolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, violation := range e.Violations {
+		messages[i] = violation.Message
+	}
+
+	return "credential: secret doesn't meet the policy (" + strings.Join(messages, "; ") + ")"
+}
+
+// CurrentSecretPolicy from the configuration (with the default lengths, if they're not configured).
+func CurrentSecretPolicy() SecretPolicy {
+	policy := SecretPolicy{
+		MinLength:           config.Default.SecretMinLength,
+		MaxLength:           config.Default.SecretMaxLength,
+		MinCharacterClasses: config.Default.SecretCharacterClasses,
+		MinEntropy:          config.Default.SecretMinEntropy,
+		BreachedSecretsFile: config.Default.BreachedSecretsFile,
+	}
+
+	if policy.MinLength == 0 {
+		policy.MinLength = config.DefaultSecretMinLength
+	}
+
+	if policy.MaxLength == 0 {
+		policy.MaxLength = config.DefaultSecretMaxLength
+	}
+
+	return policy
+}
+
+// Check the secret (of the given user, if any) against all the rules. This returns a `PolicyError`
+// listing the violated rules, or any other error if the breached secrets couldn't be checked.
+func (p SecretPolicy) Check(secret string, user *users.UserResource) error {
+	var violations []PolicyViolation
+	violate := func(rule, format string, args ...interface{}) {
+		violations = append(violations, PolicyViolation{Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	length := utf8.RuneCountInString(secret)
+	if p.MinLength > 0 && length < p.MinLength {
+		violate(RuleMinLength, "secret should have at least %d characters", p.MinLength)
+	}
+
+	if p.MaxLength > 0 && length > p.MaxLength {
+		violate(RuleMaxLength, "secret should have at most %d characters", p.MaxLength)
+	}
+
+	classes, poolSize := characterClasses(secret)
+	if classes < p.MinCharacterClasses {
+		violate(RuleCharacterClasses, "secret should have at least %d of lowercase letters, uppercase letters, digits and symbols",
+			p.MinCharacterClasses)
+	}
+
+	if user != nil {
+		lowered := strings.ToLower(secret)
+		for _, word := range bannedWords(*user) {
+			if strings.Contains(lowered, word) {
+				violate(RuleBannedWords, "secret shouldn't contain the user's names or emails")
+				break
+			}
+		}
+	}
+
+	if entropy := int(float64(length) * math.Log2(float64(poolSize))); p.MinEntropy > 0 && entropy < p.MinEntropy {
+		violate(RuleEntropy, "secret is too predictable (estimated entropy of %d bits, at least %d required)", entropy, p.MinEntropy)
+	}
+
+	if p.BreachedSecretsFile != "" {
+		breached, err := isBreachedSecret(p.BreachedSecretsFile, secret)
+		if err != nil {
+			return err
+		}
+
+		if breached {
+			violate(RuleBreached, "secret has appeared in a data breach")
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+
+	return nil
+}
+
+// characterClasses in the secret, along with the size of the pool of characters it's drawn from.
+// Characters outside ASCII count as symbols, but they widen the pool further.
+func characterClasses(secret string) (int, int) {
+	var lower, upper, digit, symbol, nonASCII bool
+	for _, r := range secret {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r > unicode.MaxASCII:
+			symbol, nonASCII = true, true
+		default:
+			symbol = true
+		}
+	}
+
+	classes, poolSize := 0, 0
+	for _, class := range []struct {
+		present bool
+		size    int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}} {
+		if class.present {
+			classes++
+			poolSize += class.size
+		}
+	}
+
+	if nonASCII {
+		poolSize += 100
+	}
+
+	return classes, poolSize
+}
+
+// bannedWords for the secrets of the user (lowercased) - their names, and their emails along
+// with the parts before `@`.
+func bannedWords(user users.UserResource) []string {
+	candidates := []string{user.Firstname, user.Lastname}
+	for _, email := range user.Emails {
+		candidates = append(candidates, email.Address, strings.SplitN(email.Address, "@", 2)[0])
+	}
+
+	var words []string
+	for _, candidate := range candidates {
+		if candidate = strings.ToLower(strings.TrimSpace(candidate)); utf8.RuneCountInString(candidate) >= minBannedWordLength {
+			words = append(words, candidate)
+		}
+	}
+
+	return words
+}
+
+// isBreachedSecret looks up the SHA-1 hash of the secret in a file of breached secrets. Each
+// line of the file has an uppercase hex SHA-1 hash (or a prefix of it, with the same length
+// for all lines), optionally followed by `:` and a count (as in the "ordered by hash" files of
+// Have I Been Pwned). The lines should be sorted, so that the file can be searched without
+// reading all of it.
+func isBreachedSecret(path, secret string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("credential: cannot read breached secrets file: %s", err)
+	}
+
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	target := fmt.Sprintf("%X", sha1.Sum([]byte(secret)))
+	candidate := ""
+
+	// Find the last entry which isn't greater than the hash (the hash should start with it).
+	low, high := int64(0), info.Size()
+	for low < high {
+		mid := low + (high-low)/2
+		entry, start, next, err := readEntryAfter(file, mid)
+		if err != nil {
+			return false, err
+		}
+
+		switch {
+		case start >= high:
+			high = mid
+		case entry == "" || entry <= target:
+			if entry != "" {
+				candidate = entry
+			}
+
+			low = next
+		default:
+			high = mid
+		}
+	}
+
+	return candidate != "" && strings.HasPrefix(target, candidate), nil
+}
+
+// readEntryAfter returns the entry in the first line starting at or after the given offset,
+// along with the offsets of that line and the next one.
+func readEntryAfter(file *os.File, offset int64) (string, int64, int64, error) {
+	start := offset
+	if offset > 0 {
+		start = offset - 1 // for checking whether a line starts at the offset
+	}
+
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		return "", 0, 0, err
+	}
+
+	reader := bufio.NewReader(file)
+	if offset > 0 {
+		skipped, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return "", start + int64(len(skipped)), start + int64(len(skipped)), nil
+		} else if err != nil {
+			return "", 0, 0, err
+		}
+
+		start += int64(len(skipped))
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", 0, 0, err
+	}
+
+	entry := strings.ToUpper(strings.TrimSpace(strings.SplitN(line, ":", 2)[0]))
+	return entry, start, start + int64(len(line)), nil
+}
@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/omnijar/arusha/users"
+)
+
+// violatedRules for the secret (if any).
+func violatedRules(t *testing.T, policy SecretPolicy, secret string, user *users.UserResource) []string {
+	err := policy.Check(secret, user)
+	if err == nil {
+		return nil
+	}
+
+	policyError, ok := err.(*PolicyError)
+	require.True(t, ok, err.Error())
+
+	var rules []string
+	for _, violation := range policyError.Violations {
+		rules = append(rules, violation.Rule)
+	}
+
+	return rules
+}
+
+func TestSecretPolicy(t *testing.T) {
+	policy := SecretPolicy{MinLength: 8, MaxLength: 16, MinCharacterClasses: 3, MinEntropy: 50}
+	user := &users.UserResource{
+		Firstname: "Ada",
+		Lastname:  "Lovelace",
+		Emails:    []users.UserEmail{{Address: "countess@example.com", Primary: true}},
+	}
+
+	assert.Empty(t, violatedRules(t, policy, "Tr0ub4dor&3x", user))
+	assert.Equal(t, []string{RuleMinLength, RuleCharacterClasses, RuleEntropy}, violatedRules(t, policy, "abc", nil))
+	assert.Equal(t, []string{RuleMaxLength}, violatedRules(t, policy, "Tr0ub4dor&3-Tr0ub4dor&3", nil))
+	assert.Equal(t, []string{RuleBannedWords}, violatedRules(t, policy, "x-LOVELACE-9", user))
+	assert.Equal(t, []string{RuleBannedWords}, violatedRules(t, policy, "Countess-99", user))
+	assert.Empty(t, violatedRules(t, policy, "Countess-99", nil))
+
+	err := policy.Check("abc", nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "at least 8 characters")
+
+	// The default policy only checks the lengths.
+	assert.Empty(t, violatedRules(t, CurrentSecretPolicy(), "password", user))
+	assert.Equal(t, []string{RuleMinLength}, violatedRules(t, CurrentSecretPolicy(), "short", user))
+}
+
+func TestBreachedSecrets(t *testing.T) {
+	breached := []string{"password", "123456", "qwerty", "letmein", "Tr0ub4dor&3"}
+
+	var lines []string
+	for i := 0; i < 200; i++ {
+		lines = append(lines, fmt.Sprintf("%X:%d", sha1.Sum([]byte(fmt.Sprintf("filler-%d", i))), i+1))
+	}
+
+	for _, secret := range breached {
+		lines = append(lines, fmt.Sprintf("%X:1000", sha1.Sum([]byte(secret))))
+	}
+
+	sort.Strings(lines)
+	file, err := ioutil.TempFile("", "arusha-breached")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	file.WriteString(strings.Join(lines, "\r\n"))
+	file.Close()
+
+	policy := SecretPolicy{BreachedSecretsFile: file.Name()}
+	for _, secret := range append(breached, "filler-0", "filler-199") {
+		assert.Equal(t, []string{RuleBreached}, violatedRules(t, policy, secret, nil), secret)
+	}
+
+	for _, secret := range []string{"correct horse battery staple", "filler-200", ""} {
+		assert.Empty(t, violatedRules(t, policy, secret, nil), secret)
+	}
+
+	// Files can have hash prefixes instead of full hashes.
+	prefixes := []string{fmt.Sprintf("%X", sha1.Sum([]byte("password")))[:10], "FFFFFFFFFF"}
+	require.NoError(t, ioutil.WriteFile(file.Name(), []byte(strings.Join(prefixes, "\n")+"\n"), 0600))
+	assert.Equal(t, []string{RuleBreached}, violatedRules(t, policy, "password", nil))
+	assert.Empty(t, violatedRules(t, policy, "letmein", nil))
+
+	policy.BreachedSecretsFile = file.Name() + ".missing"
+	assert.Error(t, policy.Check("password", nil))
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"gitlab.com/omnijar/arusha/util"
+)
+
+const (
+	// RecoveryCodesPath has the hashes of the unused recovery codes of users.
+	RecoveryCodesPath = "/mfa/recovery"
+
+	// recoveryCodeCount generated at a time.
+	recoveryCodeCount = 10
+	// recoveryCodeSize in random bytes (80 bits, so plain hashes of the codes are good enough).
+	recoveryCodeSize = 10
+	// recoveryCodeGroup is the number of characters between dashes in the codes shown to users.
+	recoveryCodeGroup = 4
+)
+
+var (
+	// ErrorSecondFactorNotEnabled occurs when generating recovery codes for users without a second factor.
+	ErrorSecondFactorNotEnabled = errors.New("auth: a second factor hasn't been enabled")
+
+	recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// recoveryCodes of a user. Only the hashes are stored, and each one is removed once it's used.
+type recoveryCodes struct {
+	Hashes    []string  `json:"hashes"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// RegenerateRecoveryCodes for the given user, replacing any unused ones. The codes are only
+// returned here, so they should be shown to the user right away.
+func (c *Controller) RegenerateRecoveryCodes(userID string) ([]string, error) {
+	methods, err := secondFactorMethods(userID)
+	if err != nil {
+		return nil, err
+	} else if len(methods) == 0 {
+		return nil, ErrorSecondFactorNotEnabled
+	}
+
+	return generateRecoveryCodes(userID)
+}
+
+// issueRecoveryCodes when the user enrolls a second factor. If the user already has unused
+// codes, then those are kept and nil is returned.
+func issueRecoveryCodes(userID string) ([]string, error) {
+	if record, err := loadRecoveryCodes(userID); err != nil || record != nil {
+		return nil, err
+	}
+
+	return generateRecoveryCodes(userID)
+}
+
+// generateRecoveryCodes for the user, and store their hashes.
+func generateRecoveryCodes(userID string) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	record := recoveryCodes{Hashes: make([]string, recoveryCodeCount), CreatedAt: time.Now().UTC()}
+	for i := range codes {
+		data := make([]byte, recoveryCodeSize)
+		if _, err := rand.Read(data); err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(data))
+		var groups []string
+		for len(code) > recoveryCodeGroup {
+			groups, code = append(groups, code[:recoveryCodeGroup]), code[recoveryCodeGroup:]
+		}
+
+		codes[i] = strings.Join(append(groups, code), "-")
+		record.Hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	if err := util.GetStore(RecoveryCodesPath).Set(userID, record); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// useRecoveryCode of the user, and return the number of codes left. The code is removed, so
+// that it cannot be used again.
+func useRecoveryCode(userID, code string) (int, error) {
+	record, err := loadRecoveryCodes(userID)
+	if err != nil {
+		return 0, err
+	} else if record == nil {
+		return 0, ErrorInvalidCode
+	}
+
+	hash, match := hashRecoveryCode(code), -1
+	for i, existing := range record.Hashes {
+		if subtle.ConstantTimeCompare([]byte(existing), []byte(hash)) == 1 {
+			match = i
+		}
+	}
+
+	if match < 0 {
+		return 0, ErrorInvalidCode
+	}
+
+	record.Hashes = append(record.Hashes[:match], record.Hashes[match+1:]...)
+	if len(record.Hashes) == 0 {
+		return 0, util.GetStore(RecoveryCodesPath).Remove(userID)
+	}
+
+	return len(record.Hashes), util.GetStore(RecoveryCodesPath).Set(userID, record)
+}
+
+// hasRecoveryCodes checks whether the user has any unused recovery codes.
+func hasRecoveryCodes(userID string) (bool, error) {
+	record, err := loadRecoveryCodes(userID)
+	return record != nil, err
+}
+
+// removeUnusedRecoveryCodes of the user, once the last second factor has been removed.
+func removeUnusedRecoveryCodes(userID string) error {
+	methods, err := secondFactorMethods(userID)
+	if err != nil || len(methods) > 0 {
+		return err
+	}
+
+	return util.GetStore(RecoveryCodesPath).Remove(userID)
+}
+
+// loadRecoveryCodes of the user, or nil if the user doesn't have any.
+func loadRecoveryCodes(userID string) (*recoveryCodes, error) {
+	var record recoveryCodes
+	if err := util.GetStore(RecoveryCodesPath).Get(userID, &record); err == util.ErrorKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// hashRecoveryCode ignoring the case, dashes and spaces.
+func hashRecoveryCode(code string) string {
+	normalized := strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+
+		return r
+	}, strings.ToLower(strings.TrimSpace(code)))
+
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
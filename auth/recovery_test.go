@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/users"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+func TestRecoveryCodes(t *testing.T) {
+	config.Default.DatabaseURL = util.StoreMemory
+	require.NoError(t, util.InitializeStore())
+
+	_, err := usersController.Import(users.UserResource{ID: "RECOVERY", Email: "recovery@example.com", Verified: true, Firstname: "Foo"})
+	require.NoError(t, err)
+
+	c := &Controller{}
+	_, err = c.RegenerateRecoveryCodes("RECOVERY")
+	assert.Equal(t, ErrorSecondFactorNotEnabled, err)
+
+	enrollment, err := c.EnrollTOTP("RECOVERY")
+	require.NoError(t, err)
+	secret, err := totpEncoding.DecodeString(enrollment.Secret)
+	require.NoError(t, err)
+	codes, err := c.ConfirmTOTP("RECOVERY", totpCode(secret, time.Now().Unix()/totpPeriod))
+	require.NoError(t, err)
+	require.Len(t, codes, recoveryCodeCount)
+	assert.Len(t, codes[0], 19)
+	assert.Equal(t, 3, strings.Count(codes[0], "-"))
+
+	var stored recoveryCodes
+	require.NoError(t, util.GetStore(RecoveryCodesPath).Get("RECOVERY", &stored))
+	for _, hash := range stored.Hashes {
+		assert.NotContains(t, codes, hash, "codes shouldn't be stored in plain text")
+	}
+
+	// Logging in with a recovery code (in any case, and with or without dashes).
+	user, err := usersController.FindUserResourceByID("RECOVERY")
+	require.NoError(t, err)
+	challenge, err := c.BeginSecondFactor(user, "login-1")
+	require.NoError(t, err)
+	assert.Contains(t, challenge.Methods, SecondFactorRecovery)
+
+	_, err = c.VerifySecondFactor(Credential{Token: challenge.Token, RecoveryCode: "aaaa-bbbb-cccc-dddd"}, "login-1")
+	assert.Equal(t, ErrorInvalidCode, err)
+	verified, err := c.VerifySecondFactor(Credential{Token: challenge.Token, RecoveryCode: strings.ToUpper(strings.Replace(codes[0], "-", "", -1))}, "login-1")
+	require.NoError(t, err)
+	assert.Equal(t, "RECOVERY", verified.ID)
+
+	challenge, err = c.BeginSecondFactor(user, "login-2")
+	require.NoError(t, err)
+	_, err = c.VerifySecondFactor(Credential{Token: challenge.Token, RecoveryCode: codes[0]}, "login-2")
+	assert.Equal(t, ErrorInvalidCode, err, "codes shouldn't be used twice")
+
+	// Enrolling again keeps the codes, while regenerating replaces them.
+	issued, err := issueRecoveryCodes("RECOVERY")
+	require.NoError(t, err)
+	assert.Nil(t, issued)
+
+	regenerated, err := c.RegenerateRecoveryCodes("RECOVERY")
+	require.NoError(t, err)
+	assert.Len(t, regenerated, recoveryCodeCount)
+	_, err = useRecoveryCode("RECOVERY", codes[1])
+	assert.Equal(t, ErrorInvalidCode, err, "previous codes shouldn't work after regenerating")
+
+	remaining, err := useRecoveryCode("RECOVERY", regenerated[1])
+	require.NoError(t, err)
+	assert.Equal(t, recoveryCodeCount-1, remaining)
+}
@@ -3,8 +3,10 @@ package auth
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 	"gitlab.com/omnijar/arusha/util"
@@ -19,14 +21,56 @@ const (
 	VerifyEmailPath = AuthPath + "/verify"
 	// ResetSecretPath is the POST/PUT path for resetting secrets.
 	ResetSecretPath = AuthPath + "/secrets/reset"
+	// ChangeSecretPath is the PUT path for changing the secret of the user of the bearer token.
+	ChangeSecretPath = AuthPath + "/secrets"
 	// SessionPath is the GET,POST and PUT path for authenticating users.
 	SessionPath = AuthPath + "/session"
 	// ArushaAuthTokenHeader for responding with the auth token.
 	ArushaAuthTokenHeader = "X-Arusha-Auth-Token"
 	// ArushaRefreshTokenHeader for refreshing expired auth tokens.
 	ArushaRefreshTokenHeader = "X-Arusha-Refresh-Token"
+	// SecondFactorPath is the POST path for verifying the second factor of a login.
+	SecondFactorPath = SessionPath + "/mfa"
+	// LoginLinkPath is the POST path for emailing a login link, and PUT path for logging in with
+	// its token.
+	LoginLinkPath = SessionPath + "/link"
+	// TOTPEnrollmentPath is the POST path for enrolling TOTP, PUT path for confirming the enrollment
+	// and DELETE path for disabling it. These require the user's bearer token.
+	TOTPEnrollmentPath = AuthPath + "/mfa/totp"
+	// RecoveryCodesRoutePath is the POST path for regenerating the recovery codes of the user of
+	// the bearer token.
+	RecoveryCodesRoutePath = AuthPath + "/mfa/recovery"
+	// WebAuthnRegistrationPath is the POST path for the options of a new WebAuthn credential, and
+	// PUT path for registering it. These require the user's bearer token.
+	WebAuthnRegistrationPath = AuthPath + "/webauthn/registration"
+	// WebAuthnCredentialsPath is the GET path for listing the WebAuthn credentials of the user of
+	// the bearer token.
+	WebAuthnCredentialsPath = AuthPath + "/webauthn/credentials"
+	// WebAuthnCredentialPath is the DELETE path for removing a WebAuthn credential.
+	WebAuthnCredentialPath = WebAuthnCredentialsPath + "/:id"
+	// WebAuthnLoginPath is the POST path for the options of a WebAuthn assertion, and PUT path
+	// for logging in with it (without a secret).
+	WebAuthnLoginPath = AuthPath + "/webauthn/login"
 	// LoginChallengeParameter in URL query.
 	LoginChallengeParameter = "login_challenge"
+	// AccountSessionsPath is the GET path for listing the sessions of the user of the bearer token,
+	// and DELETE path for revoking all of them.
+	AccountSessionsPath = AuthPath + "/sessions"
+	// AccountSessionPath is the DELETE path for revoking the consent session of the user of the
+	// bearer token with a client.
+	AccountSessionPath = AccountSessionsPath + "/:client"
+	// SubjectSessionsPath is the GET path for listing the sessions of a user, and DELETE path for
+	// revoking all of them. This should only be allowed for admins.
+	SubjectSessionsPath = "/sessions/:id"
+	// SubjectSessionPath is the DELETE path for revoking the consent session of a user with a client.
+	SubjectSessionPath = SubjectSessionsPath + "/:client"
+	// LockoutsPath is the GET path for listing the users and source addresses which are locked out.
+	// This should only be allowed for admins.
+	LockoutsPath = "/lockouts"
+	// UserLockoutPath is the DELETE path for clearing the lockout of a user.
+	UserLockoutPath = LockoutsPath + "/users/:id"
+	// AddressLockoutPath is the DELETE path for clearing the lockout of a source address.
+	AddressLockoutPath = LockoutsPath + "/addresses/:address"
 )
 
 var (
@@ -53,10 +97,49 @@ func (h *RouteHandler) SetRoutes(r *httprouter.Router) {
 	r.OPTIONS(ResetSecretPath, util.PassEmptyBody)
 	r.POST(ResetSecretPath, h.VerifySecretReset)
 	r.PUT(ResetSecretPath, h.InitiateSecretReset)
+	r.OPTIONS(ChangeSecretPath, util.PassEmptyBody)
+	r.PUT(ChangeSecretPath, h.ChangeSecret)
 	r.OPTIONS(SessionPath, util.PassEmptyBody)
 	r.GET(SessionPath, h.GetSession)
 	r.POST(SessionPath, h.Login)
 	r.DELETE(SessionPath, h.Logout)
+	r.OPTIONS(SecondFactorPath, util.PassEmptyBody)
+	r.POST(SecondFactorPath, h.VerifySecondFactor)
+	r.OPTIONS(LoginLinkPath, util.PassEmptyBody)
+	r.POST(LoginLinkPath, h.SendLoginLink)
+	r.PUT(LoginLinkPath, h.VerifyLoginLink)
+	r.OPTIONS(TOTPEnrollmentPath, util.PassEmptyBody)
+	r.POST(TOTPEnrollmentPath, h.EnrollTOTP)
+	r.PUT(TOTPEnrollmentPath, h.ConfirmTOTP)
+	r.DELETE(TOTPEnrollmentPath, h.DisableTOTP)
+	r.OPTIONS(RecoveryCodesRoutePath, util.PassEmptyBody)
+	r.POST(RecoveryCodesRoutePath, h.RegenerateRecoveryCodes)
+	r.OPTIONS(WebAuthnRegistrationPath, util.PassEmptyBody)
+	r.POST(WebAuthnRegistrationPath, h.BeginWebAuthnRegistration)
+	r.PUT(WebAuthnRegistrationPath, h.FinishWebAuthnRegistration)
+	r.OPTIONS(WebAuthnCredentialsPath, util.PassEmptyBody)
+	r.GET(WebAuthnCredentialsPath, h.ListWebAuthnCredentials)
+	r.OPTIONS(WebAuthnCredentialPath, util.PassEmptyBody)
+	r.DELETE(WebAuthnCredentialPath, h.RemoveWebAuthnCredential)
+	r.OPTIONS(WebAuthnLoginPath, util.PassEmptyBody)
+	r.POST(WebAuthnLoginPath, h.BeginWebAuthnLogin)
+	r.PUT(WebAuthnLoginPath, h.FinishWebAuthnLogin)
+	r.OPTIONS(AccountSessionsPath, util.PassEmptyBody)
+	r.GET(AccountSessionsPath, h.ListAccountSessions)
+	r.DELETE(AccountSessionsPath, h.RevokeAccountSessions)
+	r.OPTIONS(AccountSessionPath, util.PassEmptyBody)
+	r.DELETE(AccountSessionPath, h.RevokeAccountSession)
+	r.OPTIONS(SubjectSessionsPath, util.PassEmptyBody)
+	r.GET(SubjectSessionsPath, h.ListSubjectSessions)
+	r.DELETE(SubjectSessionsPath, h.RevokeSubjectSessions)
+	r.OPTIONS(SubjectSessionPath, util.PassEmptyBody)
+	r.DELETE(SubjectSessionPath, h.RevokeSubjectSession)
+	r.OPTIONS(LockoutsPath, util.PassEmptyBody)
+	r.GET(LockoutsPath, h.ListLockouts)
+	r.OPTIONS(UserLockoutPath, util.PassEmptyBody)
+	r.DELETE(UserLockoutPath, h.ClearUserLockout)
+	r.OPTIONS(AddressLockoutPath, util.PassEmptyBody)
+	r.DELETE(AddressLockoutPath, h.ClearAddressLockout)
 }
 
 // GetAuthURL for the service.
@@ -83,9 +166,9 @@ func (h *RouteHandler) Add(w http.ResponseWriter, r *http.Request, params httpro
 		return
 	}
 
-	resource, err := controller.Add(credential)
+	resource, err := controller.Add(credential, util.ClientAddress(r))
 	if err != nil {
-		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		respondCredentialError(w, err)
 		return
 	}
 
@@ -106,7 +189,7 @@ func (h *RouteHandler) VerifyEmailToken(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	resource, err := controller.VerifyEmailToken(credential)
+	resource, err := controller.VerifyEmailToken(credential, util.ClientAddress(r))
 	if err != nil {
 		util.RespondHTTPError(w, err, http.StatusBadRequest)
 		return
@@ -130,7 +213,7 @@ func (h *RouteHandler) VerifySecretReset(w http.ResponseWriter, r *http.Request,
 	}
 
 	if err := controller.ResetSecret(credential); err != nil {
-		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		respondCredentialError(w, err)
 		return
 	}
 
@@ -159,7 +242,31 @@ func (h *RouteHandler) InitiateSecretReset(w http.ResponseWriter, r *http.Reques
 	util.RespondHTTPStatusOK(w)
 }
 
-// Login user to session.
+// ChangeSecret of the user of the bearer token with the current secret, and revoke all of the
+// user's sessions along with their tokens (including the bearer token). Hydra revokes tokens by
+// client, so the other devices using the same client cannot be told apart from the current one,
+// and the client has to log in again (with the new secret).
+func (h *RouteHandler) ChangeSecret(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	subject, credential, ok := decodeAuthorizedCredential(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := controller.ChangeSecret(subject, *credential); err != nil {
+		respondCredentialError(w, err)
+		return
+	}
+
+	if err := util.RevokeSessions(subject); err != nil {
+		util.RespondHTTPError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	util.RespondHTTPStatusOK(w)
+}
+
+// Login user to session. If the user has a second factor, then this responds with a challenge
+// for it instead (see `VerifySecondFactor`).
 func (h *RouteHandler) Login(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	challenge := r.URL.Query().Get(LoginChallengeParameter)
 	if challenge == "" {
@@ -179,17 +286,141 @@ func (h *RouteHandler) Login(w http.ResponseWriter, r *http.Request, _ httproute
 		return
 	}
 
-	var response *util.HydraRedirectResponse
-	resource, err := controller.Login(credential)
+	resource, err := controller.Login(credential, util.ClientAddress(r))
+	if err == nil {
+		secondFactor, err := controller.BeginSecondFactor(resource, challenge)
+		if err != nil {
+			util.RespondHTTPError(w, err, http.StatusInternalServerError)
+			return
+		} else if secondFactor != nil {
+			log.Printf("Waiting for second factor of login request %s from user %s", challenge, resource.ID)
+			json.NewEncoder(w).Encode(secondFactor)
+			return
+		}
+	}
 
+	var response *util.HydraRedirectResponse
 	if err != nil {
 		log.Printf("Rejecting login request %s (%s)", challenge, err.Error())
 		response, err = util.RejectLoginRequest(challenge, err.Error())
 	} else {
 		log.Printf("Accepting login request %s from user %s", challenge, resource.ID)
-		response, err = util.AcceptLoginRequest(challenge, resource.ID)
+		response, err = util.AcceptLoginRequest(challenge, resource.ID, util.ACRSingleFactor)
+	}
+
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// VerifySecondFactor of a login, and accept it. Unlike the first factor, failures don't reject
+// the login request, so that the user can retry with another code.
+func (h *RouteHandler) VerifySecondFactor(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	challenge := r.URL.Query().Get(LoginChallengeParameter)
+	if challenge == "" {
+		util.RespondMissingQueryParameterError(w, LoginChallengeParameter)
+		return
+	}
+
+	var credential Credential
+	if r.Body == nil {
+		util.RespondHTTPError(w, util.ErrorHTTPNoBody, http.StatusBadRequest)
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&credential); err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	resource, err := controller.VerifySecondFactor(credential, challenge)
+	if err != nil {
+		log.Printf("Rejecting second factor of login request %s (%s)", challenge, err.Error())
+		util.RespondHTTPError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	log.Printf("Accepting login request %s from user %s with second factor", challenge, resource.ID)
+	response, err := util.AcceptLoginRequest(challenge, resource.ID, util.ACRMultiFactor)
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// SendLoginLink for a login request to the email in the body. This responds the same way
+// whether or not the email belongs to a user.
+func (h *RouteHandler) SendLoginLink(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	challenge := r.URL.Query().Get(LoginChallengeParameter)
+	if challenge == "" {
+		util.RespondMissingQueryParameterError(w, LoginChallengeParameter)
+		return
+	}
+
+	var credential Credential
+	if r.Body == nil {
+		util.RespondHTTPError(w, util.ErrorHTTPNoBody, http.StatusBadRequest)
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&credential); err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := controller.SendLoginLink(credential, challenge); err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	util.RespondHTTPStatusOK(w)
+}
+
+// VerifyLoginLink with the token in the body, and accept the login request. If the user has
+// a second factor, then this responds with a challenge for it instead. Like the second factor,
+// failures don't reject the login request.
+func (h *RouteHandler) VerifyLoginLink(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	challenge := r.URL.Query().Get(LoginChallengeParameter)
+	if challenge == "" {
+		util.RespondMissingQueryParameterError(w, LoginChallengeParameter)
+		return
 	}
 
+	var credential Credential
+	if r.Body == nil {
+		util.RespondHTTPError(w, util.ErrorHTTPNoBody, http.StatusBadRequest)
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&credential); err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	resource, err := controller.VerifyLoginLink(credential, challenge, util.ClientAddress(r))
+	if err != nil {
+		log.Printf("Rejecting login link of login request %s (%s)", challenge, err.Error())
+		util.RespondHTTPError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	secondFactor, err := controller.BeginSecondFactor(resource, challenge)
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusInternalServerError)
+		return
+	} else if secondFactor != nil {
+		log.Printf("Waiting for second factor of login request %s from user %s", challenge, resource.ID)
+		json.NewEncoder(w).Encode(secondFactor)
+		return
+	}
+
+	log.Printf("Accepting login request %s from user %s with login link", challenge, resource.ID)
+	response, err := util.AcceptLoginRequest(challenge, resource.ID, util.ACRSingleFactor)
 	if err != nil {
 		util.RespondHTTPError(w, err, http.StatusInternalServerError)
 		return
@@ -198,6 +429,72 @@ func (h *RouteHandler) Login(w http.ResponseWriter, r *http.Request, _ httproute
 	json.NewEncoder(w).Encode(response)
 }
 
+// EnrollTOTP for the user of the bearer token.
+func (h *RouteHandler) EnrollTOTP(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	subject, err := util.AuthorizeToken(util.BearerToken(r))
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	enrollment, err := controller.EnrollTOTP(*subject)
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(enrollment)
+}
+
+// ConfirmTOTP enrollment of the user of the bearer token with the first code. This responds
+// with the recovery codes, if they've been generated along with it.
+func (h *RouteHandler) ConfirmTOTP(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	subject, credential, ok := decodeAuthorizedCredential(w, r)
+	if !ok {
+		return
+	}
+
+	codes, err := controller.ConfirmTOTP(subject, credential.Code)
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	respondRecoveryCodes(w, codes)
+}
+
+// DisableTOTP for the user of the bearer token. This requires a code as well.
+func (h *RouteHandler) DisableTOTP(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	subject, credential, ok := decodeAuthorizedCredential(w, r)
+	if !ok {
+		return
+	}
+
+	if err := controller.DisableTOTP(subject, credential.Code); err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	util.RespondHTTPStatusOK(w)
+}
+
+// RegenerateRecoveryCodes of the user of the bearer token. The previous codes no longer work.
+func (h *RouteHandler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	subject, err := util.AuthorizeToken(util.BearerToken(r))
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	codes, err := controller.RegenerateRecoveryCodes(*subject)
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	respondRecoveryCodes(w, codes)
+}
+
 // GetSession is the browser-directed page. Here, we check if the login ID already has an active token,
 // which we can reuse. If a session exists, then we issue a redirect, otherwise we stay put.
 func (h *RouteHandler) GetSession(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -251,3 +548,298 @@ func (h *RouteHandler) Logout(w http.ResponseWriter, r *http.Request, _ httprout
 
 	util.RespondHTTPStatusOK(w)
 }
+
+// ListAccountSessions of the user of the bearer token.
+func (h *RouteHandler) ListAccountSessions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	subject, err := util.AuthorizeToken(util.BearerToken(r))
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	respondSessions(w, *subject)
+}
+
+// RevokeAccountSessions of the user of the bearer token ("log out everywhere"). This revokes the
+// bearer token as well.
+func (h *RouteHandler) RevokeAccountSessions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	subject, err := util.AuthorizeToken(util.BearerToken(r))
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	respondRevokedSessions(w, controller.RevokeSessions(*subject))
+}
+
+// RevokeAccountSession of the user of the bearer token with a client.
+func (h *RouteHandler) RevokeAccountSession(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	subject, err := util.AuthorizeToken(util.BearerToken(r))
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	respondRevokedSessions(w, controller.RevokeSession(*subject, params.ByName("client")))
+}
+
+// ListSubjectSessions of a user.
+func (h *RouteHandler) ListSubjectSessions(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	respondSessions(w, strings.ToUpper(params.ByName("id")))
+}
+
+// RevokeSubjectSessions of a user.
+func (h *RouteHandler) RevokeSubjectSessions(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	respondRevokedSessions(w, controller.RevokeSessions(strings.ToUpper(params.ByName("id"))))
+}
+
+// RevokeSubjectSession of a user with a client.
+func (h *RouteHandler) RevokeSubjectSession(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	respondRevokedSessions(w, controller.RevokeSession(strings.ToUpper(params.ByName("id")), params.ByName("client")))
+}
+
+// ListLockouts of users and source addresses.
+func (h *RouteHandler) ListLockouts(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lockouts, err := controller.ListLockouts()
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(lockouts)
+}
+
+// ClearUserLockout clears the lockout (and the failed logins) of a user.
+func (h *RouteHandler) ClearUserLockout(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if err := controller.ClearLockout(LockoutKindUser, strings.ToUpper(params.ByName("id"))); err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	util.RespondHTTPStatusOK(w)
+}
+
+// ClearAddressLockout clears the lockout (and the failed logins) of a source address.
+func (h *RouteHandler) ClearAddressLockout(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if err := controller.ClearLockout(LockoutKindAddress, params.ByName("address")); err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	util.RespondHTTPStatusOK(w)
+}
+
+// BeginWebAuthnRegistration for the user of the bearer token.
+func (h *RouteHandler) BeginWebAuthnRegistration(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	subject, err := util.AuthorizeToken(util.BearerToken(r))
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	options, err := controller.BeginWebAuthnRegistration(*subject)
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"publicKey": options})
+}
+
+// FinishWebAuthnRegistration of a new credential for the user of the bearer token.
+func (h *RouteHandler) FinishWebAuthnRegistration(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	subject, err := util.AuthorizeToken(util.BearerToken(r))
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	var response WebAuthnResponse
+	if r.Body == nil {
+		util.RespondHTTPError(w, util.ErrorHTTPNoBody, http.StatusBadRequest)
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	credential, codes, err := controller.FinishWebAuthnRegistration(*subject, response)
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		*WebAuthnCredential
+		RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+	}{credential, codes})
+}
+
+// ListWebAuthnCredentials of the user of the bearer token.
+func (h *RouteHandler) ListWebAuthnCredentials(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	subject, err := util.AuthorizeToken(util.BearerToken(r))
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	credentials, err := controller.ListWebAuthnCredentials(*subject)
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(credentials)
+}
+
+// RemoveWebAuthnCredential of the user of the bearer token.
+func (h *RouteHandler) RemoveWebAuthnCredential(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	subject, err := util.AuthorizeToken(util.BearerToken(r))
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	if err := controller.RemoveWebAuthnCredential(*subject, params.ByName("id")); err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	util.RespondHTTPStatusOK(w)
+}
+
+// BeginWebAuthnLogin for a login request. The body can have the token of a second factor
+// challenge, an email, or neither (for passkeys).
+func (h *RouteHandler) BeginWebAuthnLogin(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	challenge := r.URL.Query().Get(LoginChallengeParameter)
+	if challenge == "" {
+		util.RespondMissingQueryParameterError(w, LoginChallengeParameter)
+		return
+	}
+
+	var credential Credential
+	if r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(&credential); err != nil && err != io.EOF {
+			util.RespondHTTPError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	options, err := controller.BeginWebAuthnLogin(credential, challenge)
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"publicKey": options})
+}
+
+// FinishWebAuthnLogin (without a secret) and accept the login request. Like the second factor,
+// failures don't reject the login request.
+func (h *RouteHandler) FinishWebAuthnLogin(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	challenge := r.URL.Query().Get(LoginChallengeParameter)
+	if challenge == "" {
+		util.RespondMissingQueryParameterError(w, LoginChallengeParameter)
+		return
+	}
+
+	var response WebAuthnResponse
+	if r.Body == nil {
+		util.RespondHTTPError(w, util.ErrorHTTPNoBody, http.StatusBadRequest)
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	resource, err := controller.FinishWebAuthnLogin(response, challenge, util.ClientAddress(r))
+	if err != nil {
+		log.Printf("Rejecting WebAuthn assertion of login request %s (%s)", challenge, err.Error())
+		util.RespondHTTPError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	log.Printf("Accepting login request %s from user %s with WebAuthn", challenge, resource.ID)
+	redirect, err := util.AcceptLoginRequest(challenge, resource.ID, util.ACRMultiFactor)
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(redirect)
+}
+
+// decodeAuthorizedCredential in the body, along with the subject of the bearer token. This
+// responds with the error (if any), in which case the returned flag is false.
+func decodeAuthorizedCredential(w http.ResponseWriter, r *http.Request) (string, *Credential, bool) {
+	subject, err := util.AuthorizeToken(util.BearerToken(r))
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusUnauthorized)
+		return "", nil, false
+	}
+
+	var credential Credential
+	if r.Body == nil {
+		util.RespondHTTPError(w, util.ErrorHTTPNoBody, http.StatusBadRequest)
+		return "", nil, false
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&credential); err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return "", nil, false
+	}
+
+	return *subject, &credential, true
+}
+
+// respondSessions of the given user.
+func respondSessions(w http.ResponseWriter, userID string) {
+	sessions, err := controller.ListSessions(userID)
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// respondRevokedSessions with the error of revoking sessions (if any).
+func respondRevokedSessions(w http.ResponseWriter, err error) {
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	util.RespondHTTPStatusOK(w)
+}
+
+// respondRecoveryCodes along with the status (if any have been generated).
+func respondRecoveryCodes(w http.ResponseWriter, codes []string) {
+	if codes == nil {
+		util.RespondHTTPStatusOK(w)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "recoveryCodes": codes})
+}
+
+// respondCredentialError along with the violated rules, if the secret doesn't meet the policy.
+func respondCredentialError(w http.ResponseWriter, err error) {
+	policyError, ok := err.(*PolicyError)
+	if !ok {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":     "error",
+		"message":    policyError.Error(),
+		"violations": policyError.Violations,
+	})
+}
@@ -0,0 +1,286 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gitlab.com/omnijar/arusha/config"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Secrets are hashed with Argon2id (or bcrypt, if it's configured), and the hashes carry their
+// algorithm and parameters. Argon2id hashes are in the PHC string format -
+// `$argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<hash>` (with the salt and
+// hash encoded in base64, without padding).
+//
+// Hashes produced by older versions of Arusha, or imported from other systems, are stored as is
+// and they're recognized by their format while checking secrets:
+//
+// - SHA-256 hashes in hex (produced by older versions).
+// - bcrypt hashes (`$2a$`, `$2b$` or `$2y$`).
+// - PBKDF2 hashes in the modular crypt format used by passlib - `$pbkdf2-sha256$<rounds>$<salt>$<hash>`
+// (with `pbkdf2` for SHA-1 and `pbkdf2-sha512` for SHA-512), where the salt and hash are
+// encoded in base64 (without padding, and with `.` instead of `+`).
+//
+// Hashes which don't use the configured algorithm (or use weaker parameters) are replaced on the
+// next successful login (see `NeedsRehash`).
+
+const (
+	argon2Prefix   = "$argon2id$"
+	argon2SaltSize = 16
+	argon2KeySize  = 32
+	// argon2LimitFactor over the configured parameters, beyond which stored hashes are rejected.
+	argon2LimitFactor = 4
+	// bcryptLimitCost over the configured cost (which doubles the work for each step), beyond
+	// which stored hashes are rejected.
+	bcryptLimitCost = 2
+	// pbkdf2MaxRounds and pbkdf2MaxSaltSize of stored PBKDF2 hashes (which are only imported from
+	// other systems). Their keys cannot be longer than their digests, since each block of the key
+	// takes the rounds again.
+	pbkdf2MaxRounds   = 2000000
+	pbkdf2MaxSaltSize = 64
+)
+
+var (
+	sha256HashPattern = regexp.MustCompile("^[0-9a-f]{64}$")
+	pbkdf2Digests     = map[string]func() hash.Hash{
+		"pbkdf2":        sha1.New,
+		"pbkdf2-sha256": sha256.New,
+		"pbkdf2-sha512": sha512.New,
+	}
+	adaptedBase64 = base64.RawStdEncoding
+)
+
+// argon2Params are the tunable parameters of Argon2id hashes.
+type argon2Params struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+}
+
+// HashSecret hashes a given string as a secret with the configured algorithm.
+func HashSecret(secret string) (string, error) {
+	if config.Default.SecretHash == config.SecretHashBcrypt {
+		encoded, err := bcrypt.GenerateFromPassword([]byte(secret), configuredBcryptCost())
+		if err != nil {
+			return "", err
+		}
+
+		return string(encoded), nil
+	}
+
+	salt := make([]byte, argon2SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	params := configuredArgon2Params()
+	key := argon2.IDKey([]byte(secret), salt, params.iterations, params.memory, params.parallelism, argon2KeySize)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2Prefix, argon2.Version, params.memory, params.iterations,
+		params.parallelism, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckSecretHash compares a secret and a hash (in any of the supported formats) in constant time.
+func CheckSecretHash(secret, encoded string) bool {
+	switch {
+	case strings.HasPrefix(encoded, argon2Prefix):
+		params, salt, expected, ok := parseArgon2Hash(encoded)
+		if !ok {
+			return false
+		}
+
+		actual := argon2.IDKey([]byte(secret), salt, params.iterations, params.memory, params.parallelism, uint32(len(expected)))
+		return subtle.ConstantTimeCompare(actual, expected) == 1
+	case sha256HashPattern.MatchString(encoded):
+		expected, _ := hex.DecodeString(encoded)
+		actual := sha256.Sum256([]byte(secret))
+		return subtle.ConstantTimeCompare(actual[:], expected) == 1
+	case isBcryptHash(encoded):
+		return isAllowedBcryptHash(encoded) && bcrypt.CompareHashAndPassword([]byte(encoded), []byte(secret)) == nil
+	default:
+		digest, rounds, salt, expected, ok := parsePBKDF2Hash(encoded)
+		if !ok {
+			return false
+		}
+
+		actual := pbkdf2.Key([]byte(secret), salt, rounds, len(expected), digest)
+		return subtle.ConstantTimeCompare(actual, expected) == 1
+	}
+}
+
+// NeedsRehash checks whether the hash should be replaced, because it doesn't use the configured
+// algorithm or its parameters are weaker than the configured ones.
+func NeedsRehash(encoded string) bool {
+	if config.Default.SecretHash == config.SecretHashBcrypt {
+		if !isBcryptHash(encoded) {
+			return true
+		}
+
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return err != nil || cost < configuredBcryptCost()
+	}
+
+	params, _, _, ok := parseArgon2Hash(encoded)
+	configured := configuredArgon2Params()
+	return !ok || params.memory < configured.memory || params.iterations < configured.iterations ||
+		params.parallelism < configured.parallelism
+}
+
+// IsSupportedSecretHash checks whether the given hash is in one of the supported formats.
+func IsSupportedSecretHash(encoded string) bool {
+	switch {
+	case strings.HasPrefix(encoded, argon2Prefix):
+		_, _, _, ok := parseArgon2Hash(encoded)
+		return ok
+	case sha256HashPattern.MatchString(encoded):
+		return true
+	case isBcryptHash(encoded):
+		return isAllowedBcryptHash(encoded)
+	default:
+		_, _, _, _, ok := parsePBKDF2Hash(encoded)
+		return ok
+	}
+}
+
+// configuredArgon2Params for new hashes (falling back to the defaults if they're not configured).
+func configuredArgon2Params() argon2Params {
+	params := argon2Params{
+		memory:      config.Default.Argon2Memory,
+		iterations:  config.Default.Argon2Iterations,
+		parallelism: config.Default.Argon2Parallelism,
+	}
+
+	if params.memory == 0 || params.iterations == 0 || params.parallelism == 0 {
+		params = argon2Params{config.DefaultArgon2Memory, config.DefaultArgon2Iterations, config.DefaultArgon2Parallelism}
+	}
+
+	return params
+}
+
+// argon2Limits for the parameters of stored hashes - a few times the configured ones (or the
+// defaults, if those are higher), so that imported hashes cannot make logins use up the memory
+// or the CPU of the host.
+func argon2Limits() argon2Params {
+	configured := configuredArgon2Params()
+	limit := func(value, fallback, max uint32) uint32 {
+		if value < fallback {
+			value = fallback
+		}
+
+		if value > max/argon2LimitFactor {
+			return max
+		}
+
+		return value * argon2LimitFactor
+	}
+
+	return argon2Params{
+		memory:      limit(configured.memory, config.DefaultArgon2Memory, math.MaxUint32),
+		iterations:  limit(configured.iterations, config.DefaultArgon2Iterations, math.MaxUint32),
+		parallelism: uint8(limit(uint32(configured.parallelism), config.DefaultArgon2Parallelism, math.MaxUint8)),
+	}
+}
+
+// configuredBcryptCost for new hashes (falling back to the default if it's not configured).
+func configuredBcryptCost() int {
+	if config.Default.BcryptCost == 0 {
+		return config.DefaultBcryptCost
+	}
+
+	return config.Default.BcryptCost
+}
+
+// isAllowedBcryptHash checks whether the cost of the bcrypt hash is within a few steps of the
+// configured one (or the default, if that's higher), like `argon2Limits`.
+func isAllowedBcryptHash(encoded string) bool {
+	limit := configuredBcryptCost()
+	if limit < config.DefaultBcryptCost {
+		limit = config.DefaultBcryptCost
+	}
+
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err == nil && cost <= limit+bcryptLimitCost
+}
+
+func isBcryptHash(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+// parseArgon2Hash into its parameters, salt and key.
+func parseArgon2Hash(encoded string) (argon2Params, []byte, []byte, bool) {
+	var params argon2Params
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != config.SecretHashArgon2id {
+		return params, nil, nil, false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, false
+	}
+
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism)
+	if err != nil || params.memory == 0 || params.iterations == 0 || params.parallelism == 0 {
+		return params, nil, nil, false
+	}
+
+	limits := argon2Limits()
+	if params.memory > limits.memory || params.iterations > limits.iterations || params.parallelism > limits.parallelism {
+		return params, nil, nil, false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, false
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, false
+	}
+
+	return params, salt, key, true
+}
+
+// parsePBKDF2Hash into its digest, rounds, salt and key.
+func parsePBKDF2Hash(encoded string) (func() hash.Hash, int, []byte, []byte, bool) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 || parts[0] != "" {
+		return nil, 0, nil, nil, false
+	}
+
+	digest, ok := pbkdf2Digests[parts[1]]
+	if !ok {
+		return nil, 0, nil, nil, false
+	}
+
+	rounds, err := strconv.Atoi(parts[2])
+	if err != nil || rounds <= 0 || rounds > pbkdf2MaxRounds {
+		return nil, 0, nil, nil, false
+	}
+
+	salt, err := adaptedBase64.DecodeString(strings.Replace(parts[3], ".", "+", -1))
+	if err != nil || len(salt) > pbkdf2MaxSaltSize {
+		return nil, 0, nil, nil, false
+	}
+
+	key, err := adaptedBase64.DecodeString(strings.Replace(parts[4], ".", "+", -1))
+	if err != nil || len(key) == 0 || len(key) > digest().Size() {
+		return nil, 0, nil, nil, false
+	}
+
+	return digest, rounds, salt, key, true
+}
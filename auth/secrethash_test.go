@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/omnijar/arusha/config"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestCheckSecretHash(t *testing.T) {
+	secret := "correct horse battery staple"
+
+	argon2Hash, err := HashSecret(secret)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(argon2Hash, "$argon2id$v=19$m=65536,t=3,p=2$"), argon2Hash)
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	salt := []byte("0123456789abcdef")
+	key := pbkdf2.Key([]byte(secret), salt, 1000, 32, sha256.New)
+	pbkdf2Hash := "$pbkdf2-sha256$1000$" + strings.Replace(adaptedBase64.EncodeToString(salt), "+", ".", -1) +
+		"$" + strings.Replace(adaptedBase64.EncodeToString(key), "+", ".", -1)
+	sha256Hash := fmt.Sprintf("%x", sha256.Sum256([]byte(secret)))
+
+	for _, hash := range []string{argon2Hash, sha256Hash, string(bcryptHash), pbkdf2Hash} {
+		assert.True(t, IsSupportedSecretHash(hash), hash)
+		assert.True(t, CheckSecretHash(secret, hash), hash)
+		assert.False(t, CheckSecretHash("wrong secret", hash), hash)
+	}
+
+	for _, hash := range []string{"", "plaintext", "$pbkdf2-md5$1000$c2FsdA$a2V5", "$pbkdf2-sha256$x$c2FsdA$a2V5", "$2a$10$short",
+		"$argon2id$v=18$m=65536,t=3,p=2$c2FsdA$a2V5", "$argon2id$v=19$m=0,t=3,p=2$c2FsdA$a2V5",
+		"$argon2id$v=19$m=4294967295,t=3,p=2$c2FsdA$a2V5", "$argon2id$v=19$m=65536,t=1000000,p=2$c2FsdA$a2V5", "$argon2i$v=19$m=65536,t=3,p=2$c2FsdA$a2V5",
+		"$2a$31$" + strings.Repeat("a", 53), "$pbkdf2-sha256$2147483647$c2FsdA$a2V5",
+		"$pbkdf2-sha256$1000$c2FsdA$" + adaptedBase64.EncodeToString(make([]byte, 33))} {
+		assert.False(t, IsSupportedSecretHash(hash), hash)
+		assert.False(t, CheckSecretHash(secret, hash), hash)
+	}
+
+	another, err := HashSecret(secret)
+	require.NoError(t, err)
+	assert.NotEqual(t, argon2Hash, another, "hashes should be salted")
+}
+
+func TestNeedsRehash(t *testing.T) {
+	defer func() {
+		config.Default.SecretHash, config.Default.BcryptCost = "", 0
+		config.Default.Argon2Memory, config.Default.Argon2Iterations, config.Default.Argon2Parallelism = 0, 0, 0
+	}()
+
+	secret := "correct horse battery staple"
+
+	config.Default.Argon2Memory, config.Default.Argon2Iterations, config.Default.Argon2Parallelism = 1024, 1, 1
+	weakHash, err := HashSecret(secret)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(weakHash, "$argon2id$v=19$m=1024,t=1,p=1$"), weakHash)
+	assert.False(t, NeedsRehash(weakHash))
+
+	config.Default.Argon2Iterations = 2
+	assert.True(t, NeedsRehash(weakHash))
+	assert.True(t, NeedsRehash(fmt.Sprintf("%x", sha256.Sum256([]byte(secret)))))
+
+	config.Default.SecretHash, config.Default.BcryptCost = config.SecretHashBcrypt, bcrypt.MinCost
+	bcryptHash, err := HashSecret(secret)
+	require.NoError(t, err)
+	assert.True(t, CheckSecretHash(secret, bcryptHash))
+	assert.False(t, NeedsRehash(bcryptHash))
+	assert.True(t, NeedsRehash(weakHash))
+
+	config.Default.BcryptCost = bcrypt.MinCost + 1
+	assert.True(t, NeedsRehash(bcryptHash))
+}
@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"gitlab.com/omnijar/arusha/util"
+)
+
+// Sessions of a user - the logins remembered by Hydra, and the consent sessions with clients
+// (each of which has its own tokens).
+type Sessions struct {
+	Login   []util.LoginSession   `json:"login"`
+	Consent []util.ConsentSession `json:"consent"`
+}
+
+// ListSessions of the given user.
+func (c *Controller) ListSessions(userID string) (*Sessions, error) {
+	login, err := util.ListLoginSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	consent, err := util.ListConsentSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sessions{Login: login, Consent: consent}, nil
+}
+
+// RevokeSession of the given user with a client (the consent session), along with the client's
+// tokens. Login sessions cannot be revoked one by one, see `RevokeSessions`.
+func (c *Controller) RevokeSession(userID, client string) error {
+	return util.RevokeConsentSession(userID, client)
+}
+
+// RevokeSessions of the given user ("log out everywhere"), including all of the user's tokens.
+func (c *Controller) RevokeSessions(userID string) error {
+	return util.RevokeSessions(userID)
+}
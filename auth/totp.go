@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+const (
+	// TOTPPath has the TOTP secrets of users.
+	TOTPPath = "/mfa/totp"
+
+	// totpSecretSize in bytes (160 bits, as recommended by RFC 4226).
+	totpSecretSize = 20
+	// totpDigits in each code.
+	totpDigits = 6
+	// totpPeriod for which each code is valid.
+	totpPeriod = 30
+	// totpSkew is the number of periods before and after the current one for which codes are
+	// accepted, so that clocks which are slightly off still work.
+	totpSkew = 1
+)
+
+var (
+	// ErrorTOTPNotEnrolled occurs when confirming (or disabling) TOTP before enrolling.
+	ErrorTOTPNotEnrolled = errors.New("auth: TOTP hasn't been enrolled")
+	// ErrorTOTPAlreadyEnabled occurs when enrolling TOTP while it's already enabled.
+	ErrorTOTPAlreadyEnabled = errors.New("auth: TOTP is already enabled. disable it before enrolling again")
+	// ErrorInvalidCode occurs when a one-time code is wrong (or has already been used).
+	ErrorInvalidCode = errors.New("auth: invalid code")
+
+	totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// TOTPEnrollment has the secret of a new TOTP enrollment, along with the `otpauth://` URI
+// for authenticator apps (usually shown as a QR code).
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// totpSecret of a user. The secret is sealed if encryption is enabled. The counter of the last
+// accepted code is kept, so that codes cannot be replayed.
+type totpSecret struct {
+	Secret      string           `json:"secret,omitempty"`
+	Sealed      *util.SealedData `json:"sealed,omitempty"`
+	Confirmed   bool             `json:"confirmed"`
+	LastCounter int64            `json:"lastCounter"`
+	CreatedAt   time.Time        `json:"createdAt"`
+}
+
+// EnrollTOTP for the given user. This generates a new secret, which has to be confirmed with
+// a code (see `ConfirmTOTP`) before it's used for logging in. Any pending enrollment is replaced.
+func (c *Controller) EnrollTOTP(userID string) (*TOTPEnrollment, error) {
+	user, err := usersController.FindUserResourceByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := loadTOTPSecret(user.ID)
+	if err != nil {
+		return nil, err
+	} else if existing != nil && existing.Confirmed {
+		return nil, ErrorTOTPAlreadyEnabled
+	}
+
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	if err := storeTOTPSecret(user.ID, secret, &totpSecret{CreatedAt: time.Now().UTC()}); err != nil {
+		return nil, err
+	}
+
+	encoded := totpEncoding.EncodeToString(secret)
+	return &TOTPEnrollment{Secret: encoded, URI: totpURI(user.Email, encoded)}, nil
+}
+
+// ConfirmTOTP enrollment of the given user with the first code from the authenticator app.
+// Logins require a second factor once this succeeds. If the user doesn't have recovery codes
+// yet, then these are generated and returned as well.
+func (c *Controller) ConfirmTOTP(userID, code string) ([]string, error) {
+	record, err := loadTOTPSecret(userID)
+	if err != nil {
+		return nil, err
+	} else if record == nil {
+		return nil, ErrorTOTPNotEnrolled
+	} else if record.Confirmed {
+		return nil, ErrorTOTPAlreadyEnabled
+	}
+
+	// The record is only stored (as confirmed) if the code is accepted.
+	record.Confirmed = true
+	if err := verifyTOTP(userID, record, code); err != nil {
+		return nil, err
+	}
+
+	return issueRecoveryCodes(userID)
+}
+
+// DisableTOTP for the given user. The code is required, so that a stolen session alone cannot
+// remove the second factor.
+func (c *Controller) DisableTOTP(userID, code string) error {
+	record, err := loadTOTPSecret(userID)
+	if err != nil {
+		return err
+	} else if record == nil {
+		return ErrorTOTPNotEnrolled
+	}
+
+	if record.Confirmed {
+		if err := verifyTOTP(userID, record, code); err != nil {
+			return err
+		}
+	}
+
+	if err := util.GetStore(TOTPPath).Remove(userID); err != nil {
+		return err
+	}
+
+	return removeUnusedRecoveryCodes(userID)
+}
+
+// hasTOTP checks whether the user has confirmed a TOTP enrollment.
+func hasTOTP(userID string) (bool, error) {
+	record, err := loadTOTPSecret(userID)
+	if err != nil {
+		return false, err
+	}
+
+	return record != nil && record.Confirmed, nil
+}
+
+// verifyTOTP code of the user, and record its counter (so that it cannot be used again).
+func verifyTOTP(userID string, record *totpSecret, code string) error {
+	secret, err := openTOTPSecret(record)
+	if err != nil {
+		return err
+	}
+
+	counter, ok := matchTOTP(secret, strings.TrimSpace(code), time.Now(), record.LastCounter)
+	if !ok {
+		return ErrorInvalidCode
+	}
+
+	record.LastCounter = counter
+	return util.GetStore(TOTPPath).Set(userID, record)
+}
+
+// matchTOTP code at the given time, and return its counter. Codes with counters up to the last
+// accepted one are rejected.
+func matchTOTP(secret []byte, code string, at time.Time, lastCounter int64) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := at.Unix() / totpPeriod
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		if counter <= lastCounter {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+
+	return 0, false
+}
+
+// totpCode for the given counter (RFC 4226, with HMAC-SHA1).
+func totpCode(secret []byte, counter int64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulo *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo)
+}
+
+// totpURI for authenticator apps (see https://github.com/google/google-authenticator/wiki/Key-Uri-Format).
+func totpURI(account, secret string) string {
+	issuer := config.Default.TOTPIssuer
+	if issuer == "" {
+		issuer = config.DefaultTOTPIssuer
+	}
+
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// loadTOTPSecret of the user, or nil if the user hasn't enrolled.
+func loadTOTPSecret(userID string) (*totpSecret, error) {
+	var record totpSecret
+	if err := util.GetStore(TOTPPath).Get(userID, &record); err == util.ErrorKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// storeTOTPSecret of the user, sealing the secret if encryption is enabled.
+func storeTOTPSecret(userID string, secret []byte, record *totpSecret) error {
+	encoded := totpEncoding.EncodeToString(secret)
+	record.Secret, record.Sealed = encoded, nil
+	if util.IsEncryptionEnabled() {
+		sealed, err := util.Seal([]byte(encoded))
+		if err != nil {
+			return err
+		}
+
+		record.Secret, record.Sealed = "", sealed
+	}
+
+	return util.GetStore(TOTPPath).Set(userID, record)
+}
+
+// openTOTPSecret of the record.
+func openTOTPSecret(record *totpSecret) ([]byte, error) {
+	encoded := record.Secret
+	if record.Sealed != nil {
+		data, err := util.Open(*record.Sealed)
+		if err != nil {
+			return nil, err
+		}
+
+		encoded = string(data)
+	}
+
+	return totpEncoding.DecodeString(encoded)
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/users"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors from RFC 6238 (truncated to 6 digits).
+	secret := []byte("12345678901234567890")
+	for seconds, code := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		assert.Equal(t, code, totpCode(secret, seconds/totpPeriod), seconds)
+	}
+
+	at := time.Unix(1111111109, 0)
+	counter, ok := matchTOTP(secret, "081804", at.Add(totpPeriod*time.Second), 0)
+	assert.True(t, ok, "codes from the previous period should be accepted")
+	assert.Equal(t, int64(1111111109/totpPeriod), counter)
+
+	_, ok = matchTOTP(secret, "081804", at, counter)
+	assert.False(t, ok, "codes shouldn't be accepted twice")
+	_, ok = matchTOTP(secret, "081804", at.Add(2*totpPeriod*time.Second), 0)
+	assert.False(t, ok)
+	_, ok = matchTOTP(secret, "81804", at, 0)
+	assert.False(t, ok)
+}
+
+func TestSecondFactorLogin(t *testing.T) {
+	config.Default.DatabaseURL = util.StoreMemory
+	require.NoError(t, util.InitializeStore())
+	config.Default.LockoutThreshold, config.Default.LockoutDuration = 3, time.Hour
+	defer func() { config.Default.LockoutThreshold, config.Default.LockoutDuration = 0, 0 }()
+
+	_, err := usersController.Import(users.UserResource{ID: "TOTP", Email: "totp@example.com", Verified: true, Firstname: "Foo"})
+	require.NoError(t, err)
+
+	c := &Controller{}
+	user, err := usersController.FindUserResourceByID("TOTP")
+	require.NoError(t, err)
+	challenge, err := c.BeginSecondFactor(user, "login-1")
+	require.NoError(t, err)
+	assert.Nil(t, challenge, "users without a second factor shouldn't be challenged")
+
+	enrollment, err := c.EnrollTOTP("TOTP")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(enrollment.URI, "otpauth://totp/Arusha:totp@example.com?"), enrollment.URI)
+	assert.Contains(t, enrollment.URI, "secret="+enrollment.Secret)
+
+	secret, err := totpEncoding.DecodeString(enrollment.Secret)
+	require.NoError(t, err)
+	codeAt := func(offset int64) string {
+		return totpCode(secret, time.Now().Unix()/totpPeriod+offset)
+	}
+
+	assert.Equal(t, ErrorTOTPNotEnrolled, c.DisableTOTP("NOBODY", codeAt(0)))
+	_, err = c.ConfirmTOTP("TOTP", "000000x")
+	assert.Equal(t, ErrorInvalidCode, err)
+	challenge, err = c.BeginSecondFactor(user, "login-1")
+	require.NoError(t, err)
+	assert.Nil(t, challenge, "unconfirmed enrollments shouldn't be used")
+
+	codes, err := c.ConfirmTOTP("TOTP", codeAt(-1))
+	require.NoError(t, err)
+	assert.Len(t, codes, recoveryCodeCount)
+	_, err = c.EnrollTOTP("TOTP")
+	assert.Equal(t, ErrorTOTPAlreadyEnabled, err)
+
+	challenge, err = c.BeginSecondFactor(user, "login-1")
+	require.NoError(t, err)
+	require.NotNil(t, challenge)
+	assert.Equal(t, []string{SecondFactorTOTP, SecondFactorRecovery}, challenge.Methods)
+
+	// The challenge only works for its own login, and wrong codes count as failed logins.
+	_, err = c.VerifySecondFactor(Credential{Token: challenge.Token, Code: codeAt(0)}, "login-2")
+	assert.Equal(t, util.ErrorTokenInvalid, err)
+	_, err = c.VerifySecondFactor(Credential{Token: challenge.Token, Code: codeAt(-1)}, "login-1")
+	assert.Equal(t, ErrorInvalidCode, err, "codes shouldn't be accepted twice")
+
+	verified, err := c.VerifySecondFactor(Credential{Token: challenge.Token, Code: codeAt(0)}, "login-1")
+	require.NoError(t, err)
+	assert.Equal(t, "TOTP", verified.ID)
+
+	failures, err := loadLoginFailures(LockoutKindUser, "TOTP")
+	require.NoError(t, err)
+	assert.Nil(t, failures, "failures should be cleared after the second factor")
+
+	_, err = c.VerifySecondFactor(Credential{Token: challenge.Token, Code: codeAt(1)}, "login-1")
+	assert.Equal(t, util.ErrorTokenInvalid, err, "challenges shouldn't be used twice")
+
+	assert.Equal(t, ErrorInvalidCode, c.DisableTOTP("TOTP", codeAt(0)))
+	require.NoError(t, c.DisableTOTP("TOTP", codeAt(1)))
+	challenge, err = c.BeginSecondFactor(user, "login-3")
+	require.NoError(t, err)
+	assert.Nil(t, challenge)
+
+	enabled, err := hasRecoveryCodes("TOTP")
+	require.NoError(t, err)
+	assert.False(t, enabled, "recovery codes should be removed along with the last second factor")
+}
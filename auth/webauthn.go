@@ -0,0 +1,696 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/users"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+const (
+	// WebAuthnPath has the WebAuthn credentials of users.
+	WebAuthnPath = "/mfa/webauthn"
+
+	// COSE algorithms supported for WebAuthn credentials.
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+
+	// Flags in the authenticator data.
+	authDataUserPresent  = 0x01
+	authDataUserVerified = 0x04
+	authDataAttested     = 0x40
+
+	// authDataMinLength is the length of the RP ID hash, flags and sign count.
+	authDataMinLength = 37
+)
+
+var (
+	// ErrorWebAuthnNotConfigured occurs when using WebAuthn without a relying party ID.
+	ErrorWebAuthnNotConfigured = errors.New("auth: WebAuthn isn't configured (" + config.EnvWebAuthnRPID + ")")
+	// ErrorWebAuthnInvalid occurs when a WebAuthn response cannot be verified.
+	ErrorWebAuthnInvalid = errors.New("auth: invalid WebAuthn response")
+	// ErrorWebAuthnCredentialNotFound occurs when a WebAuthn credential isn't registered.
+	ErrorWebAuthnCredentialNotFound = errors.New("auth: WebAuthn credential isn't registered")
+	// ErrorWebAuthnCredentialExists occurs when registering a WebAuthn credential twice.
+	ErrorWebAuthnCredentialExists = errors.New("auth: WebAuthn credential has already been registered")
+	// ErrorWebAuthnUserNotVerified occurs when logging in without a secret with a WebAuthn
+	// credential which hasn't verified the user (with a PIN or biometrics).
+	ErrorWebAuthnUserNotVerified = errors.New("auth: WebAuthn credential didn't verify the user")
+	// ErrorWebAuthnSignCount occurs when the sign count of a credential doesn't increase, which
+	// means that the authenticator may have been cloned.
+	ErrorWebAuthnSignCount = errors.New("auth: WebAuthn sign count didn't increase. the authenticator may have been cloned")
+
+	webAuthnEncoding = base64.RawURLEncoding
+)
+
+// WebAuthnCredential registered by a user (a security key or a passkey).
+type WebAuthnCredential struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	PublicKey  string     `json:"publicKey"`
+	SignCount  uint32     `json:"signCount"`
+	AAGUID     string     `json:"aaguid"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// WebAuthnEntity is the relying party or the user in the creation options.
+type WebAuthnEntity struct {
+	ID          string `json:"id,omitempty"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName,omitempty"`
+}
+
+// WebAuthnParameter is one of the supported credential types.
+type WebAuthnParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// WebAuthnDescriptor of a registered credential.
+type WebAuthnDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// WebAuthnCreationOptions for `navigator.credentials.create()`. Binary values are base64url
+// encoded, so they should be decoded before calling the browser.
+type WebAuthnCreationOptions struct {
+	Challenge              string               `json:"challenge"`
+	RP                     WebAuthnEntity       `json:"rp"`
+	User                   WebAuthnEntity       `json:"user"`
+	PubKeyCredParams       []WebAuthnParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                `json:"timeout"`
+	ExcludeCredentials     []WebAuthnDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection map[string]string    `json:"authenticatorSelection"`
+	Attestation            string               `json:"attestation"`
+}
+
+// WebAuthnRequestOptions for `navigator.credentials.get()`. Binary values are base64url encoded.
+type WebAuthnRequestOptions struct {
+	Challenge        string               `json:"challenge"`
+	RPID             string               `json:"rpId"`
+	Timeout          int64                `json:"timeout"`
+	AllowCredentials []WebAuthnDescriptor `json:"allowCredentials"`
+	UserVerification string               `json:"userVerification"`
+}
+
+// WebAuthnResponse is the credential returned by the browser, with its binary values base64url
+// encoded. Name is an optional nickname for new credentials.
+type WebAuthnResponse struct {
+	ID       string                        `json:"id"`
+	Type     string                        `json:"type"`
+	Name     string                        `json:"name,omitempty"`
+	Response WebAuthnAuthenticatorResponse `json:"response"`
+}
+
+// WebAuthnAuthenticatorResponse has the attestation (for registrations) or the assertion (for logins).
+type WebAuthnAuthenticatorResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject,omitempty"`
+	AuthenticatorData string `json:"authenticatorData,omitempty"`
+	Signature         string `json:"signature,omitempty"`
+	UserHandle        string `json:"userHandle,omitempty"`
+}
+
+// webAuthnClientData is signed by the authenticator (along with the authenticator data).
+type webAuthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// BeginWebAuthnRegistration for the given user. The options are passed to the browser, and the
+// new credential is sent back to `FinishWebAuthnRegistration`.
+func (c *Controller) BeginWebAuthnRegistration(userID string) (*WebAuthnCreationOptions, error) {
+	if config.Default.WebAuthnRPID == "" {
+		return nil, ErrorWebAuthnNotConfigured
+	}
+
+	user, err := usersController.FindUserResourceByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := c.ListWebAuthnCredentials(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := mintWebAuthnChallenge(util.TokenPurposeWebAuthnRegistration, user.ID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	displayName := strings.TrimSpace(user.Firstname + " " + user.Lastname)
+	if displayName == "" {
+		displayName = user.Email
+	}
+
+	return &WebAuthnCreationOptions{
+		Challenge: challenge,
+		RP:        WebAuthnEntity{ID: config.Default.WebAuthnRPID, Name: webAuthnRPName()},
+		User:      WebAuthnEntity{ID: webAuthnEncoding.EncodeToString([]byte(user.ID)), Name: user.Email, DisplayName: displayName},
+		PubKeyCredParams: []WebAuthnParameter{
+			{Type: "public-key", Alg: coseAlgES256},
+			{Type: "public-key", Alg: coseAlgEdDSA},
+			{Type: "public-key", Alg: coseAlgRS256},
+		},
+		Timeout:                int64(util.TokenTTL(util.TokenPurposeWebAuthnRegistration) / time.Millisecond),
+		ExcludeCredentials:     webAuthnDescriptors(credentials),
+		AuthenticatorSelection: map[string]string{"residentKey": "preferred", "userVerification": "preferred"},
+		Attestation:            "none",
+	}, nil
+}
+
+// FinishWebAuthnRegistration of a new credential for the given user. Attestation statements
+// aren't verified (the options ask for none), so this doesn't prove the make of the authenticator.
+// Like `ConfirmTOTP`, this also returns new recovery codes if the user doesn't have any yet.
+func (c *Controller) FinishWebAuthnRegistration(userID string, response WebAuthnResponse) (*WebAuthnCredential, []string, error) {
+	if config.Default.WebAuthnRPID == "" {
+		return nil, nil, ErrorWebAuthnNotConfigured
+	}
+
+	clientData, _, err := parseWebAuthnClientData(response, "webauthn.create")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	attestation, err := decodeWebAuthnBinary(response.Response.AttestationObject)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	decoded, _, err := decodeCBOR(attestation)
+	object, ok := decoded.(map[interface{}]interface{})
+	if err != nil || !ok {
+		return nil, nil, ErrorWebAuthnInvalid
+	}
+
+	authData, ok := object["authData"].([]byte)
+	if !ok {
+		return nil, nil, ErrorWebAuthnInvalid
+	}
+
+	flags, signCount, err := checkWebAuthnAuthData(authData)
+	if err != nil {
+		return nil, nil, err
+	} else if flags&authDataAttested == 0 {
+		return nil, nil, ErrorWebAuthnInvalid
+	}
+
+	// The attested credential data has the AAGUID, the credential ID and the public key.
+	data := authData[authDataMinLength:]
+	if len(data) < 18 {
+		return nil, nil, ErrorWebAuthnInvalid
+	}
+
+	aaguid, idLength := data[:16], int(binary.BigEndian.Uint16(data[16:18]))
+	if len(data) < 18+idLength {
+		return nil, nil, ErrorWebAuthnInvalid
+	}
+
+	credentialID := data[18 : 18+idLength]
+	_, keyLength, err := decodeCBOR(data[18+idLength:])
+	if err != nil {
+		return nil, nil, ErrorWebAuthnInvalid
+	}
+
+	publicKey := data[18+idLength : 18+idLength+keyLength]
+	if _, _, err := parseCOSEKey(publicKey); err != nil {
+		return nil, nil, err
+	}
+
+	// The challenge is only consumed once the response is valid.
+	if _, err := consumeWebAuthnChallenge(util.TokenPurposeWebAuthnRegistration, clientData.Challenge, userID, ""); err != nil {
+		return nil, nil, err
+	}
+
+	credentials, err := c.ListWebAuthnCredentials(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	credential := WebAuthnCredential{
+		ID:        webAuthnEncoding.EncodeToString(credentialID),
+		Name:      strings.TrimSpace(response.Name),
+		PublicKey: webAuthnEncoding.EncodeToString(publicKey),
+		SignCount: signCount,
+		AAGUID:    hex.EncodeToString(aaguid),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	for _, existing := range credentials {
+		if existing.ID == credential.ID {
+			return nil, nil, ErrorWebAuthnCredentialExists
+		}
+	}
+
+	if err := util.GetStore(WebAuthnPath).Set(userID, append(credentials, credential)); err != nil {
+		return nil, nil, err
+	}
+
+	codes, err := issueRecoveryCodes(userID)
+	return &credential, codes, err
+}
+
+// ListWebAuthnCredentials of the given user.
+func (c *Controller) ListWebAuthnCredentials(userID string) ([]WebAuthnCredential, error) {
+	credentials := *new([]WebAuthnCredential)
+	if err := util.GetStore(WebAuthnPath).Get(userID, &credentials); err != nil && err != util.ErrorKeyNotFound {
+		return nil, err
+	}
+
+	return credentials, nil
+}
+
+// RemoveWebAuthnCredential of the given user.
+func (c *Controller) RemoveWebAuthnCredential(userID, credentialID string) error {
+	credentials, err := c.ListWebAuthnCredentials(userID)
+	if err != nil {
+		return err
+	}
+
+	remaining := *new([]WebAuthnCredential)
+	for _, credential := range credentials {
+		if credential.ID != credentialID {
+			remaining = append(remaining, credential)
+		}
+	}
+
+	if len(remaining) == len(credentials) {
+		return ErrorWebAuthnCredentialNotFound
+	} else if len(remaining) == 0 {
+		if err := util.GetStore(WebAuthnPath).Remove(userID); err != nil {
+			return err
+		}
+
+		return removeUnusedRecoveryCodes(userID)
+	}
+
+	return util.GetStore(WebAuthnPath).Set(userID, remaining)
+}
+
+// BeginWebAuthnLogin for the given login challenge (from Hydra). If the credential has the token
+// from a second factor challenge (see `BeginSecondFactor`) or an email, then only the credentials
+// of that user are allowed. Otherwise, the user is identified from the credential they pick
+// (which should be discoverable, i.e., a passkey).
+func (c *Controller) BeginWebAuthnLogin(credential Credential, loginChallenge string) (*WebAuthnRequestOptions, error) {
+	if config.Default.WebAuthnRPID == "" {
+		return nil, ErrorWebAuthnNotConfigured
+	}
+
+	userID := ""
+	if credential.Token != "" {
+		token, err := util.LookupToken(util.TokenPurposeSecondFactor, credential.Token)
+		if err != nil {
+			return nil, err
+		} else if token.Value != loginChallenge {
+			return nil, util.ErrorTokenInvalid
+		}
+
+		userID = token.Subject
+	} else if credential.Email != "" {
+		if err := credential.ValidateEmail(); err != nil {
+			return nil, err
+		}
+
+		// Unknown emails get options without any credentials (like users without passkeys), so
+		// that the response doesn't reveal whether the email exists.
+		if user, err := usersController.FindUserResourceByEmail(credential.Email); err == nil {
+			userID = user.ID
+		}
+	}
+
+	var allowed []WebAuthnCredential
+	if userID != "" {
+		var err error
+		if allowed, err = c.ListWebAuthnCredentials(userID); err != nil {
+			return nil, err
+		}
+	}
+
+	challenge, err := mintWebAuthnChallenge(util.TokenPurposeWebAuthnAssertion, userID, loginChallenge)
+	if err != nil {
+		return nil, err
+	}
+
+	// Logins without a secret need the user to be verified (see `FinishWebAuthnLogin`).
+	verification := "required"
+	if credential.Token != "" {
+		verification = "preferred"
+	}
+
+	return &WebAuthnRequestOptions{
+		Challenge:        challenge,
+		RPID:             config.Default.WebAuthnRPID,
+		Timeout:          int64(util.TokenTTL(util.TokenPurposeWebAuthnAssertion) / time.Millisecond),
+		AllowCredentials: webAuthnDescriptors(allowed),
+		UserVerification: verification,
+	}, nil
+}
+
+// FinishWebAuthnLogin (without a secret) for the given login challenge, and return the user.
+// The credential should verify the user (with a PIN or biometrics), so that it counts as multiple
+// factors - otherwise, it would skip the second factor that logins with a secret require.
+// Failures count as failed logins (see `Login`).
+func (c *Controller) FinishWebAuthnLogin(response WebAuthnResponse, loginChallenge, address string) (*users.UserResource, error) {
+	if err := checkLockout(LockoutKindAddress, address); err != nil {
+		return nil, err
+	}
+
+	userID, flags, err := verifyWebAuthnAssertion(response, loginChallenge, "")
+	if err != nil {
+		if userID != "" {
+			recordLoginFailure(LockoutKindUser, userID)
+		}
+
+		recordLoginFailure(LockoutKindAddress, address)
+		return nil, err
+	}
+
+	if err := checkLockout(LockoutKindUser, userID); err != nil {
+		return nil, err
+	}
+
+	if flags&authDataUserVerified == 0 {
+		return nil, ErrorWebAuthnUserNotVerified
+	}
+
+	user, err := usersController.FindUserResourceByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockoutStore(LockoutKindUser).Remove(user.ID); err != nil {
+		log.Printf("auth: error clearing failed logins of user %s: %s", user.ID, err)
+	}
+
+	return user, nil
+}
+
+// hasWebAuthn checks whether the user has registered WebAuthn credentials.
+func hasWebAuthn(userID string) (bool, error) {
+	credentials, err := (&Controller{}).ListWebAuthnCredentials(userID)
+	return len(credentials) > 0, err
+}
+
+// verifyWebAuthnAssertion for the given login challenge, and update the sign count of the
+// credential. If a user is given, then the credential should belong to them. This returns the
+// user ID (once it's known, even if the assertion is invalid) and the flags of the authenticator.
+func verifyWebAuthnAssertion(response WebAuthnResponse, loginChallenge, expectedUserID string) (string, byte, error) {
+	if config.Default.WebAuthnRPID == "" {
+		return "", 0, ErrorWebAuthnNotConfigured
+	}
+
+	clientData, clientDataJSON, err := parseWebAuthnClientData(response, "webauthn.get")
+	if err != nil {
+		return "", 0, err
+	}
+
+	token, err := lookupWebAuthnChallenge(util.TokenPurposeWebAuthnAssertion, clientData.Challenge)
+	if err != nil {
+		return "", 0, err
+	} else if token.Value != loginChallenge {
+		return "", 0, util.ErrorTokenInvalid
+	}
+
+	// Discoverable credentials have the user ID as the user handle.
+	userID := token.Subject
+	if userID == "" {
+		handle, err := decodeWebAuthnBinary(response.Response.UserHandle)
+		if err != nil || len(handle) == 0 {
+			return "", 0, ErrorWebAuthnInvalid
+		}
+
+		userID = string(handle)
+	}
+
+	if expectedUserID != "" && userID != expectedUserID {
+		return "", 0, ErrorWebAuthnCredentialNotFound
+	}
+
+	controller := &Controller{}
+	credentials, err := controller.ListWebAuthnCredentials(userID)
+	if err != nil {
+		return userID, 0, err
+	}
+
+	index := -1
+	for i, credential := range credentials {
+		if credential.ID == strings.TrimRight(response.ID, "=") {
+			index = i
+		}
+	}
+
+	if index < 0 {
+		return userID, 0, ErrorWebAuthnCredentialNotFound
+	}
+
+	authData, err := decodeWebAuthnBinary(response.Response.AuthenticatorData)
+	if err != nil {
+		return userID, 0, err
+	}
+
+	flags, signCount, err := checkWebAuthnAuthData(authData)
+	if err != nil {
+		return userID, 0, err
+	}
+
+	signature, err := decodeWebAuthnBinary(response.Response.Signature)
+	if err != nil {
+		return userID, 0, err
+	}
+
+	credential := &credentials[index]
+	publicKey, err := webAuthnEncoding.DecodeString(credential.PublicKey)
+	if err != nil {
+		return userID, 0, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	if err := verifyCOSESignature(publicKey, append(append([]byte{}, authData...), clientDataHash[:]...), signature); err != nil {
+		return userID, 0, err
+	}
+
+	// Authenticators without counters always return zero.
+	if (signCount != 0 || credential.SignCount != 0) && signCount <= credential.SignCount {
+		return userID, 0, ErrorWebAuthnSignCount
+	}
+
+	if _, err := consumeWebAuthnChallenge(util.TokenPurposeWebAuthnAssertion, clientData.Challenge, token.Subject, loginChallenge); err != nil {
+		return userID, 0, err
+	}
+
+	now := time.Now().UTC()
+	credential.SignCount, credential.LastUsedAt = signCount, &now
+	if err := util.GetStore(WebAuthnPath).Set(userID, credentials); err != nil {
+		return userID, 0, err
+	}
+
+	return userID, flags, nil
+}
+
+// parseWebAuthnClientData of the response, and check its type and origin. This returns the
+// client data along with its JSON (which is signed by the authenticator).
+func parseWebAuthnClientData(response WebAuthnResponse, ceremony string) (*webAuthnClientData, []byte, error) {
+	if response.Type != "public-key" {
+		return nil, nil, ErrorWebAuthnInvalid
+	}
+
+	clientDataJSON, err := decodeWebAuthnBinary(response.Response.ClientDataJSON)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var clientData webAuthnClientData
+	if err := json.Unmarshal(clientDataJSON, &clientData); err != nil || clientData.Type != ceremony {
+		return nil, nil, ErrorWebAuthnInvalid
+	}
+
+	for _, origin := range config.Default.WebAuthnOrigins {
+		if clientData.Origin == origin {
+			return &clientData, clientDataJSON, nil
+		}
+	}
+
+	return nil, nil, errors.New("auth: WebAuthn origin '" + clientData.Origin + "' isn't allowed")
+}
+
+// checkWebAuthnAuthData for the relying party ID and user presence, and return its flags and
+// sign count.
+func checkWebAuthnAuthData(authData []byte) (byte, uint32, error) {
+	if len(authData) < authDataMinLength {
+		return 0, 0, ErrorWebAuthnInvalid
+	}
+
+	rpIDHash := sha256.Sum256([]byte(config.Default.WebAuthnRPID))
+	if !bytes.Equal(authData[:32], rpIDHash[:]) {
+		return 0, 0, ErrorWebAuthnInvalid
+	}
+
+	flags := authData[32]
+	if flags&authDataUserPresent == 0 {
+		return 0, 0, ErrorWebAuthnInvalid
+	}
+
+	return flags, binary.BigEndian.Uint32(authData[33:37]), nil
+}
+
+// mintWebAuthnChallenge as a token, so that it expires and can only be used once. The challenge
+// is the token's bytes (base64url encoded).
+func mintWebAuthnChallenge(purpose, userID, loginChallenge string) (string, error) {
+	token, err := util.MintToken(nil, purpose, userID, loginChallenge)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := hex.DecodeString(token)
+	if err != nil {
+		return "", err
+	}
+
+	return webAuthnEncoding.EncodeToString(data), nil
+}
+
+// lookupWebAuthnChallenge (from the client data) for the given purpose.
+func lookupWebAuthnChallenge(purpose, challenge string) (*util.Token, error) {
+	data, err := decodeWebAuthnBinary(challenge)
+	if err != nil {
+		return nil, util.ErrorTokenInvalid
+	}
+
+	return util.LookupToken(purpose, hex.EncodeToString(data))
+}
+
+// consumeWebAuthnChallenge (from the client data) for the given purpose, and check that it has
+// been minted for the given user and login challenge.
+func consumeWebAuthnChallenge(purpose, challenge, userID, loginChallenge string) (*util.Token, error) {
+	data, err := decodeWebAuthnBinary(challenge)
+	if err != nil {
+		return nil, util.ErrorTokenInvalid
+	}
+
+	// The token is checked before consuming it, so that it isn't lost to someone else's response.
+	token, err := util.LookupToken(purpose, hex.EncodeToString(data))
+	if err != nil {
+		return nil, err
+	} else if token.Subject != userID || token.Value != loginChallenge {
+		return nil, util.ErrorTokenInvalid
+	}
+
+	return util.ConsumeToken(purpose, hex.EncodeToString(data))
+}
+
+// decodeWebAuthnBinary value (base64url, with or without padding).
+func decodeWebAuthnBinary(value string) ([]byte, error) {
+	data, err := webAuthnEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, ErrorWebAuthnInvalid
+	}
+
+	return data, nil
+}
+
+func webAuthnDescriptors(credentials []WebAuthnCredential) []WebAuthnDescriptor {
+	descriptors := *new([]WebAuthnDescriptor)
+	for _, credential := range credentials {
+		descriptors = append(descriptors, WebAuthnDescriptor{Type: "public-key", ID: credential.ID})
+	}
+
+	return descriptors
+}
+
+func webAuthnRPName() string {
+	if config.Default.WebAuthnRPName == "" {
+		return config.DefaultWebAuthnRPName
+	}
+
+	return config.Default.WebAuthnRPName
+}
+
+// parseCOSEKey for one of the supported algorithms, and return it along with the algorithm.
+func parseCOSEKey(data []byte) (crypto.PublicKey, int64, error) {
+	decoded, _, err := decodeCBOR(data)
+	key, ok := decoded.(map[interface{}]interface{})
+	if err != nil || !ok {
+		return nil, 0, ErrorWebAuthnInvalid
+	}
+
+	alg, _ := key[int64(3)].(int64)
+	switch alg {
+	case coseAlgES256:
+		x, okX := key[int64(-2)].([]byte)
+		y, okY := key[int64(-3)].([]byte)
+		if key[int64(1)] != int64(2) || key[int64(-1)] != int64(1) || !okX || !okY {
+			return nil, 0, ErrorWebAuthnInvalid
+		}
+
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return nil, 0, ErrorWebAuthnInvalid
+		}
+
+		return publicKey, alg, nil
+	case coseAlgEdDSA:
+		x, okX := key[int64(-2)].([]byte)
+		if key[int64(1)] != int64(1) || key[int64(-1)] != int64(6) || !okX || len(x) != ed25519.PublicKeySize {
+			return nil, 0, ErrorWebAuthnInvalid
+		}
+
+		return ed25519.PublicKey(x), alg, nil
+	case coseAlgRS256:
+		n, okN := key[int64(-1)].([]byte)
+		e, okE := key[int64(-2)].([]byte)
+		if key[int64(1)] != int64(3) || !okN || !okE || len(e) > 4 {
+			return nil, 0, ErrorWebAuthnInvalid
+		}
+
+		exponent := new(big.Int).SetBytes(e)
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, alg, nil
+	default:
+		return nil, 0, errors.New("auth: unsupported WebAuthn credential algorithm")
+	}
+}
+
+// verifyCOSESignature of the data with the COSE key.
+func verifyCOSESignature(keyData, data, signature []byte) error {
+	publicKey, alg, err := parseCOSEKey(keyData)
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256(data)
+	valid := false
+	switch alg {
+	case coseAlgES256:
+		valid = ecdsa.VerifyASN1(publicKey.(*ecdsa.PublicKey), digest[:], signature)
+	case coseAlgEdDSA:
+		valid = ed25519.Verify(publicKey.(ed25519.PublicKey), data, signature)
+	case coseAlgRS256:
+		valid = rsa.VerifyPKCS1v15(publicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) == nil
+	}
+
+	if !valid {
+		return ErrorWebAuthnInvalid
+	}
+
+	return nil
+}
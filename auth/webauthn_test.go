@@ -0,0 +1,257 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/users"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+// encodeCBOR for the test authenticator (only the types used by WebAuthn).
+func encodeCBOR(value interface{}) []byte {
+	header := func(major byte, argument uint64) []byte {
+		switch {
+		case argument < 24:
+			return []byte{major<<5 | byte(argument)}
+		case argument < 1<<8:
+			return []byte{major<<5 | 24, byte(argument)}
+		default:
+			data := []byte{major<<5 | 25, 0, 0}
+			binary.BigEndian.PutUint16(data[1:], uint16(argument))
+			return data
+		}
+	}
+
+	switch v := value.(type) {
+	case int:
+		if v < 0 {
+			return header(1, uint64(-1-v))
+		}
+
+		return header(0, uint64(v))
+	case []byte:
+		return append(header(2, uint64(len(v))), v...)
+	case string:
+		return append(header(3, uint64(len(v))), v...)
+	case map[interface{}]interface{}:
+		data := header(5, uint64(len(v)))
+		for key, item := range v {
+			data = append(append(data, encodeCBOR(key)...), encodeCBOR(item)...)
+		}
+
+		return data
+	default:
+		panic("unsupported CBOR type")
+	}
+}
+
+// softwareAuthenticator is a platform authenticator with an ES256 key, for testing the ceremonies.
+type softwareAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+	flags        byte
+}
+
+func newSoftwareAuthenticator(t *testing.T) *softwareAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	credentialID := make([]byte, 16)
+	_, err = rand.Read(credentialID)
+	require.NoError(t, err)
+
+	return &softwareAuthenticator{key: key, credentialID: credentialID, flags: authDataUserPresent}
+}
+
+func (a *softwareAuthenticator) authData(rpID string, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append(rpIDHash[:], a.flags)
+	if attested != nil {
+		data[32] |= authDataAttested
+	}
+
+	a.signCount++
+	data = append(data, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.signCount)
+	return append(data, attested...)
+}
+
+func (a *softwareAuthenticator) clientData(ceremony, challenge, origin string) []byte {
+	data, _ := json.Marshal(webAuthnClientData{Type: ceremony, Challenge: challenge, Origin: origin})
+	return data
+}
+
+func (a *softwareAuthenticator) create(options *WebAuthnCreationOptions, origin string) WebAuthnResponse {
+	a.userHandle, _ = webAuthnEncoding.DecodeString(options.User.ID)
+
+	x, y := make([]byte, 32), make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	publicKey := encodeCBOR(map[interface{}]interface{}{1: 2, 3: coseAlgES256, -1: 1, -2: x, -3: y})
+
+	attested := make([]byte, 18)
+	binary.BigEndian.PutUint16(attested[16:], uint16(len(a.credentialID)))
+	attested = append(append(attested, a.credentialID...), publicKey...)
+
+	object := encodeCBOR(map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": a.authData(options.RP.ID, attested),
+	})
+
+	return WebAuthnResponse{
+		ID:   webAuthnEncoding.EncodeToString(a.credentialID),
+		Type: "public-key",
+		Name: "Test key",
+		Response: WebAuthnAuthenticatorResponse{
+			ClientDataJSON:    webAuthnEncoding.EncodeToString(a.clientData("webauthn.create", options.Challenge, origin)),
+			AttestationObject: webAuthnEncoding.EncodeToString(object),
+		},
+	}
+}
+
+func (a *softwareAuthenticator) get(t *testing.T, options *WebAuthnRequestOptions, origin string) WebAuthnResponse {
+	clientData := a.clientData("webauthn.get", options.Challenge, origin)
+	authData := a.authData(options.RPID, nil)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	require.NoError(t, err)
+
+	return WebAuthnResponse{
+		ID:   webAuthnEncoding.EncodeToString(a.credentialID),
+		Type: "public-key",
+		Response: WebAuthnAuthenticatorResponse{
+			ClientDataJSON:    webAuthnEncoding.EncodeToString(clientData),
+			AuthenticatorData: webAuthnEncoding.EncodeToString(authData),
+			Signature:         webAuthnEncoding.EncodeToString(signature),
+			UserHandle:        webAuthnEncoding.EncodeToString(a.userHandle),
+		},
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	value, size, err := decodeCBOR(encodeCBOR(map[interface{}]interface{}{"a": []byte{1, 2}, -300: 1000}))
+	require.NoError(t, err)
+	assert.Equal(t, map[interface{}]interface{}{"a": []byte{1, 2}, int64(-300): int64(1000)}, value)
+	assert.Equal(t, 12, size)
+
+	for _, data := range [][]byte{{}, {0x5f}, {0x62, 'a'}, {0xa1, 0x40, 0x01}, {0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, {0xf9, 0, 0}} {
+		_, _, err := decodeCBOR(data)
+		assert.Equal(t, ErrorInvalidCBOR, err, "%x", data)
+	}
+}
+
+func TestWebAuthn(t *testing.T) {
+	config.Default.DatabaseURL = util.StoreMemory
+	require.NoError(t, util.InitializeStore())
+	config.Default.WebAuthnRPID, config.Default.WebAuthnOrigins = "example.com", []string{"https://example.com"}
+	defer func() { config.Default.WebAuthnRPID, config.Default.WebAuthnOrigins = "", nil }()
+
+	_, err := usersController.Import(users.UserResource{ID: "WEBAUTHN", Email: "webauthn@example.com", Verified: true, Firstname: "Foo"})
+	require.NoError(t, err)
+
+	c := &Controller{}
+	origin := "https://example.com"
+	authenticator := newSoftwareAuthenticator(t)
+
+	// Registration
+	options, err := c.BeginWebAuthnRegistration("WEBAUTHN")
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", options.RP.ID)
+	assert.Equal(t, "webauthn@example.com", options.User.Name)
+
+	_, _, err = c.FinishWebAuthnRegistration("WEBAUTHN", authenticator.create(options, "https://evil.example.com"))
+	assert.Error(t, err)
+	_, _, err = c.FinishWebAuthnRegistration("OTHER", authenticator.create(options, origin))
+	assert.Equal(t, util.ErrorTokenInvalid, err, "challenges should only work for their own user")
+
+	registration := authenticator.create(options, origin)
+	credential, codes, err := c.FinishWebAuthnRegistration("WEBAUTHN", registration)
+	require.NoError(t, err)
+	assert.Equal(t, "Test key", credential.Name)
+	assert.Len(t, codes, recoveryCodeCount)
+	_, _, err = c.FinishWebAuthnRegistration("WEBAUTHN", registration)
+	assert.Equal(t, util.ErrorTokenInvalid, err, "challenges shouldn't be used twice")
+
+	options, err = c.BeginWebAuthnRegistration("WEBAUTHN")
+	require.NoError(t, err)
+	assert.Equal(t, []WebAuthnDescriptor{{Type: "public-key", ID: credential.ID}}, options.ExcludeCredentials)
+	_, _, err = c.FinishWebAuthnRegistration("WEBAUTHN", authenticator.create(options, origin))
+	assert.Equal(t, ErrorWebAuthnCredentialExists, err)
+
+	// Passwordless login with a passkey needs user verification, so that it isn't a single factor.
+	request, err := c.BeginWebAuthnLogin(Credential{}, "login-1")
+	require.NoError(t, err)
+	assert.Empty(t, request.AllowCredentials)
+	assert.Equal(t, "required", request.UserVerification)
+
+	_, err = c.FinishWebAuthnLogin(authenticator.get(t, request, origin), "login-1", "")
+	assert.Equal(t, ErrorWebAuthnUserNotVerified, err)
+
+	authenticator.flags |= authDataUserVerified
+	request, err = c.BeginWebAuthnLogin(Credential{}, "login-1")
+	require.NoError(t, err)
+	assertion := authenticator.get(t, request, origin)
+	_, err = c.FinishWebAuthnLogin(assertion, "login-2", "")
+	assert.Equal(t, util.ErrorTokenInvalid, err)
+	user, err := c.FinishWebAuthnLogin(assertion, "login-1", "")
+	require.NoError(t, err)
+	assert.Equal(t, "WEBAUTHN", user.ID)
+	_, err = c.FinishWebAuthnLogin(assertion, "login-1", "")
+	assert.Equal(t, util.ErrorTokenInvalid, err, "assertions shouldn't be replayed")
+
+	request, err = c.BeginWebAuthnLogin(Credential{Email: "webauthn@example.com"}, "login-3")
+	require.NoError(t, err)
+	assert.Len(t, request.AllowCredentials, 1)
+	_, err = c.FinishWebAuthnLogin(authenticator.get(t, request, origin), "login-3", "")
+	require.NoError(t, err)
+
+	// A cloned authenticator falls behind the sign count.
+	clone := *authenticator
+	clone.signCount = 1
+	request, err = c.BeginWebAuthnLogin(Credential{}, "login-4")
+	require.NoError(t, err)
+	_, err = c.FinishWebAuthnLogin(clone.get(t, request, origin), "login-4", "")
+	assert.Equal(t, ErrorWebAuthnSignCount, err)
+
+	// Second factor
+	user, err = usersController.FindUserResourceByID("WEBAUTHN")
+	require.NoError(t, err)
+	challenge, err := c.BeginSecondFactor(user, "login-5")
+	require.NoError(t, err)
+	require.NotNil(t, challenge)
+	assert.Equal(t, []string{SecondFactorWebAuthn, SecondFactorRecovery}, challenge.Methods)
+
+	request, err = c.BeginWebAuthnLogin(Credential{Token: challenge.Token}, "login-5")
+	require.NoError(t, err)
+	assert.Len(t, request.AllowCredentials, 1)
+	assertion = authenticator.get(t, request, origin)
+	verified, err := c.VerifySecondFactor(Credential{Token: challenge.Token, Assertion: &assertion}, "login-5")
+	require.NoError(t, err)
+	assert.Equal(t, "WEBAUTHN", verified.ID)
+
+	credentials, err := c.ListWebAuthnCredentials("WEBAUTHN")
+	require.NoError(t, err)
+	require.Len(t, credentials, 1)
+	assert.Equal(t, authenticator.signCount, credentials[0].SignCount)
+	assert.NotNil(t, credentials[0].LastUsedAt)
+
+	require.NoError(t, c.RemoveWebAuthnCredential("WEBAUTHN", credential.ID))
+	assert.Equal(t, ErrorWebAuthnCredentialNotFound, c.RemoveWebAuthnCredential("WEBAUTHN", credential.ID))
+	challenge, err = c.BeginSecondFactor(user, "login-6")
+	require.NoError(t, err)
+	assert.Nil(t, challenge)
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/transfer"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+// backupCmd represents the backup command
+var backupCmd = &cobra.Command{
+	Use:   "backup <file>",
+	Short: "Back up Arusha's state to an encrypted archive",
+	Long: `Writes the users, credentials, pending tokens, scopes and roles (from Keto) to a
+versioned archive, encrypted with the passphrase in ARUSHA_BACKUP_PASSPHRASE.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		initializeBackupClients()
+		controller := transfer.NewController()
+		backup, err := controller.CreateBackup()
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		file, err := os.Create(args[0])
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		defer file.Close()
+		if err := controller.WriteBackup(file, backup, config.Default.BackupPassphrase); err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		fmt.Printf("Backed up %d users and %d roles.\n", len(backup.Users), len(backup.Roles))
+	},
+}
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore <file>",
+	Short: "Restore Arusha's state from an encrypted archive",
+	Long: `Restores a backup (created with 'arusha backup') in a fresh environment, including
+the scopes and roles in Keto. The host service should be restarted afterwards.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		file, err := os.Open(args[0])
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		defer file.Close()
+
+		initializeBackupClients()
+		controller := transfer.NewController()
+		backup, err := controller.ReadBackup(file, config.Default.BackupPassphrase)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		if err := controller.RestoreBackup(*backup); err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		fmt.Printf("Restored %d users and %d roles (from backup created at %s).\n", len(backup.Users),
+			len(backup.Roles), backup.CreatedAt.Format("2006-01-02 15:04:05"))
+	},
+}
+
+func initializeBackupClients() {
+	if err := util.InitializeStore(); err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	if err := util.InitializeEncryption(); err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	if err := util.VerifyHydraEndpoint(); err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	if err := util.InitializeKetoClient(); err != nil {
+		log.Fatalln(err.Error())
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(backupCmd)
+	RootCmd.AddCommand(restoreCmd)
+}
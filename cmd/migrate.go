@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Manage the schema migrations of the SQL database",
+	Long: `Applies, rolls back and reports versioned schema migrations for the SQL database
+configured in DATABASE_URL. The host service refuses to start until all migrations
+required by its build have been applied.`,
+}
+
+// migrateUpCmd represents the migrate up command
+var migrateUpCmd = &cobra.Command{
+	Use:   "up [version]",
+	Short: "Apply pending migrations (up to the given version, if any)",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		target := 0
+		if len(args) > 0 {
+			target = parseMigrationArg(args[0])
+		}
+
+		connectMigrationDatabase()
+		applied, err := util.MigrateUp(target)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		if len(applied) == 0 {
+			fmt.Println("Schema is up to date.")
+		}
+
+		for _, migration := range applied {
+			fmt.Printf("Applied %d: %s\n", migration.Version, migration.Description)
+		}
+	},
+}
+
+// migrateDownCmd represents the migrate down command
+var migrateDownCmd = &cobra.Command{
+	Use:   "down [steps]",
+	Short: "Roll back the latest migration (or the given number of migrations)",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		steps := 1
+		if len(args) > 0 {
+			steps = parseMigrationArg(args[0])
+		}
+
+		connectMigrationDatabase()
+		reverted, err := util.MigrateDown(steps)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		if len(reverted) == 0 {
+			fmt.Println("No migrations to roll back.")
+		}
+
+		for _, migration := range reverted {
+			fmt.Printf("Rolled back %d: %s\n", migration.Version, migration.Description)
+		}
+	},
+}
+
+// migrateStatusCmd represents the migrate status command
+var migrateStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Display the applied and pending migrations",
+	Run: func(cmd *cobra.Command, args []string) {
+		connectMigrationDatabase()
+		statuses, err := util.ListMigrations()
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		version, err := util.SchemaVersion()
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		fmt.Printf("Schema version: %d (required: %d)\n", version, util.LatestSchemaVersion())
+		for _, status := range statuses {
+			state := "pending"
+			if status.AppliedAt != nil {
+				state = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+
+			fmt.Printf("%4d  %-28s  %s\n", status.Version, state, status.Description)
+		}
+	},
+}
+
+func connectMigrationDatabase() {
+	if !util.IsDatabaseURL(config.Default.DatabaseURL) {
+		log.Fatalln("migrate: DATABASE_URL doesn't point to a SQL database. nothing to migrate")
+	}
+
+	if err := util.InitializeDatabase(config.Default.DatabaseURL); err != nil {
+		log.Fatalln(err.Error())
+	}
+}
+
+func parseMigrationArg(arg string) int {
+	value, err := strconv.Atoi(arg)
+	if err != nil || value <= 0 {
+		log.Fatalln("migrate: expected a positive number, found " + arg)
+	}
+
+	return value
+}
+
+func init() {
+	migrateCmd.AddCommand(migrateUpCmd)
+	migrateCmd.AddCommand(migrateDownCmd)
+	migrateCmd.AddCommand(migrateStatusCmd)
+	RootCmd.AddCommand(migrateCmd)
+}
@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+	"gitlab.com/omnijar/arusha/transfer"
+	"gitlab.com/omnijar/arusha/users"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+// usersCmd represents the users command
+var usersCmd = &cobra.Command{
+	Use:   "users",
+	Short: "Import and export the users of Arusha",
+}
+
+// usersImportCmd represents the users import command
+var usersImportCmd = &cobra.Command{
+	Use:   "import [file]",
+	Short: "Import users from a JSONL file (or stdin)",
+	Long: `Imports users from a JSONL file, where each line has the fields of a user along
+with an optional "secretHash" - a SHA-256 (hex), bcrypt or PBKDF2 (passlib format) hash
+of their secret. Each line is imported separately, and the errors are reported per line.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		input := io.Reader(os.Stdin)
+		if len(args) > 0 && args[0] != "-" {
+			file, err := os.Open(args[0])
+			if err != nil {
+				log.Fatalln(err.Error())
+			}
+
+			defer file.Close()
+			input = file
+		}
+
+		initializeUserStore()
+		result, err := transfer.NewController().ImportUsers(input)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		for _, lineError := range result.Errors {
+			fmt.Fprintf(os.Stderr, "line %d: %s\n", lineError.Line, lineError.Error)
+		}
+
+		fmt.Printf("Imported %d users (%d errors).\n", result.Imported, len(result.Errors))
+		if len(result.Errors) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+// usersExportCmd represents the users export command
+var usersExportCmd = &cobra.Command{
+	Use:   "export [file]",
+	Short: "Export users to a JSONL file (or stdout)",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		output := io.Writer(os.Stdout)
+		if len(args) > 0 && args[0] != "-" {
+			file, err := os.Create(args[0])
+			if err != nil {
+				log.Fatalln(err.Error())
+			}
+
+			defer file.Close()
+			output = file
+		}
+
+		initializeUserStore()
+		exported, err := transfer.NewController().ExportUsers(output)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		log.Printf("users: exported %d users", exported)
+	},
+}
+
+// usersReencryptCmd represents the users reencrypt command
+var usersReencryptCmd = &cobra.Command{
+	Use:   "reencrypt",
+	Short: "Encrypt the personal data of users with the current encryption key",
+	Long: `Encrypts the personal data of all users with the current version of the key in
+ARUSHA_ENCRYPTION_KEY. This encrypts the users stored before encryption was enabled,
+and it should be run after rotating the key (older versions of the key are needed until
+it has finished).`,
+	Run: func(cmd *cobra.Command, args []string) {
+		initializeUserStore()
+		reencrypted, err := users.NewController().ReencryptResources()
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		log.Printf("users: encrypted %d users", reencrypted)
+	},
+}
+
+func initializeUserStore() {
+	if err := util.InitializeStore(); err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	if err := util.InitializeEncryption(); err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	if err := users.LoadMetadataSchema(); err != nil {
+		log.Fatalln(err.Error())
+	}
+}
+
+func init() {
+	usersCmd.AddCommand(usersImportCmd)
+	usersCmd.AddCommand(usersExportCmd)
+	usersCmd.AddCommand(usersReencryptCmd)
+	RootCmd.AddCommand(usersCmd)
+}
@@ -2,8 +2,12 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"net"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -16,6 +20,148 @@ const (
 	EnvArushaClusterURL = "ARUSHA_CLUSTER_URL"
 	// EnvArushaClientCallbackURL is the callback URL for the client after verifying auth.
 	EnvArushaClientCallbackURL = "ARUSHA_CLIENT_CALLBACK_URL"
+	// EnvDatabaseURL env variable for choosing the storage backend ("vault", "memory" or
+	// a `postgres://` or `sqlite://` URL).
+	EnvDatabaseURL = "DATABASE_URL"
+	// EnvUserRetentionPeriod env variable for the duration (e.g., "720h") for which deleted
+	// users can be restored, before they're purged.
+	EnvUserRetentionPeriod = "ARUSHA_USER_RETENTION_PERIOD"
+	// EnvUserMetadataSchema env variable for the path of the JSON Schema used for validating
+	// the metadata of users (optional).
+	EnvUserMetadataSchema = "ARUSHA_USER_METADATA_SCHEMA"
+	// EnvBackupPassphrase env variable for the passphrase used for encrypting backups.
+	EnvBackupPassphrase = "ARUSHA_BACKUP_PASSPHRASE"
+	// EnvEncryptionKey env variable for the key used for encrypting personal data of users
+	// ("file:<path>" or "vault-transit:<key name>"). Data isn't encrypted if it's unset.
+	EnvEncryptionKey = "ARUSHA_ENCRYPTION_KEY"
+	// EnvSecretHash env variable for the algorithm used for hashing secrets ("argon2id" or "bcrypt").
+	EnvSecretHash = "ARUSHA_SECRET_HASH"
+	// EnvArgon2Params env variable for the Argon2id parameters, in the same format as the hashes
+	// (memory in KiB, iterations and parallelism - e.g., "m=65536,t=3,p=2").
+	EnvArgon2Params = "ARUSHA_ARGON2_PARAMS"
+	// EnvBcryptCost env variable for the cost of bcrypt hashes.
+	EnvBcryptCost = "ARUSHA_BCRYPT_COST"
+	// EnvSecretMinLength env variable for the minimum length of new secrets.
+	EnvSecretMinLength = "ARUSHA_SECRET_MIN_LENGTH"
+	// EnvSecretMaxLength env variable for the maximum length of new secrets.
+	EnvSecretMaxLength = "ARUSHA_SECRET_MAX_LENGTH"
+	// EnvSecretCharacterClasses env variable for the number of character classes (lowercase,
+	// uppercase, digits and symbols) required in new secrets.
+	EnvSecretCharacterClasses = "ARUSHA_SECRET_CHARACTER_CLASSES"
+	// EnvSecretMinEntropy env variable for the minimum estimated entropy (in bits) of new secrets.
+	EnvSecretMinEntropy = "ARUSHA_SECRET_MIN_ENTROPY"
+	// EnvBreachedSecretsFile env variable for the path of the sorted file of SHA-1 hashes (or
+	// hash prefixes) of breached secrets (optional).
+	EnvBreachedSecretsFile = "ARUSHA_BREACHED_SECRETS_FILE"
+	// EnvSecretHistorySize env variable for the number of recent secrets (including the current
+	// one) which cannot be reused.
+	EnvSecretHistorySize = "ARUSHA_SECRET_HISTORY_SIZE"
+	// EnvSecretHistoryPeriod env variable for the duration (e.g., "8760h") for which replaced
+	// secrets are remembered ("0" remembers them until they're pushed out by newer ones).
+	EnvSecretHistoryPeriod = "ARUSHA_SECRET_HISTORY_PERIOD"
+	// EnvLockoutThreshold env variable for the number of failed logins of a user, after which
+	// the user is locked out ("0" disables lockouts).
+	EnvLockoutThreshold = "ARUSHA_LOCKOUT_THRESHOLD"
+	// EnvLockoutAddressThreshold env variable for the number of failed logins from an address,
+	// after which the address is locked out ("0" disables lockouts).
+	EnvLockoutAddressThreshold = "ARUSHA_LOCKOUT_ADDRESS_THRESHOLD"
+	// EnvLockoutDuration env variable for the duration (e.g., "15m") of lockouts. Failed logins
+	// are also forgotten after this duration.
+	EnvLockoutDuration = "ARUSHA_LOCKOUT_DURATION"
+	// EnvLoginBackoff env variable for the delay (e.g., "1s") required after the first failed
+	// login, which doubles with every failure ("0" disables the backoff).
+	EnvLoginBackoff = "ARUSHA_LOGIN_BACKOFF"
+	// EnvEmailTokenTTL env variable for the duration (e.g., "72h") for which email verification
+	// tokens are valid.
+	EnvEmailTokenTTL = "ARUSHA_EMAIL_TOKEN_TTL"
+	// EnvResetTokenTTL env variable for the duration (e.g., "1h") for which secret reset tokens
+	// are valid.
+	EnvResetTokenTTL = "ARUSHA_RESET_TOKEN_TTL"
+	// EnvEmailCodeLength env variable for the number of digits (6 to 8) in the codes sent along
+	// with verification and login links.
+	EnvEmailCodeLength = "ARUSHA_EMAIL_CODE_LENGTH"
+	// EnvEmailCodeTTL env variable for the duration (e.g., "10m") for which emailed codes are valid.
+	EnvEmailCodeTTL = "ARUSHA_EMAIL_CODE_TTL"
+	// EnvEmailCodeAttempts env variable for the number of attempts allowed for each emailed code.
+	EnvEmailCodeAttempts = "ARUSHA_EMAIL_CODE_ATTEMPTS"
+	// EnvLoginLinkURL env variable for the URL of the page completing logins with emailed links
+	// (the token is added as query parameter). Login links are disabled if it's unset.
+	EnvLoginLinkURL = "ARUSHA_LOGIN_LINK_URL"
+	// EnvLoginLinkTTL env variable for the duration (e.g., "15m") for which login links are valid.
+	EnvLoginLinkTTL = "ARUSHA_LOGIN_LINK_TTL"
+	// EnvSessionLifetime env variable for the duration (e.g., "8h") for which logins are remembered.
+	EnvSessionLifetime = "ARUSHA_SESSION_LIFETIME"
+	// EnvSessionIdleTimeout env variable for the duration (e.g., "30m") after which remembered logins
+	// are no longer used, if none of the user's sessions have been used ("0" disables the timeout).
+	EnvSessionIdleTimeout = "ARUSHA_SESSION_IDLE_TIMEOUT"
+	// EnvAPIKeyMaxTTL env variable for the longest duration (e.g., "2160h") for which API keys can
+	// be valid. Keys without an expiry are valid for this long.
+	EnvAPIKeyMaxTTL = "ARUSHA_API_KEY_MAX_TTL"
+	// EnvTOTPIssuer env variable for the issuer shown by authenticator apps for TOTP secrets.
+	EnvTOTPIssuer = "ARUSHA_TOTP_ISSUER"
+	// EnvWebAuthnRPID env variable for the WebAuthn relying party ID - the domain (e.g.,
+	// "example.com") of the pages using WebAuthn. WebAuthn is disabled if it's unset.
+	EnvWebAuthnRPID = "ARUSHA_WEBAUTHN_RP_ID"
+	// EnvWebAuthnRPName env variable for the relying party name shown by authenticators.
+	EnvWebAuthnRPName = "ARUSHA_WEBAUTHN_RP_NAME"
+	// EnvWebAuthnOrigins env variable for the comma-separated origins (e.g.,
+	// "https://login.example.com") allowed in WebAuthn ceremonies. Defaults to the RP ID over HTTPS.
+	EnvWebAuthnOrigins = "ARUSHA_WEBAUTHN_ORIGINS"
+	// EnvTrustedProxies env variable for the comma-separated addresses or CIDRs (e.g.,
+	// "10.0.0.0/8") of the proxies whose X-Real-IP header is trusted. The header is ignored if it's unset.
+	EnvTrustedProxies = "ARUSHA_TRUSTED_PROXIES"
+
+	// SecretHashArgon2id hashes secrets with Argon2id (default).
+	SecretHashArgon2id = "argon2id"
+	// SecretHashBcrypt hashes secrets with bcrypt.
+	SecretHashBcrypt = "bcrypt"
+
+	// DefaultUserRetentionPeriod for deleted users (30 days).
+	DefaultUserRetentionPeriod = 30 * 24 * time.Hour
+	// DefaultArgon2Memory for Argon2id hashes (in KiB).
+	DefaultArgon2Memory = 64 * 1024
+	// DefaultArgon2Iterations for Argon2id hashes.
+	DefaultArgon2Iterations = 3
+	// DefaultArgon2Parallelism for Argon2id hashes.
+	DefaultArgon2Parallelism = 2
+	// DefaultBcryptCost for bcrypt hashes.
+	DefaultBcryptCost = 12
+	// DefaultSecretMinLength for new secrets.
+	DefaultSecretMinLength = 8
+	// DefaultSecretMaxLength for new secrets.
+	DefaultSecretMaxLength = 128
+	// DefaultSecretHistorySize for preventing the reuse of secrets.
+	DefaultSecretHistorySize = 5
+	// DefaultSecretHistoryPeriod for replaced secrets (1 year).
+	DefaultSecretHistoryPeriod = 365 * 24 * time.Hour
+	// DefaultLockoutThreshold for failed logins of a user.
+	DefaultLockoutThreshold = 10
+	// DefaultLockoutAddressThreshold for failed logins from an address.
+	DefaultLockoutAddressThreshold = 100
+	// DefaultLockoutDuration of lockouts.
+	DefaultLockoutDuration = 15 * time.Minute
+	// DefaultLoginBackoff after the first failed login.
+	DefaultLoginBackoff = time.Second
+	// DefaultEmailTokenTTL for email verification tokens.
+	DefaultEmailTokenTTL = 72 * time.Hour
+	// DefaultResetTokenTTL for secret reset tokens.
+	DefaultResetTokenTTL = time.Hour
+	// DefaultEmailCodeLength for emailed codes.
+	DefaultEmailCodeLength = 6
+	// DefaultEmailCodeTTL for emailed codes.
+	DefaultEmailCodeTTL = 10 * time.Minute
+	// DefaultEmailCodeAttempts for each emailed code.
+	DefaultEmailCodeAttempts = 5
+	// DefaultLoginLinkTTL for login links.
+	DefaultLoginLinkTTL = 15 * time.Minute
+	// DefaultSessionLifetime for remembered logins.
+	DefaultSessionLifetime = 8 * time.Hour
+	// DefaultAPIKeyMaxTTL for API keys.
+	DefaultAPIKeyMaxTTL = 90 * 24 * time.Hour
+	// DefaultTOTPIssuer for TOTP secrets.
+	DefaultTOTPIssuer = "Arusha"
+	// DefaultWebAuthnRPName for WebAuthn credentials.
+	DefaultWebAuthnRPName = "Arusha"
 )
 
 var (
@@ -32,6 +178,42 @@ type Config struct {
 	TokenVerificationURL    string
 	ArushaClusterURL        string
 	ArushaClientCallbackURL string
+	DatabaseURL             string
+	UserRetentionPeriod     time.Duration
+	UserMetadataSchema      string
+	BackupPassphrase        string
+	EncryptionKey           string
+	SecretHash              string
+	Argon2Memory            uint32
+	Argon2Iterations        uint32
+	Argon2Parallelism       uint8
+	BcryptCost              int
+	SecretMinLength         int
+	SecretMaxLength         int
+	SecretCharacterClasses  int
+	SecretMinEntropy        int
+	BreachedSecretsFile     string
+	SecretHistorySize       int
+	SecretHistoryPeriod     time.Duration
+	LockoutThreshold        int
+	LockoutAddressThreshold int
+	LockoutDuration         time.Duration
+	LoginBackoff            time.Duration
+	EmailTokenTTL           time.Duration
+	ResetTokenTTL           time.Duration
+	EmailCodeLength         int
+	EmailCodeTTL            time.Duration
+	EmailCodeAttempts       int
+	LoginLinkURL            string
+	LoginLinkTTL            time.Duration
+	SessionLifetime         time.Duration
+	SessionIdleTimeout      time.Duration
+	APIKeyMaxTTL            time.Duration
+	TOTPIssuer              string
+	WebAuthnRPID            string
+	WebAuthnRPName          string
+	WebAuthnOrigins         []string
+	TrustedProxies          []*net.IPNet
 }
 
 // Initialize the configuration of the service.
@@ -68,5 +250,174 @@ func Initialize() error {
 
 	Default.ArushaClientCallbackURL = v
 
+	Default.DatabaseURL = os.Getenv(EnvDatabaseURL)
+	if Default.DatabaseURL == "" {
+		Default.DatabaseURL = "vault"
+	}
+
+	Default.UserRetentionPeriod = DefaultUserRetentionPeriod
+	if v = os.Getenv(EnvUserRetentionPeriod); v != "" {
+		period, err := time.ParseDuration(v)
+		if err != nil || period < 0 {
+			return errors.New(EnvUserRetentionPeriod + " variable is invalid")
+		}
+
+		Default.UserRetentionPeriod = period
+	}
+
+	Default.UserMetadataSchema = os.Getenv(EnvUserMetadataSchema)
+	Default.BackupPassphrase = os.Getenv(EnvBackupPassphrase)
+	Default.EncryptionKey = os.Getenv(EnvEncryptionKey)
+
+	Default.SecretHash = os.Getenv(EnvSecretHash)
+	if Default.SecretHash == "" {
+		Default.SecretHash = SecretHashArgon2id
+	} else if Default.SecretHash != SecretHashArgon2id && Default.SecretHash != SecretHashBcrypt {
+		return errors.New(EnvSecretHash + " variable should be either '" + SecretHashArgon2id + "' or '" + SecretHashBcrypt + "'")
+	}
+
+	Default.Argon2Memory, Default.Argon2Iterations = DefaultArgon2Memory, DefaultArgon2Iterations
+	Default.Argon2Parallelism = DefaultArgon2Parallelism
+	if v = os.Getenv(EnvArgon2Params); v != "" {
+		var memory, iterations, parallelism uint
+		_, err := fmt.Sscanf(v, "m=%d,t=%d,p=%d", &memory, &iterations, &parallelism)
+		if err != nil || memory < 8*parallelism || iterations == 0 || parallelism == 0 || parallelism > 255 {
+			return errors.New(EnvArgon2Params + " variable is invalid (expected 'm=<memory>,t=<iterations>,p=<parallelism>')")
+		}
+
+		Default.Argon2Memory, Default.Argon2Iterations = uint32(memory), uint32(iterations)
+		Default.Argon2Parallelism = uint8(parallelism)
+	}
+
+	Default.BcryptCost = DefaultBcryptCost
+	if v = os.Getenv(EnvBcryptCost); v != "" {
+		cost, err := strconv.Atoi(v)
+		if err != nil || cost < 4 || cost > 31 {
+			return errors.New(EnvBcryptCost + " variable is invalid (expected a number from 4 to 31)")
+		}
+
+		Default.BcryptCost = cost
+	}
+
+	for _, setting := range []struct {
+		name  string
+		field *int
+		value int
+		min   int
+	}{
+		{EnvSecretMinLength, &Default.SecretMinLength, DefaultSecretMinLength, 1},
+		{EnvSecretMaxLength, &Default.SecretMaxLength, DefaultSecretMaxLength, 1},
+		{EnvSecretCharacterClasses, &Default.SecretCharacterClasses, 0, 0},
+		{EnvSecretMinEntropy, &Default.SecretMinEntropy, 0, 0},
+		{EnvSecretHistorySize, &Default.SecretHistorySize, DefaultSecretHistorySize, 0},
+		{EnvLockoutThreshold, &Default.LockoutThreshold, DefaultLockoutThreshold, 0},
+		{EnvLockoutAddressThreshold, &Default.LockoutAddressThreshold, DefaultLockoutAddressThreshold, 0},
+		{EnvEmailCodeLength, &Default.EmailCodeLength, DefaultEmailCodeLength, 6},
+		{EnvEmailCodeAttempts, &Default.EmailCodeAttempts, DefaultEmailCodeAttempts, 1},
+	} {
+		*setting.field = setting.value
+		if v = os.Getenv(setting.name); v != "" {
+			value, err := strconv.Atoi(v)
+			if err != nil || value < setting.min {
+				return fmt.Errorf("%s variable is invalid (expected a number not less than %d)", setting.name, setting.min)
+			}
+
+			*setting.field = value
+		}
+	}
+
+	if Default.SecretMinLength > Default.SecretMaxLength {
+		return errors.New(EnvSecretMinLength + " variable is greater than " + EnvSecretMaxLength)
+	}
+
+	if Default.EmailCodeLength > 8 {
+		return errors.New(EnvEmailCodeLength + " variable is invalid (expected a number from 6 to 8)")
+	}
+
+	Default.BreachedSecretsFile = os.Getenv(EnvBreachedSecretsFile)
+
+	Default.LoginLinkURL = os.Getenv(EnvLoginLinkURL)
+	if _, err := url.Parse(Default.LoginLinkURL); err != nil {
+		return errors.New(EnvLoginLinkURL + " variable is invalid")
+	}
+
+	Default.TOTPIssuer = os.Getenv(EnvTOTPIssuer)
+	if Default.TOTPIssuer == "" {
+		Default.TOTPIssuer = DefaultTOTPIssuer
+	}
+
+	Default.WebAuthnRPID = os.Getenv(EnvWebAuthnRPID)
+	Default.WebAuthnRPName = os.Getenv(EnvWebAuthnRPName)
+	if Default.WebAuthnRPName == "" {
+		Default.WebAuthnRPName = DefaultWebAuthnRPName
+	}
+
+	Default.WebAuthnOrigins = nil
+	for _, origin := range strings.Split(os.Getenv(EnvWebAuthnOrigins), ",") {
+		if origin = strings.TrimRight(strings.TrimSpace(origin), "/"); origin == "" {
+			continue
+		}
+
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.New(EnvWebAuthnOrigins + " variable is invalid (expected comma-separated origins)")
+		}
+
+		Default.WebAuthnOrigins = append(Default.WebAuthnOrigins, origin)
+	}
+
+	if len(Default.WebAuthnOrigins) == 0 && Default.WebAuthnRPID != "" {
+		Default.WebAuthnOrigins = []string{"https://" + Default.WebAuthnRPID}
+	}
+
+	Default.TrustedProxies = nil
+	for _, proxy := range strings.Split(os.Getenv(EnvTrustedProxies), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy == "" {
+			continue
+		}
+
+		if ip := net.ParseIP(proxy); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+
+			proxy = fmt.Sprintf("%s/%d", ip, bits)
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return errors.New(EnvTrustedProxies + " variable is invalid (expected comma-separated addresses or CIDRs)")
+		}
+
+		Default.TrustedProxies = append(Default.TrustedProxies, network)
+	}
+
+	for _, setting := range []struct {
+		name  string
+		field *time.Duration
+		value time.Duration
+	}{
+		{EnvSecretHistoryPeriod, &Default.SecretHistoryPeriod, DefaultSecretHistoryPeriod},
+		{EnvLockoutDuration, &Default.LockoutDuration, DefaultLockoutDuration},
+		{EnvLoginBackoff, &Default.LoginBackoff, DefaultLoginBackoff},
+		{EnvEmailTokenTTL, &Default.EmailTokenTTL, DefaultEmailTokenTTL},
+		{EnvResetTokenTTL, &Default.ResetTokenTTL, DefaultResetTokenTTL},
+		{EnvEmailCodeTTL, &Default.EmailCodeTTL, DefaultEmailCodeTTL},
+		{EnvLoginLinkTTL, &Default.LoginLinkTTL, DefaultLoginLinkTTL},
+		{EnvSessionLifetime, &Default.SessionLifetime, DefaultSessionLifetime},
+		{EnvSessionIdleTimeout, &Default.SessionIdleTimeout, 0},
+		{EnvAPIKeyMaxTTL, &Default.APIKeyMaxTTL, DefaultAPIKeyMaxTTL},
+	} {
+		*setting.field = setting.value
+		if v = os.Getenv(setting.name); v != "" {
+			period, err := time.ParseDuration(v)
+			if err != nil || period < 0 {
+				return errors.New(setting.name + " variable is invalid")
+			}
+
+			*setting.field = period
+		}
+	}
+
 	return nil
 }
@@ -5,6 +5,7 @@ import (
 	"gitlab.com/omnijar/arusha/accesscontrol"
 	"gitlab.com/omnijar/arusha/auth"
 	"gitlab.com/omnijar/arusha/consent"
+	"gitlab.com/omnijar/arusha/transfer"
 	"gitlab.com/omnijar/arusha/users"
 )
 
@@ -15,20 +16,23 @@ type RouterHandler interface {
 
 // RouteHandler contains the domain-based route handlers for the HTTP service.
 type RouteHandler struct {
-	Access  *accesscontrol.RouteHandler
-	Auth    *auth.RouteHandler
-	Consent *consent.RouteHandler
-	Users   *users.RouteHandler
+	Access   *accesscontrol.RouteHandler
+	Auth     *auth.RouteHandler
+	Consent  *consent.RouteHandler
+	Transfer *transfer.RouteHandler
+	Users    *users.RouteHandler
 }
 
 func (h *RouteHandler) registerRoutes(router *httprouter.Router) {
 	h.Access = accesscontrol.NewRouteHandler()
 	h.Auth = auth.NewRouteHandler()
 	h.Consent = consent.NewRouteHandler()
+	h.Transfer = transfer.NewRouteHandler()
 	h.Users = users.NewRouteHandler()
 
 	h.Access.SetRoutes(router)
 	h.Auth.SetRoutes(router)
 	h.Consent.SetRoutes(router)
+	h.Transfer.SetRoutes(router)
 	h.Users.SetRoutes(router)
 }
@@ -7,7 +7,9 @@ import (
 	"github.com/julienschmidt/httprouter"
 	"github.com/ory/graceful"
 	"github.com/spf13/cobra"
+	"gitlab.com/omnijar/arusha/accesscontrol"
 	"gitlab.com/omnijar/arusha/middleware"
+	"gitlab.com/omnijar/arusha/users"
 	"gitlab.com/omnijar/arusha/util"
 )
 
@@ -20,6 +22,22 @@ func RunHost() func(cmd *cobra.Command, args []string) {
 			log.Fatalln(err.Error())
 		}
 
+		if err := util.LockVaultHost(); err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		defer util.UnlockVaultHost()
+
+		if err := users.LoadMetadataSchema(); err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		if err := (&accesscontrol.Controller{}).LoadScopes(); err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		go users.NewController().RunPurges()
+
 		handler := &RouteHandler{}
 		handler.registerRoutes(router)
 
@@ -0,0 +1,294 @@
+package transfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"gitlab.com/omnijar/arusha/accesscontrol"
+	"gitlab.com/omnijar/arusha/auth"
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/users"
+	"gitlab.com/omnijar/arusha/util"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// BackupFormatVersion of the archives written by this build. Archives with older versions
+	// can still be restored.
+	BackupFormatVersion = 1
+
+	backupMagic    = "ARUSHA-BACKUP"
+	backupSaltSize = 16
+	backupKeySize  = 32
+)
+
+var (
+	// ErrorBackupPassphrase occurs when the passphrase for backups isn't configured.
+	ErrorBackupPassphrase = errors.New("backup: " + config.EnvBackupPassphrase + " variable not configured")
+	// ErrorInvalidBackup occurs when the archive is corrupted or the passphrase is wrong.
+	ErrorInvalidBackup = errors.New("backup: invalid archive or wrong passphrase")
+	// ErrorEnvironmentNotEmpty occurs when restoring a backup in an environment which has users.
+	ErrorEnvironmentNotEmpty = errors.New("backup: environment already has users. backups can only be restored in fresh environments")
+
+	// backupStorePaths are the store paths copied as is. Users (along with their email index)
+	// and roles are backed up separately.
+	backupStorePaths = []string{
+		auth.CredentialsPath,
+		auth.CredentialHistoryPath,
+		auth.TOTPPath,
+		auth.WebAuthnPath,
+		auth.RecoveryCodesPath,
+		accesscontrol.APIKeysPath,
+		util.TokensPath,
+		util.CodesPath,
+	}
+
+	accessController = &accesscontrol.Controller{}
+)
+
+// Backup of Arusha's state.
+type Backup struct {
+	CreatedAt    time.Time                             `json:"createdAt"`
+	BuildVersion string                                `json:"buildVersion"`
+	Users        []users.UserResource                  `json:"users"`
+	Store        map[string]map[string]json.RawMessage `json:"store"`
+	Scopes       *accesscontrol.ScopeState             `json:"scopes,omitempty"`
+	Roles        []accesscontrol.Role                  `json:"roles"`
+}
+
+// CreateBackup of the users (including the deleted ones), credentials, pending tokens,
+// scopes and roles. Roles are fetched from Keto only if the scopes have been initialized.
+func (c *Controller) CreateBackup() (*Backup, error) {
+	backup := &Backup{
+		CreatedAt:    time.Now().UTC(),
+		BuildVersion: config.Default.BuildVersion,
+		Users:        *new([]users.UserResource),
+		Store:        make(map[string]map[string]json.RawMessage),
+		Roles:        *new([]accesscontrol.Role),
+	}
+
+	for _, deleted := range []bool{false, true} {
+		query := users.ListQuery{Limit: users.MaxListLimit, Deleted: deleted}
+		for {
+			page, err := usersController.ListResources(query)
+			if err != nil {
+				return nil, err
+			}
+
+			backup.Users = append(backup.Users, page.Users...)
+			if page.NextCursor == "" {
+				break
+			}
+
+			query.Cursor = page.NextCursor
+		}
+	}
+
+	for _, path := range backupStorePaths {
+		store := util.GetStore(path)
+		keys, err := store.List()
+		if err != nil {
+			return nil, err
+		}
+
+		values := make(map[string]json.RawMessage)
+		for _, key := range keys {
+			var value json.RawMessage
+			if err := store.Get(key, &value); err == util.ErrorKeyNotFound {
+				continue // removed while backing up
+			} else if err != nil {
+				return nil, err
+			}
+
+			values[key] = value
+		}
+
+		backup.Store[path] = values
+	}
+
+	scopes, err := accessController.GetScopeState()
+	if err != nil {
+		return nil, err
+	}
+
+	if scopes != nil {
+		backup.Scopes = scopes
+		if backup.Roles, err = accessController.ListRoles(); err != nil {
+			return nil, err
+		}
+	}
+
+	return backup, nil
+}
+
+// RestoreBackup in a fresh environment (one without users). Scopes are restored before
+// roles, since the roles in Keto require Arusha's client in Hydra. This isn't atomic - if it
+// fails, then the users (and store values) restored until then are kept, so the store has to be
+// reset before retrying. Scopes and roles are replaced on retrying, so Keto needn't be reset.
+func (c *Controller) RestoreBackup(backup Backup) error {
+	for _, deleted := range []bool{false, true} {
+		page, err := usersController.ListResources(users.ListQuery{Limit: 1, Deleted: deleted})
+		if err != nil {
+			return err
+		}
+
+		if page.Total > 0 {
+			return ErrorEnvironmentNotEmpty
+		}
+	}
+
+	for _, user := range backup.Users {
+		if err := usersController.LoadResource(user); err != nil {
+			return fmt.Errorf("backup: error restoring user %s: %s", user.ID, err)
+		}
+	}
+
+	for path, values := range backup.Store {
+		store := util.GetStore(path)
+		for key, value := range values {
+			if err := store.Set(key, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	if backup.Scopes == nil {
+		return nil
+	}
+
+	if err := accessController.RestoreScopes(*backup.Scopes); err != nil {
+		return err
+	}
+
+	for _, role := range backup.Roles {
+		if err := accessController.RestoreRole(role); err != nil {
+			return fmt.Errorf("backup: error restoring role %s: %s", role.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// WriteBackup to the given writer as an encrypted archive. The archive has a header (with
+// the format version), followed by the salt for deriving the key from the passphrase and
+// the backup compressed with gzip and encrypted with AES-GCM.
+func (c *Controller) WriteBackup(w io.Writer, backup *Backup, passphrase string) error {
+	if passphrase == "" {
+		return ErrorBackupPassphrase
+	}
+
+	var plaintext bytes.Buffer
+	compressor := gzip.NewWriter(&plaintext)
+	if err := json.NewEncoder(compressor).Encode(backup); err != nil {
+		return err
+	}
+
+	if err := compressor.Close(); err != nil {
+		return err
+	}
+
+	header := backupHeader(BackupFormatVersion)
+	salt := make([]byte, backupSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	aead, err := backupCipher(passphrase, salt)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	// The header is authenticated along with the contents.
+	ciphertext := aead.Seal(nil, nonce, plaintext.Bytes(), header)
+	for _, part := range [][]byte{header, salt, nonce, ciphertext} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadBackup from an encrypted archive.
+func (c *Controller) ReadBackup(r io.Reader, passphrase string) (*Backup, error) {
+	if passphrase == "" {
+		return nil, ErrorBackupPassphrase
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	headerSize := len(backupHeader(0))
+	if len(data) < headerSize+backupSaltSize || string(data[:len(backupMagic)]) != backupMagic {
+		return nil, ErrorInvalidBackup
+	}
+
+	header := data[:headerSize]
+	if version := int(header[len(backupMagic)]); version > BackupFormatVersion {
+		return nil, fmt.Errorf("backup: archive version %d isn't supported by this build (latest: %d)", version, BackupFormatVersion)
+	}
+
+	salt := data[headerSize : headerSize+backupSaltSize]
+	aead, err := backupCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	data = data[headerSize+backupSaltSize:]
+	if len(data) < aead.NonceSize() {
+		return nil, ErrorInvalidBackup
+	}
+
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], header)
+	if err != nil {
+		return nil, ErrorInvalidBackup
+	}
+
+	decompressor, err := gzip.NewReader(bytes.NewReader(plaintext))
+	if err != nil {
+		return nil, ErrorInvalidBackup
+	}
+
+	var backup Backup
+	if err := json.NewDecoder(decompressor).Decode(&backup); err != nil {
+		return nil, ErrorInvalidBackup
+	}
+
+	return &backup, nil
+}
+
+// backupHeader for the given format version.
+func backupHeader(version int) []byte {
+	return append([]byte(backupMagic), byte(version))
+}
+
+// backupCipher for the key derived from the passphrase (with scrypt).
+func backupCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, backupKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,100 @@
+package transfer
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/omnijar/arusha/auth"
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/users"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	config.Default.DatabaseURL = util.StoreMemory
+	config.Default.UserRetentionPeriod = time.Hour
+	require.NoError(t, util.InitializeStore())
+
+	c := NewController()
+	for i := 0; i < 3; i++ {
+		_, err := usersController.Import(users.UserResource{
+			ID:        fmt.Sprintf("BACKUP-%d", i),
+			Email:     fmt.Sprintf("backup-%d@example.com", i),
+			Verified:  true,
+			Firstname: "Foo",
+		})
+		require.NoError(t, err)
+	}
+
+	_, err := usersController.RemoveUserResource("BACKUP-2", nil)
+	require.NoError(t, err)
+	hash, err := auth.HashSecret("secret-zero")
+	require.NoError(t, err)
+	require.NoError(t, authController.ImportSecretHash("BACKUP-0", hash))
+	token, err := util.MintToken(nil, util.TokenPurposeResetSecret, "BACKUP-1", "backup-1@example.com")
+	require.NoError(t, err)
+	code, err := util.MintCode(nil, util.TokenPurposeLoginLink, "backup-1@example.com", "BACKUP-1", "challenge")
+	require.NoError(t, err)
+
+	backup, err := c.CreateBackup()
+	require.NoError(t, err)
+	assert.True(t, len(backup.Users) >= 3)
+	assert.Nil(t, backup.Scopes)
+
+	var archive bytes.Buffer
+	require.NoError(t, c.WriteBackup(&archive, backup, "passphrase"))
+	data := archive.Bytes()
+
+	_, err = c.ReadBackup(bytes.NewReader(data), "wrong passphrase")
+	assert.Equal(t, ErrorInvalidBackup, err)
+
+	tampered := append([]byte{}, data...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = c.ReadBackup(bytes.NewReader(tampered), "passphrase")
+	assert.Equal(t, ErrorInvalidBackup, err)
+
+	future := append([]byte{}, data...)
+	future[len(backupMagic)] = BackupFormatVersion + 1
+	_, err = c.ReadBackup(bytes.NewReader(future), "passphrase")
+	assert.Error(t, err)
+
+	restored, err := c.ReadBackup(bytes.NewReader(data), "passphrase")
+	require.NoError(t, err)
+	assert.Equal(t, ErrorEnvironmentNotEmpty, c.RestoreBackup(*restored))
+
+	// Restore in a fresh environment backed by a SQL database.
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("arusha-%s.db", uuid.New()))
+	defer os.Remove(path)
+	require.NoError(t, util.InitializeDatabase("sqlite://"+path))
+	defer util.CloseDatabase()
+	_, err = util.MigrateUp(0)
+	require.NoError(t, err)
+
+	config.Default.DatabaseURL = "sqlite://" + path
+	require.NoError(t, util.InitializeStore())
+	require.NoError(t, c.RestoreBackup(*restored))
+
+	user, err := (&auth.Controller{}).Login(auth.Credential{Email: "backup-0@example.com", Secret: "secret-zero"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, "BACKUP-0", user.ID)
+
+	_, err = usersController.FindUserResourceByID("BACKUP-2")
+	assert.Error(t, err)
+	_, err = usersController.RestoreUserResource("BACKUP-2", nil)
+	assert.NoError(t, err)
+
+	minted, err := util.LookupToken(util.TokenPurposeResetSecret, token)
+	require.NoError(t, err)
+	assert.Equal(t, "BACKUP-1", minted.Subject)
+
+	sent, err := util.ConsumeCode(util.TokenPurposeLoginLink, "backup-1@example.com", code)
+	require.NoError(t, err)
+	assert.Equal(t, "BACKUP-1", sent.Subject)
+}
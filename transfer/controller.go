@@ -0,0 +1,144 @@
+package transfer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"strings"
+
+	"gitlab.com/omnijar/arusha/auth"
+	"gitlab.com/omnijar/arusha/users"
+)
+
+const (
+	// MaxRecordSize is the maximum size (in bytes) of a line while importing users.
+	MaxRecordSize = 1024 * 1024
+)
+
+var (
+	usersController = users.NewController()
+	authController  = &auth.Controller{}
+)
+
+// UserRecord is a line in the JSONL streams for importing and exporting users. It has the
+// fields of the user resource, along with the hash of their secret (if any).
+type UserRecord struct {
+	users.UserResource
+	SecretHash string `json:"secretHash,omitempty"`
+}
+
+// ImportError for a line in the imported stream.
+type ImportError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// ImportResult has the number of imported users, and the errors for the lines which
+// couldn't be imported.
+type ImportResult struct {
+	Imported int           `json:"imported"`
+	Errors   []ImportError `json:"errors"`
+}
+
+// Controller for importing and exporting data.
+type Controller struct{}
+
+// NewController for transferring data.
+func NewController() *Controller {
+	return &Controller{}
+}
+
+// ImportUsers from the given JSONL stream. Each line is imported separately, and the lines
+// which fail don't affect the others. This only returns an error if the stream cannot be read.
+func (c *Controller) ImportUsers(r io.Reader) (*ImportResult, error) {
+	result := &ImportResult{Errors: *new([]ImportError)}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MaxRecordSize)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		data := strings.TrimSpace(scanner.Text())
+		if data == "" {
+			continue
+		}
+
+		if err := c.importUser([]byte(data)); err != nil {
+			result.Errors = append(result.Errors, ImportError{Line: line, Error: err.Error()})
+			continue
+		}
+
+		result.Imported++
+	}
+
+	return result, scanner.Err()
+}
+
+// importUser from a single record. If its secret hash cannot be imported, then the user is
+// removed again, so that each record is either imported completely or not at all.
+func (c *Controller) importUser(data []byte) error {
+	var record UserRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return err
+	}
+
+	if record.SecretHash != "" && !auth.IsSupportedSecretHash(record.SecretHash) {
+		return auth.ErrorUnsupportedSecretHash
+	}
+
+	user, err := usersController.Import(record.UserResource)
+	if err != nil {
+		return err
+	}
+
+	if record.SecretHash != "" {
+		if err := authController.ImportSecretHash(user.ID, record.SecretHash); err != nil {
+			if err := usersController.PurgeUserResource(*user); err != nil {
+				log.Printf("transfer: error removing user %s after failing to import its secret hash: %s", user.ID, err)
+				return errors.New("transfer: user has been imported, but not its secret hash")
+			}
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ExportUsers to the given writer as a JSONL stream. Deleted users aren't exported.
+func (c *Controller) ExportUsers(w io.Writer) (int, error) {
+	encoder := json.NewEncoder(w)
+	query := users.ListQuery{Limit: users.MaxListLimit}
+
+	exported := 0
+	for {
+		page, err := usersController.ListResources(query)
+		if err != nil {
+			return exported, err
+		}
+
+		for _, user := range page.Users {
+			record := UserRecord{UserResource: user}
+			hash, err := authController.GetSecretHash(user.ID)
+			if err != nil {
+				return exported, err
+			} else if hash != nil {
+				record.SecretHash = *hash
+			}
+
+			if err := encoder.Encode(record); err != nil {
+				return exported, err
+			}
+
+			exported++
+		}
+
+		if page.NextCursor == "" {
+			return exported, nil
+		}
+
+		query.Cursor = page.NextCursor
+	}
+}
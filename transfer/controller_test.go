@@ -0,0 +1,73 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/omnijar/arusha/auth"
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+func TestImportExportUsers(t *testing.T) {
+	config.Default.DatabaseURL = util.StoreMemory
+	require.NoError(t, util.InitializeStore())
+
+	// Unsalted SHA-256 hash, as produced by older versions.
+	legacyHash := fmt.Sprintf("%x", sha256.Sum256([]byte("secret-one")))
+	input := strings.Join([]string{
+		`{"id": "legacy-1", "email": "Ada@Example.com", "verified": true, "firstName": "Ada", "secretHash": "` + legacyHash + `"}`,
+		``,
+		`{"email": "alan@example.com", "firstName": "Alan", "emails": [` +
+			`{"address": "alan@example.com", "verified": true, "primary": true}, {"address": "alan@example.org"}]}`,
+		`{"email": "not-an-email", "firstName": "Grace"}`,
+		`{"email": "ada@example.com", "firstName": "Duplicate"}`,
+		`{"email": "grace@example.com", "firstName": "Grace", "secretHash": "plaintext"}`,
+		`not json`,
+	}, "\n")
+
+	c := NewController()
+	result, err := c.ImportUsers(strings.NewReader(input))
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Imported)
+
+	var lines []int
+	for _, lineError := range result.Errors {
+		lines = append(lines, lineError.Line)
+	}
+
+	assert.Equal(t, []int{4, 5, 6, 7}, lines)
+
+	user, err := (&auth.Controller{}).Login(auth.Credential{Email: "ada@example.com", Secret: "secret-one"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, "LEGACY-1", user.ID)
+
+	var output bytes.Buffer
+	exported, err := c.ExportUsers(&output)
+	require.NoError(t, err)
+
+	records := map[string]UserRecord{}
+	scanner := bufio.NewScanner(&output)
+	for scanner.Scan() {
+		var record UserRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records[record.Email] = record
+	}
+
+	assert.Len(t, records, exported)
+
+	// The legacy hash is replaced on login.
+	assert.NotEqual(t, legacyHash, records["ada@example.com"].SecretHash)
+	assert.True(t, auth.CheckSecretHash("secret-one", records["ada@example.com"].SecretHash))
+	assert.True(t, records["ada@example.com"].Verified)
+	assert.Empty(t, records["alan@example.com"].SecretHash)
+	assert.Len(t, records["alan@example.com"].Emails, 2)
+	assert.False(t, records["alan@example.com"].Emails[1].Verified)
+}
@@ -0,0 +1,67 @@
+package transfer
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+const (
+	// TransferPath is the base path for importing and exporting data. These routes should only
+	// be allowed for admins.
+	TransferPath = "/transfer"
+	// TransferUsersPath is the GET path for exporting users and POST path for importing them
+	// (as JSONL streams).
+	TransferUsersPath = TransferPath + "/users"
+	// JSONLContentType for the streams of users.
+	JSONLContentType = "application/x-ndjson"
+)
+
+var (
+	controller = NewController()
+)
+
+// RouteHandler manages the routes for importing and exporting data.
+type RouteHandler struct{}
+
+// NewRouteHandler creates a new transfer route handler.
+func NewRouteHandler() *RouteHandler {
+	return &RouteHandler{}
+}
+
+// SetRoutes sets the routes for importing and exporting data.
+func (h *RouteHandler) SetRoutes(r *httprouter.Router) {
+	r.OPTIONS(TransferUsersPath, util.PassEmptyBody)
+	r.GET(TransferUsersPath, h.ExportUsers)
+	r.POST(TransferUsersPath, h.ImportUsers)
+}
+
+// ImportUsers from the JSONL stream in the request body. The response has the number of
+// imported users, along with the errors for each line which couldn't be imported.
+func (h *RouteHandler) ImportUsers(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if r.Body == nil {
+		util.RespondHTTPError(w, util.ErrorHTTPNoBody, http.StatusBadRequest)
+		return
+	}
+
+	result, err := controller.ImportUsers(r.Body)
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(result)
+}
+
+// ExportUsers as a JSONL stream.
+func (h *RouteHandler) ExportUsers(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	w.Header().Set("Content-Type", JSONLContentType)
+
+	// NOTE: The status has been sent by the time we find errors, so they can only be logged.
+	if exported, err := controller.ExportUsers(w); err != nil {
+		log.Printf("transfer: error exporting users (after %d users): %s", exported, err)
+	}
+}
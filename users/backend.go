@@ -0,0 +1,222 @@
+package users
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/omnijar/arusha/util"
+)
+
+const (
+	// DefaultListLimit is the number of resources returned in a page by default.
+	DefaultListLimit = 50
+	// MaxListLimit is the maximum number of resources returned in a page.
+	MaxListLimit = 500
+)
+
+var (
+	// ErrorResourceNotFound occurs when the resource doesn't exist in the backend.
+	ErrorResourceNotFound = errors.New("users: resource doesn't exist")
+	// ErrorEmailExists occurs when another resource already uses an email.
+	ErrorEmailExists = errors.New("users: email already exists")
+	// ErrorInvalidCursor for malformed pagination cursors.
+	ErrorInvalidCursor = errors.New("users: invalid cursor")
+)
+
+// Backend persists user resources along with the index for their emails. Changes to a
+// resource and its email index should be all-or-nothing - if an operation fails, then
+// the backend should be left as it was before the operation.
+type Backend interface {
+	// Create a new resource.
+	Create(user UserResource) error
+	// Update an existing resource. The old resource is required for updating the email index,
+	// and its version should match the stored one (otherwise `util.ErrorPreconditionFailed`
+	// is returned). The version of the new resource is set by the caller.
+	Update(oldResource, newResource UserResource) error
+	// Remove an existing resource permanently (if its version matches the stored one).
+	Remove(user UserResource) error
+	// FindByID returns `ErrorResourceNotFound` if the resource doesn't exist. Soft-deleted
+	// resources are returned as well.
+	FindByID(id string) (*UserResource, error)
+	// FindByEmail returns `ErrorResourceNotFound` if the resource doesn't exist. Soft-deleted
+	// resources are returned as well.
+	FindByEmail(email string) (*UserResource, error)
+	// List a page of resources matching the query, ordered by their creation time (and IDs
+	// for resources created at the same time).
+	List(query ListQuery) (*ListPage, error)
+}
+
+// ListQuery for fetching a page of resources. Apart from the cursor and limit, all fields
+// are optional filters, and a resource should match all of them.
+type ListQuery struct {
+	Cursor string
+	Limit  int
+	// EmailPrefix matches the start of any of the emails.
+	EmailPrefix string
+	// Firstname and Lastname match the names exactly (ignoring case).
+	Firstname string
+	Lastname  string
+	// Verified matches the verification status of the primary email.
+	Verified *bool
+	// CreatedAfter and CreatedBefore match the creation time (inclusive).
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	// Search matches resources whose first or last names contain each word in it (ignoring case).
+	Search string
+	// Deleted lists the soft-deleted resources instead of the active ones.
+	Deleted bool
+	// DeletedBefore matches the resources deleted at or before the given time.
+	DeletedBefore *time.Time
+}
+
+// ListPage has the resources in a page, the total number of resources matching the
+// filters and the cursor for the next page (empty for the last page).
+type ListPage struct {
+	Users      []UserResource `json:"users"`
+	Total      int            `json:"total"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+}
+
+// Validate the query and set the default limit.
+func (q *ListQuery) Validate() error {
+	if q.Limit <= 0 {
+		q.Limit = DefaultListLimit
+	} else if q.Limit > MaxListLimit {
+		q.Limit = MaxListLimit
+	}
+
+	if _, _, err := decodeCursor(q.Cursor); err != nil {
+		return err
+	}
+
+	q.EmailPrefix = strings.ToLower(strings.TrimSpace(q.EmailPrefix))
+	q.Firstname = strings.TrimSpace(q.Firstname)
+	q.Lastname = strings.TrimSpace(q.Lastname)
+	q.Search = strings.TrimSpace(q.Search)
+
+	if q.CreatedAfter != nil && q.CreatedBefore != nil && q.CreatedAfter.After(*q.CreatedBefore) {
+		return errors.New("users: creation time range is empty")
+	}
+
+	return nil
+}
+
+// searchTerms in the query (lowercased).
+func (q *ListQuery) searchTerms() []string {
+	return strings.Fields(strings.ToLower(q.Search))
+}
+
+// Matches checks whether the resource matches the filters in this query.
+func (q *ListQuery) Matches(user UserResource) bool {
+	if q.EmailPrefix != "" {
+		matched := false
+		for _, email := range user.Emails {
+			matched = matched || strings.HasPrefix(email.Address, q.EmailPrefix)
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	if q.Firstname != "" && !strings.EqualFold(user.Firstname, q.Firstname) {
+		return false
+	}
+
+	if q.Lastname != "" && !strings.EqualFold(user.Lastname, q.Lastname) {
+		return false
+	}
+
+	if q.Verified != nil && user.Verified != *q.Verified {
+		return false
+	}
+
+	if q.CreatedAfter != nil && user.CreatedAt.Before(*q.CreatedAfter) {
+		return false
+	}
+
+	if q.CreatedBefore != nil && user.CreatedAt.After(*q.CreatedBefore) {
+		return false
+	}
+
+	if q.Deleted != (user.DeletedAt != nil) {
+		return false
+	}
+
+	if q.DeletedBefore != nil && (user.DeletedAt == nil || user.DeletedAt.After(*q.DeletedBefore)) {
+		return false
+	}
+
+	firstname, lastname := strings.ToLower(user.Firstname), strings.ToLower(user.Lastname)
+	for _, term := range q.searchTerms() {
+		if !strings.Contains(firstname, term) && !strings.Contains(lastname, term) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// encodeCursor for the position right after the given resource.
+func encodeCursor(user UserResource) string {
+	position := fmt.Sprintf("%d:%s", user.CreatedAt.UnixNano(), user.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(position))
+}
+
+// decodeCursor into the creation time (in nanoseconds) and ID of the last resource
+// in the previous page. An empty cursor points to the start - before any creation time, since
+// users stored before creation times were kept have zero times (which are negative in nanoseconds).
+func decodeCursor(cursor string) (int64, string, error) {
+	if cursor == "" {
+		return math.MinInt64, "", nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", ErrorInvalidCursor
+	}
+
+	parts := strings.SplitN(string(data), ":", 2)
+	if len(parts) != 2 {
+		return 0, "", ErrorInvalidCursor
+	}
+
+	createdAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", ErrorInvalidCursor
+	}
+
+	return createdAt, parts[1], nil
+}
+
+// isAfterCursor checks whether the resource comes after the given position.
+func isAfterCursor(user UserResource, createdAt int64, id string) bool {
+	nanos := user.CreatedAt.UnixNano()
+	return nanos > createdAt || (nanos == createdAt && user.ID > id)
+}
+
+// getBackend for user resources. This uses the SQL database if Arusha has been
+// configured with one, otherwise it falls back to the key/value store. Personal data
+// is encrypted if an encryption key has been configured.
+func getBackend() Backend {
+	var backend Backend = &StoreBackend{}
+	if db, driver := util.GetDatabase(); db != nil {
+		backend = &SQLBackend{db: db, driver: driver}
+	}
+
+	if util.IsEncryptionEnabled() {
+		return &EncryptedBackend{backend}
+	}
+
+	return backend
+}
+
+// now returns the current time in the precision stored by the backends.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
@@ -0,0 +1,272 @@
+package users
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+// testBackends returns the backends to be tested, along with the path of the SQLite database
+// (which should be removed after testing).
+func testBackends(t *testing.T) (map[string]Backend, string) {
+	config.Default.DatabaseURL = util.StoreMemory
+	require.NoError(t, util.InitializeStore())
+
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("arusha-%s.db", uuid.New()))
+	require.NoError(t, util.InitializeDatabase("sqlite://"+path))
+	_, err := util.MigrateUp(0)
+	require.NoError(t, err)
+	db, driver := util.GetDatabase()
+
+	return map[string]Backend{
+		"store": &StoreBackend{},
+		"sql":   &SQLBackend{db: db, driver: driver},
+	}, path
+}
+
+func TestBackends(t *testing.T) {
+	backends, path := testBackends(t)
+	defer os.Remove(path)
+	defer util.CloseDatabase()
+
+	for name, backend := range backends {
+		t.Run("backend="+name, func(t *testing.T) {
+			createdAt := now()
+			var created []UserResource
+
+			for i := 0; i < 7; i++ {
+				user := UserResource{
+					ID:        fmt.Sprintf("%s-%d", name, i),
+					Email:     fmt.Sprintf("%s-%d@example.com", name, i),
+					Firstname: "Foo",
+					// Two users share the same creation time to check the ordering by IDs.
+					CreatedAt: createdAt.Add(time.Duration(i/2) * time.Second),
+				}
+
+				require.NoError(t, backend.Create(user))
+				created = append(created, user)
+			}
+
+			assert.Equal(t, ErrorEmailExists, backend.Create(UserResource{ID: "other", Email: created[0].Email}))
+
+			found, err := backend.FindByEmail(created[3].Email)
+			require.NoError(t, err)
+			assert.Equal(t, created[3].ID, found.ID)
+			assert.True(t, created[3].CreatedAt.Equal(found.CreatedAt))
+
+			updated := *found
+			updated.Emails = []UserEmail{{Address: name + "-new@example.com", Primary: true}}
+			require.NoError(t, backend.Update(*found, updated))
+
+			_, err = backend.FindByEmail(created[3].Email)
+			assert.Equal(t, ErrorResourceNotFound, err)
+			found, err = backend.FindByEmail(updated.Emails[0].Address)
+			require.NoError(t, err)
+			assert.Equal(t, created[3].ID, found.ID)
+
+			var listed []string
+			cursor := ""
+			for {
+				page, err := backend.List(ListQuery{Cursor: cursor, Limit: 3})
+				require.NoError(t, err)
+				assert.True(t, len(page.Users) <= 3)
+				assert.Equal(t, len(created), page.Total)
+
+				for _, user := range page.Users {
+					listed = append(listed, user.ID)
+				}
+
+				if page.NextCursor == "" {
+					break
+				}
+
+				cursor = page.NextCursor
+			}
+
+			var expected []string
+			for _, user := range created {
+				expected = append(expected, user.ID)
+			}
+
+			assert.Equal(t, expected, listed)
+
+			// Writes based on stale versions should be rejected.
+			renamed := *found
+			renamed.Firstname = "Bar"
+			renamed.Version++
+			require.NoError(t, backend.Update(*found, renamed))
+			assert.Equal(t, util.ErrorPreconditionFailed, backend.Update(*found, renamed))
+			assert.Equal(t, util.ErrorPreconditionFailed, backend.Remove(*found))
+
+			require.NoError(t, backend.Remove(renamed))
+			_, err = backend.FindByID(found.ID)
+			assert.Equal(t, ErrorResourceNotFound, err)
+		})
+	}
+}
+
+func TestBackendFilters(t *testing.T) {
+	backends, path := testBackends(t)
+	defer os.Remove(path)
+	defer util.CloseDatabase()
+
+	createdAt := now()
+	verified := true
+
+	for name, backend := range backends {
+		prefix := "filter-" + name + "-"
+		for i, user := range []UserResource{
+			{Email: prefix + "ada@example.com", Firstname: "Ada", Lastname: "Lovelace", Verified: true},
+			{Email: prefix + "alan@example.com", Firstname: "Alan", Lastname: "Turing"},
+			{Email: prefix + "grace@example.org", Firstname: "Grace", Lastname: "Hopper", Verified: true},
+			{Email: prefix + "al_x@example.org", Firstname: "Alex", Lastname: "Love"},
+		} {
+			user.ID = fmt.Sprintf("%s%d", prefix, i)
+			user.CreatedAt = createdAt.Add(time.Duration(i) * time.Hour)
+			require.NoError(t, backend.Create(user))
+		}
+
+		after, before := createdAt.Add(time.Hour), createdAt.Add(2*time.Hour)
+
+		for _, c := range []struct {
+			query    ListQuery
+			expected []int
+		}{
+			{query: ListQuery{}, expected: []int{0, 1, 2, 3}},
+			{query: ListQuery{EmailPrefix: "AL"}, expected: []int{1, 3}},
+			{query: ListQuery{EmailPrefix: "al_"}, expected: []int{3}},
+			{query: ListQuery{Firstname: "grace"}, expected: []int{2}},
+			{query: ListQuery{Lastname: "LOVE"}, expected: []int{3}},
+			{query: ListQuery{Verified: &verified}, expected: []int{0, 2}},
+			{query: ListQuery{CreatedAfter: &after, CreatedBefore: &before}, expected: []int{1, 2}},
+			{query: ListQuery{Search: "love"}, expected: []int{0, 3}},
+			{query: ListQuery{Search: "ada love"}, expected: []int{0}},
+			{query: ListQuery{Search: "al", Verified: &verified}, expected: []int{}},
+		} {
+			t.Run(fmt.Sprintf("backend=%s/query=%+v", name, c.query), func(t *testing.T) {
+				query := c.query
+				if query.EmailPrefix == "" {
+					query.EmailPrefix = prefix
+				} else {
+					query.EmailPrefix = prefix + query.EmailPrefix
+				}
+
+				require.NoError(t, query.Validate())
+				page, err := backend.List(query)
+				require.NoError(t, err)
+
+				ids := []string{}
+				for _, user := range page.Users {
+					ids = append(ids, user.ID)
+				}
+
+				expected := []string{}
+				for _, idx := range c.expected {
+					expected = append(expected, fmt.Sprintf("%s%d", prefix, idx))
+				}
+
+				assert.Equal(t, expected, ids)
+				assert.Equal(t, len(expected), page.Total)
+			})
+		}
+	}
+}
+
+func TestBackendEmails(t *testing.T) {
+	backends, path := testBackends(t)
+	defer os.Remove(path)
+	defer util.CloseDatabase()
+
+	for name, backend := range backends {
+		t.Run("backend="+name, func(t *testing.T) {
+			primary, backup := name+"-primary@example.com", name+"-backup@example.com"
+			user := UserResource{
+				ID: name + "-emails",
+				Emails: []UserEmail{
+					{Address: primary, Verified: true, Primary: true},
+					{Address: backup},
+				},
+				Firstname: "Foo",
+				CreatedAt: now(),
+				Version:   1,
+			}
+
+			require.NoError(t, backend.Create(user))
+			assert.Equal(t, ErrorEmailExists, backend.Create(UserResource{ID: "other", Email: backup}))
+			if sqlBackend, ok := backend.(*SQLBackend); ok {
+				// Emails added concurrently (after the checks) are refused by the database.
+				err := sqlBackend.inTransaction(func(tx *sql.Tx) error {
+					return sqlBackend.insertEmails(tx, UserResource{ID: "other", Emails: []UserEmail{{Address: backup}}})
+				})
+				assert.Equal(t, ErrorEmailExists, err)
+			}
+
+			found, err := backend.FindByEmail(backup)
+			require.NoError(t, err)
+			assert.Equal(t, user.ID, found.ID)
+			assert.Equal(t, primary, found.Email)
+			assert.True(t, found.Verified)
+			assert.Equal(t, user.Emails, found.Emails)
+
+			page, err := backend.List(ListQuery{EmailPrefix: name + "-backup", Limit: 10})
+			require.NoError(t, err)
+			require.Len(t, page.Users, 1)
+			assert.Equal(t, user.Emails, page.Users[0].Emails)
+
+			// Make the backup email primary and replace the old one.
+			other := name + "-other@example.com"
+			updated := *found
+			updated.Emails = []UserEmail{{Address: backup, Primary: true}, {Address: other}}
+			updated.Version++
+			require.NoError(t, backend.Update(*found, updated))
+
+			_, err = backend.FindByEmail(primary)
+			assert.Equal(t, ErrorResourceNotFound, err)
+			found, err = backend.FindByEmail(other)
+			require.NoError(t, err)
+			assert.Equal(t, backup, found.Email)
+			assert.False(t, found.Verified)
+
+			require.NoError(t, backend.Remove(*found))
+			for _, email := range updated.Emails {
+				_, err = backend.FindByEmail(email.Address)
+				assert.Equal(t, ErrorResourceNotFound, err)
+			}
+		})
+	}
+}
+
+func TestBackendsWithoutCreationTimes(t *testing.T) {
+	backends, path := testBackends(t)
+	defer os.Remove(path)
+	defer util.CloseDatabase()
+
+	for name, backend := range backends {
+		t.Run("backend="+name, func(t *testing.T) {
+			// Users stored before creation times were kept have zero times.
+			legacy := UserResource{ID: name + "-legacy", Email: name + "-legacy@example.com", Firstname: "Legacy"}
+			require.NoError(t, backend.Create(legacy))
+			require.NoError(t, backend.Create(UserResource{ID: name + "-new", Email: name + "-new@example.com", Firstname: "Legacy", CreatedAt: now()}))
+
+			page, err := backend.List(ListQuery{Firstname: "Legacy", Limit: 1})
+			require.NoError(t, err)
+			require.Len(t, page.Users, 1)
+			assert.Equal(t, legacy.ID, page.Users[0].ID)
+
+			page, err = backend.List(ListQuery{Firstname: "Legacy", Cursor: page.NextCursor, Limit: 1})
+			require.NoError(t, err)
+			require.Len(t, page.Users, 1)
+			assert.Equal(t, name+"-new", page.Users[0].ID)
+			assert.Empty(t, page.NextCursor)
+		})
+	}
+}
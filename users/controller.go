@@ -2,6 +2,9 @@ package users
 
 import (
 	"errors"
+	"log"
+	"strings"
+	"time"
 
 	"gitlab.com/omnijar/arusha/util"
 )
@@ -9,20 +12,25 @@ import (
 const (
 	usersPath  = "/users"
 	emailsPath = "/emails"
-
-	// VaultResetTokenPath has all the active tokens for resetting secret.
-	VaultResetTokenPath = "/reset-tokens"
-	// VaultEmailVerifyPath has all the active tokens for verifying email.
-	VaultEmailVerifyPath = "/email-tokens"
-)
-
-var (
-	users = make(map[string]UserResource)
 )
 
 // Controller is a controller for managing user functions.
 type Controller struct{}
 
+func init() {
+	// Remembered logins of deleted users cannot be skipped.
+	util.SetSubjectCheck(func(subject string) (bool, error) {
+		resource, err := getBackend().FindByID(subject)
+		if err == ErrorResourceNotFound {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		return resource.DeletedAt == nil, nil
+	})
+}
+
 // NewController for managing user events.
 func NewController() *Controller {
 	return &Controller{}
@@ -37,121 +45,379 @@ func (c *Controller) Add(user UserResource) (*UserResource, error) {
 		return nil, err
 	}
 
-	// Check whether a resource already exists for the email.
-	emailVault := util.GetVaultClient(emailsPath)
+	// Only admins can set the app metadata.
+	user.AppMetadata = nil
+	if err := validateMetadata(user.Metadata); err != nil {
+		return nil, err
+	}
+
+	user.CreatedAt = now()
+	user.Version = 1
 
-	var userID string
-	if userExists := emailVault.Get(user.Email, &userID); userExists {
+	// Generate random tokens for the verification mails.
+	tx := util.NewStoreTransaction()
+	verifications, err := addVerificationTokens(tx, user.ID, user.Emails)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create user data. The backend ensures that the resource and its email index are
+	// created together, and we remove the tokens if that fails.
+	if err := getBackend().Create(user); err == ErrorEmailExists {
+		tx.Rollback()
 		return nil, errors.New("users: email already exists. resource cannot be addded")
+	} else if err != nil {
+		return nil, tx.RollbackOnError(err)
 	}
 
-	// Generate a random token and send verification mail.
-	token := util.GenerateRandomToken()
-	tokenVault := util.GetVaultClient(VaultEmailVerifyPath)
-	tokenVault.Set(token, user.Email)
-	go util.SendVerificationMail(user.Email, token)
+	sendVerificationMails(verifications)
+
+	return &user, nil
+}
 
-	// Create user data.
-	usersVault := util.GetVaultClient(usersPath)
-	users[user.ID] = user // FIXME: Remove this!
-	usersVault.Set(user.ID, user)
-	emailVault.Set(user.Email, user.ID)
+// Import an user resource from another system. Unlike `Add`, this keeps the ID, creation
+// time, verification status and app metadata of the resource (if they're set), and it
+// doesn't send verification mails.
+func (c *Controller) Import(user UserResource) (*UserResource, error) {
+	if user.ID == "" {
+		user.ID = util.GenerateRandomUUID()
+	}
+
+	// Validation resets the verification status, which should be kept for imports.
+	verified := make(map[string]bool)
+	for _, email := range user.Emails {
+		verified[strings.ToLower(email.Address)] = email.Verified
+	}
+
+	if len(user.Emails) == 0 {
+		verified[strings.ToLower(user.Email)] = user.Verified
+	}
+
+	if err := user.Validate(); err != nil {
+		return nil, err
+	}
+
+	for i := range user.Emails {
+		user.Emails[i].Verified = verified[user.Emails[i].Address]
+	}
+
+	user.syncEmails()
+	if err := validateMetadata(user.Metadata); err != nil {
+		return nil, err
+	}
+
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = now()
+	}
+
+	user.CreatedAt = user.CreatedAt.UTC().Truncate(time.Microsecond)
+	user.DeletedAt = nil
+	user.Version = 1
+
+	backend := getBackend()
+	if _, err := backend.FindByID(user.ID); err == nil {
+		return nil, errors.New("users: resource already exists for ID")
+	} else if err != ErrorResourceNotFound {
+		return nil, err
+	}
+
+	if err := backend.Create(user); err == ErrorEmailExists {
+		return nil, errors.New("users: email already exists. resource cannot be imported")
+	} else if err != nil {
+		return nil, err
+	}
 
 	return &user, nil
 }
 
-// Update an user resource within the system.
-func (c *Controller) Update(newResource UserResource) (*UserResource, error) {
+// LoadResource as is (e.g., while restoring backups), without validating it. This fails
+// if a resource already exists for its ID or emails.
+func (c *Controller) LoadResource(user UserResource) error {
+	backend := getBackend()
+	if _, err := backend.FindByID(user.ID); err == nil {
+		return errors.New("users: resource already exists for ID")
+	} else if err != ErrorResourceNotFound {
+		return err
+	}
+
+	return backend.Create(user)
+}
+
+// Update an user resource within the system. If a version is given, then it should match
+// the current version of the resource.
+func (c *Controller) Update(newResource UserResource, version *int) (*UserResource, error) {
+	legacy := len(newResource.Emails) == 0
 	// Validate new data.
 	if err := newResource.Validate(); err != nil {
 		return nil, err
 	}
 
 	// Ensure that data already exists for resource.
-	usersVault := util.GetVaultClient(usersPath)
-
-	var oldResource UserResource
-	if resourceExists := usersVault.Get(newResource.ID, &oldResource); !resourceExists {
+	backend := getBackend()
+	oldResource, err := backend.FindByID(newResource.ID)
+	if err == ErrorResourceNotFound || (err == nil && oldResource.DeletedAt != nil) {
 		return nil, errors.New("users: resource doesn't exist. resource cannot be updated")
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := util.CheckVersion(version, oldResource.Version); err != nil {
+		return nil, err
+	}
+
+	// Metadata is kept if it's missing in the new data, and only admins can change the app
+	// metadata (through `UpdateAppMetadata`).
+	if newResource.Metadata == nil {
+		newResource.Metadata = oldResource.Metadata
+	}
+
+	if err := validateMetadata(newResource.Metadata); err != nil {
+		return nil, err
+	}
+
+	newResource.AppMetadata = oldResource.AppMetadata
+	newResource.CreatedAt = oldResource.CreatedAt
+	newResource.Version = oldResource.Version + 1
+
+	// Clients which only know about the primary email replace it (and keep the others).
+	if legacy {
+		newResource.Emails = replacePrimaryEmail(oldResource.Emails, newResource.Email)
+	}
+
+	// Keep the verification status of existing emails, and send verification mails for
+	// the new ones.
+	var added []UserEmail
+	for i, email := range newResource.Emails {
+		if oldEmail := oldResource.FindEmail(email.Address); oldEmail != nil {
+			newResource.Emails[i].Verified = oldEmail.Verified
+		} else {
+			added = append(added, email)
+		}
 	}
 
-	// If the email is new, then send verification mail and update the store.
-	if oldResource.Email != newResource.Email {
-		token := util.GenerateRandomToken()
-		tokenVault := util.GetVaultClient(VaultEmailVerifyPath)
-		tokenVault.Set(token, newResource.Email)
-		go util.SendVerificationMail(newResource.Email, token)
+	newResource.syncEmails()
 
-		emailVault := util.GetVaultClient(emailsPath)
-		emailVault.Remove(oldResource.Email)
-		emailVault.Set(newResource.Email, newResource.ID)
-	} else {
-		newResource.Verified = oldResource.Verified
+	tx := util.NewStoreTransaction()
+	verifications, err := addVerificationTokens(tx, newResource.ID, added)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := backend.Update(*oldResource, newResource); err == ErrorEmailExists {
+		tx.Rollback()
+		return nil, errors.New("users: email already exists. resource cannot be updated")
+	} else if err != nil {
+		return nil, tx.RollbackOnError(err)
 	}
 
-	users[newResource.ID] = newResource // FIXME: Remove this!
-	usersVault.Set(newResource.ID, newResource)
+	// Pending verifications of the removed emails are no longer valid.
+	for _, email := range oldResource.Emails {
+		if newResource.FindEmail(email.Address) == nil {
+			if err := revokeVerificationTokens(email.Address); err != nil {
+				log.Printf("users: error removing tokens for %s: %s", newResource.ID, err)
+			}
+		}
+	}
+
+	sendVerificationMails(verifications)
+
 	return &newResource, nil
 }
 
-// FindUserResourceByID gets an user resource from the system based on the ID.
-func (c *Controller) FindUserResourceByID(id string) (*UserResource, error) {
-	vault := util.GetVaultClient(usersPath)
+// UpdateAppMetadata of an user resource. This replaces the existing app metadata, and it
+// should only be allowed for admins. If a version is given, then it should match the current
+// version of the resource.
+func (c *Controller) UpdateAppMetadata(id string, appMetadata map[string]interface{}, version *int) (*UserResource, error) {
+	resource, err := c.FindUserResourceByID(id)
+	if err != nil {
+		return nil, err
+	}
 
-	var resource UserResource
-	if resourceExists := vault.Get(id, &resource); resourceExists {
-		users[id] = resource // FIXME: Remove this
-		return &resource, nil
+	if err := util.CheckVersion(version, resource.Version); err != nil {
+		return nil, err
 	}
 
-	return nil, errors.New("users: resource doesn't exist for ID")
+	updated := *resource
+	updated.AppMetadata = appMetadata
+	updated.Version++
+
+	if err := getBackend().Update(*resource, updated); err != nil {
+		return nil, err
+	}
+
+	return &updated, nil
+}
+
+// FindUserResourceByID gets an user resource from the system based on the ID. Deleted
+// resources aren't returned.
+func (c *Controller) FindUserResourceByID(id string) (*UserResource, error) {
+	resource, err := getBackend().FindByID(id)
+	if err == ErrorResourceNotFound || (err == nil && resource.DeletedAt != nil) {
+		return nil, errors.New("users: resource doesn't exist for ID")
+	}
+
+	return resource, err
 }
 
 // FindUserResourceByEmail gets an user resource from the system based on their email.
+// Deleted resources aren't returned.
 func (c *Controller) FindUserResourceByEmail(email string) (*UserResource, error) {
-	vault := util.GetVaultClient(emailsPath)
-
-	var userID string
-	if emailExists := vault.Get(email, &userID); emailExists {
-		return c.FindUserResourceByID(userID)
+	resource, err := getBackend().FindByEmail(email)
+	if err == ErrorResourceNotFound || (err == nil && resource.DeletedAt != nil) {
+		return nil, errors.New("users: resource doesn't exist for email")
 	}
 
-	return nil, errors.New("users: resource doesn't exist for email")
+	return resource, err
 }
 
-// FetchAllResources from this instance.
-// FIXME: How do we paginate? Vault doesn't support pagination. So, we should probably
-// go for a database?
-func (c *Controller) FetchAllResources() (map[string]UserResource, error) {
-	return users, nil
-}
+// ListResources matching the given query.
+func (c *Controller) ListResources(query ListQuery) (*ListPage, error) {
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
 
-// RemoveUserResource corresponding to the given ID.
-func (c *Controller) RemoveUserResource(id string) (*UserResource, error) {
-	usersVault := util.GetVaultClient(usersPath)
-	emailVault := util.GetVaultClient(emailsPath)
+	return getBackend().List(query)
+}
 
+// RemoveUserResource corresponding to the given ID. The resource is only marked as deleted
+// (which blocks its logins, and revokes its sessions along with its tokens in Hydra), and it
+// can be restored until the retention period has passed.
+// If a version is given, then it should match the current version of the resource.
+func (c *Controller) RemoveUserResource(id string, version *int) (*UserResource, error) {
 	resource, err := c.FindUserResourceByID(id)
 	if err != nil {
 		return nil, err
 	}
 
-	delete(users, resource.ID)
-	usersVault.Remove(resource.ID)
-	emailVault.Remove(resource.Email)
+	if err := util.CheckVersion(version, resource.Version); err != nil {
+		return nil, err
+	}
 
-	return resource, nil
+	deletedAt := now()
+	deleted := *resource
+	deleted.DeletedAt = &deletedAt
+	deleted.Version++
+
+	if err := getBackend().Update(*resource, deleted); err != nil {
+		return nil, err
+	}
+
+	// Remembered logins are refused for deleted users anyway, so failing to revoke the sessions
+	// doesn't undo the deletion.
+	if err := util.RevokeSessions(id); err != nil && err != util.ErrorOAuthNotInitialized {
+		log.Printf("users: error revoking sessions of deleted resource %s: %s", id, err)
+	}
+
+	return &deleted, nil
 }
 
 // VerifyEmail marks the given email as verified (if it exists).
-func (c *Controller) VerifyEmail(email string) {
+func (c *Controller) VerifyEmail(email string) error {
 	user, err := c.FindUserResourceByEmail(email)
 	if err != nil {
-		return
+		return err
+	}
+
+	verified := *user
+	verified.Emails = append([]UserEmail{}, user.Emails...)
+	verified.FindEmail(email).Verified = true
+	verified.syncEmails()
+	verified.Version++
+	return getBackend().Update(*user, verified)
+}
+
+// ReencryptResources seals the personal data of all resources (including the deleted ones)
+// with new data keys wrapped by the current encryption key. This encrypts the resources
+// stored before encryption was enabled, and it should be run after rotating the key.
+func (c *Controller) ReencryptResources() (int, error) {
+	if !util.IsEncryptionEnabled() {
+		return 0, util.ErrorEncryptionNotInitialized
+	}
+
+	backend := getBackend()
+	reencrypted := 0
+	for _, deleted := range []bool{false, true} {
+		query := ListQuery{Limit: MaxListLimit, Deleted: deleted}
+		for {
+			page, err := backend.List(query)
+			if err != nil {
+				return reencrypted, err
+			}
+
+			for _, user := range page.Users {
+				// The version doesn't change, since the resource itself stays the same.
+				if err := backend.Update(user, user); err != nil {
+					return reencrypted, err
+				}
+
+				reencrypted++
+			}
+
+			if page.NextCursor == "" {
+				break
+			}
+
+			query.Cursor = page.NextCursor
+		}
+	}
+
+	return reencrypted, util.RewrapBlindIndexKey()
+}
+
+// replacePrimaryEmail in the given emails with another address. If the address already
+// belongs to the emails, then it becomes the primary one.
+func replacePrimaryEmail(emails []UserEmail, address string) []UserEmail {
+	replaced := []UserEmail{{Address: address, Primary: true}}
+	for _, email := range emails {
+		if !email.Primary && email.Address != address {
+			replaced = append(replaced, email)
+		}
+	}
+
+	return replaced
+}
+
+// verification of an email, with the token for the link and the code sent along with it.
+type verification struct {
+	address string
+	token   string
+	code    string
+}
+
+// addVerificationTokens (and codes) for the given emails (of the given user) in the transaction.
+func addVerificationTokens(tx *util.StoreTransaction, userID string, emails []UserEmail) ([]verification, error) {
+	var verifications []verification
+	for _, email := range emails {
+		token, err := util.MintToken(tx, util.TokenPurposeVerifyEmail, userID, email.Address)
+		if err != nil {
+			return nil, tx.RollbackOnError(err)
+		}
+
+		code, err := util.MintCode(tx, util.TokenPurposeVerifyEmail, email.Address, userID, email.Address)
+		if err != nil {
+			return nil, tx.RollbackOnError(err)
+		}
+
+		verifications = append(verifications, verification{address: email.Address, token: token, code: code})
 	}
 
-	user.Verified = true
+	return verifications, nil
+}
+
+// revokeVerificationTokens (and the code) of the given email.
+func revokeVerificationTokens(address string) error {
+	if err := util.RevokeCode(util.TokenPurposeVerifyEmail, address); err != nil {
+		return err
+	}
 
-	vault := util.GetVaultClient(usersPath)
-	vault.Set(user.ID, user)
+	return util.RevokeTokens(func(token util.Token) bool {
+		return token.Purpose == util.TokenPurposeVerifyEmail && token.HasValue(address)
+	})
+}
+
+// sendVerificationMails for the given verifications.
+func sendVerificationMails(verifications []verification) {
+	for _, v := range verifications {
+		go util.SendVerificationMail(v.address, v.token, v.code)
+	}
 }
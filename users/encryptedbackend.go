@@ -0,0 +1,213 @@
+package users
+
+import (
+	"encoding/json"
+	"strings"
+
+	"gitlab.com/omnijar/arusha/util"
+)
+
+// EncryptedBackend encrypts the personal data (emails, names and metadata) of user resources
+// before they reach the underlying backend. The emails are replaced by their blind indexes,
+// so that resources can still be found by email.
+type EncryptedBackend struct {
+	Backend
+}
+
+// sealedUserData has the personal data of a resource, which is encrypted at rest. Emails are
+// in the same order as the emails of the resource.
+type sealedUserData struct {
+	Emails    []string               `json:"emails"`
+	Firstname string                 `json:"firstName"`
+	Lastname  string                 `json:"lastName,omitempty"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// Create a new resource.
+func (b *EncryptedBackend) Create(user UserResource) error {
+	sealed, err := sealResource(user)
+	if err != nil {
+		return err
+	}
+
+	return b.Backend.Create(*sealed)
+}
+
+// Update an existing resource. The stored emails are used for the old resource, so that
+// resources stored before encryption was enabled have their email index replaced.
+func (b *EncryptedBackend) Update(oldResource, newResource UserResource) error {
+	stored, err := b.Backend.FindByID(oldResource.ID)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := sealResource(newResource)
+	if err != nil {
+		return err
+	}
+
+	oldResource.Email, oldResource.Emails = stored.Email, stored.Emails
+	return b.Backend.Update(oldResource, *sealed)
+}
+
+// FindByID gets the resource for the given ID.
+func (b *EncryptedBackend) FindByID(id string) (*UserResource, error) {
+	resource, err := b.Backend.FindByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return openResource(*resource)
+}
+
+// FindByEmail gets the resource for the given email. Resources stored before encryption was
+// enabled are still indexed by their plain emails, so those are looked up as well.
+func (b *EncryptedBackend) FindByEmail(email string) (*UserResource, error) {
+	resource, err := b.Backend.FindByEmail(util.BlindIndex(strings.ToLower(strings.TrimSpace(email))))
+	if err == ErrorResourceNotFound {
+		resource, err = b.Backend.FindByEmail(email)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return openResource(*resource)
+}
+
+// List the resources matching the query. Filters on personal data cannot be applied by the
+// underlying backend, so those queries go through all the resources matching the remaining
+// filters (and decrypt them). The data keys of the resources are cached (see `util.Open`), so
+// only the first of these queries unwraps each key with the key encryption key.
+func (b *EncryptedBackend) List(query ListQuery) (*ListPage, error) {
+	if query.EmailPrefix == "" && query.Firstname == "" && query.Lastname == "" && query.Search == "" {
+		page, err := b.Backend.List(query)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, user := range page.Users {
+			opened, err := openResource(user)
+			if err != nil {
+				return nil, err
+			}
+
+			page.Users[i] = *opened
+		}
+
+		return page, nil
+	}
+
+	createdAt, id, err := decodeCursor(query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	innerQuery := query
+	innerQuery.Cursor, innerQuery.Limit = "", MaxListLimit
+	innerQuery.EmailPrefix, innerQuery.Firstname, innerQuery.Lastname, innerQuery.Search = "", "", "", ""
+
+	page := &ListPage{Users: *new([]UserResource)}
+	for {
+		innerPage, err := b.Backend.List(innerQuery)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, user := range innerPage.Users {
+			opened, err := openResource(user)
+			if err != nil {
+				return nil, err
+			}
+
+			if !query.Matches(*opened) {
+				continue
+			}
+
+			page.Total++
+			if isAfterCursor(*opened, createdAt, id) && len(page.Users) <= query.Limit {
+				page.Users = append(page.Users, *opened)
+			}
+		}
+
+		if innerPage.NextCursor == "" {
+			break
+		}
+
+		innerQuery.Cursor = innerPage.NextCursor
+	}
+
+	if len(page.Users) > query.Limit {
+		page.Users = page.Users[:query.Limit]
+		page.NextCursor = encodeCursor(page.Users[len(page.Users)-1])
+	}
+
+	return page, nil
+}
+
+// sealResource encrypts the personal data of the resource and replaces its emails with
+// their blind indexes.
+func sealResource(user UserResource) (*UserResource, error) {
+	user.syncEmails()
+	data := sealedUserData{
+		Emails:    *new([]string),
+		Firstname: user.Firstname,
+		Lastname:  user.Lastname,
+		Metadata:  user.Metadata,
+	}
+
+	emails := make([]UserEmail, len(user.Emails))
+	for i, email := range user.Emails {
+		data.Emails = append(data.Emails, email.Address)
+		emails[i] = email
+		emails[i].Address = util.BlindIndex(email.Address)
+	}
+
+	plaintext, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Sealed, err = util.Seal(plaintext); err != nil {
+		return nil, err
+	}
+
+	user.Email = util.BlindIndex(user.Email)
+	user.Emails = emails
+	user.Firstname, user.Lastname = "", ""
+	user.Metadata = nil
+	return &user, nil
+}
+
+// openResource decrypts the personal data of a sealed resource. Resources stored before
+// encryption was enabled are returned as they are.
+func openResource(user UserResource) (*UserResource, error) {
+	if user.Sealed == nil {
+		return &user, nil
+	}
+
+	plaintext, err := util.Open(*user.Sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	var data sealedUserData
+	if err := json.Unmarshal(plaintext, &data); err != nil {
+		return nil, err
+	}
+
+	if len(data.Emails) != len(user.Emails) {
+		return nil, util.ErrorDecryption
+	}
+
+	user.Emails = append([]UserEmail(nil), user.Emails...)
+	for i, address := range data.Emails {
+		user.Emails[i].Address = address
+	}
+
+	user.Firstname, user.Lastname = data.Firstname, data.Lastname
+	user.Metadata = data.Metadata
+	user.Sealed = nil
+	user.syncEmails()
+	return &user, nil
+}
@@ -0,0 +1,123 @@
+package users
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+func TestEncryptedBackends(t *testing.T) {
+	backends, path := testBackends(t)
+	defer os.Remove(path)
+	defer util.CloseDatabase()
+
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+
+	file, err := ioutil.TempFile("", "arusha-key")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	fmt.Fprintf(file, "1:%s\n", base64.StdEncoding.EncodeToString(key))
+	file.Close()
+
+	defer func() {
+		config.Default.EncryptionKey = ""
+		util.InitializeEncryption()
+	}()
+
+	for name, backend := range backends {
+		t.Run("backend="+name, func(t *testing.T) {
+			// This resource is stored before encryption is enabled.
+			legacy := UserResource{
+				ID:        "enc-" + name + "-legacy",
+				Email:     "enc-" + name + "-legacy@example.com",
+				Firstname: "Foo",
+				CreatedAt: now(),
+			}
+
+			config.Default.EncryptionKey = ""
+			require.NoError(t, util.InitializeEncryption())
+			require.NoError(t, backend.Create(legacy))
+
+			config.Default.EncryptionKey = util.KeyProviderFile + file.Name()
+			require.NoError(t, util.InitializeEncryption())
+			encrypted := &EncryptedBackend{backend}
+
+			user := UserResource{
+				ID:        "enc-" + name,
+				Email:     "enc-" + name + "@example.com",
+				Firstname: "Bar",
+				Lastname:  "Baz",
+				Metadata:  map[string]interface{}{"plan": "free"},
+				CreatedAt: now(),
+			}
+
+			require.NoError(t, encrypted.Create(user))
+			assert.Equal(t, ErrorEmailExists, encrypted.Create(UserResource{ID: "other", Email: user.Email}))
+
+			stored, err := backend.FindByID(user.ID)
+			require.NoError(t, err)
+			assert.NotNil(t, stored.Sealed)
+			assert.NotEqual(t, user.Email, stored.Email)
+			assert.Empty(t, stored.Firstname)
+			assert.Nil(t, stored.Metadata)
+
+			found, err := encrypted.FindByEmail(user.Email)
+			require.NoError(t, err)
+			assert.Equal(t, user.ID, found.ID)
+			assert.Equal(t, user.Email, found.Email)
+			assert.Equal(t, "Baz", found.Lastname)
+			assert.Equal(t, "free", found.Metadata["plan"])
+			assert.Nil(t, found.Sealed)
+
+			// Plain resources are still found, and they're encrypted on update.
+			found, err = encrypted.FindByEmail(legacy.Email)
+			require.NoError(t, err)
+			updated := *found
+			updated.Emails = append(updated.Emails, UserEmail{Address: "enc-" + name + "-other@example.com"})
+			require.NoError(t, encrypted.Update(*found, updated))
+
+			stored, err = backend.FindByID(legacy.ID)
+			require.NoError(t, err)
+			assert.NotNil(t, stored.Sealed)
+			_, err = backend.FindByEmail(legacy.Email)
+			assert.Equal(t, ErrorResourceNotFound, err)
+
+			for _, email := range []string{legacy.Email, updated.Emails[1].Address} {
+				found, err = encrypted.FindByEmail(email)
+				require.NoError(t, err)
+				assert.Equal(t, legacy.ID, found.ID)
+				assert.Equal(t, legacy.Email, found.Email)
+			}
+
+			page, err := encrypted.List(ListQuery{EmailPrefix: "enc-" + name, Limit: 1})
+			require.NoError(t, err)
+			assert.Equal(t, 2, page.Total)
+			require.Len(t, page.Users, 1)
+			assert.Equal(t, legacy.ID, page.Users[0].ID)
+
+			page, err = encrypted.List(ListQuery{EmailPrefix: "enc-" + name, Limit: 1, Cursor: page.NextCursor})
+			require.NoError(t, err)
+			require.Len(t, page.Users, 1)
+			assert.Equal(t, user.ID, page.Users[0].ID)
+			assert.Empty(t, page.NextCursor)
+
+			page, err = encrypted.List(ListQuery{Firstname: "bar", Limit: MaxListLimit})
+			require.NoError(t, err)
+			assert.Equal(t, 1, page.Total)
+
+			require.NoError(t, encrypted.Remove(*found))
+			_, err = encrypted.FindByEmail(updated.Emails[1].Address)
+			assert.Equal(t, ErrorResourceNotFound, err)
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+	"gitlab.com/omnijar/arusha/config"
+)
+
+var (
+	metadataSchema *gojsonschema.Schema
+)
+
+// LoadMetadataSchema from the path configured for user metadata. If there's no path, then
+// the metadata of users is accepted as is.
+func LoadMetadataSchema() error {
+	metadataSchema = nil
+	if config.Default.UserMetadataSchema == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(config.Default.UserMetadataSchema)
+	if err != nil {
+		return errors.New("users: cannot read metadata schema: " + err.Error())
+	}
+
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(data))
+	if err != nil {
+		return errors.New("users: invalid metadata schema: " + err.Error())
+	}
+
+	metadataSchema = schema
+	return nil
+}
+
+// validateMetadata against the configured schema.
+func validateMetadata(metadata map[string]interface{}) error {
+	if metadataSchema == nil {
+		return nil
+	}
+
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+
+	result, err := metadataSchema.Validate(gojsonschema.NewGoLoader(metadata))
+	if err != nil {
+		return errors.New("users: cannot validate metadata: " + err.Error())
+	}
+
+	if !result.Valid() {
+		var reasons []string
+		for _, reason := range result.Errors() {
+			reasons = append(reasons, reason.String())
+		}
+
+		return fmt.Errorf("users: invalid metadata (%s)", strings.Join(reasons, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package users
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+func TestMetadata(t *testing.T) {
+	backends, path := testBackends(t)
+	defer os.Remove(path)
+	defer util.CloseDatabase()
+
+	schemaPath := filepath.Join(os.TempDir(), "arusha-schema-"+uuid.New()+".json")
+	defer os.Remove(schemaPath)
+	require.NoError(t, ioutil.WriteFile(schemaPath, []byte(`{
+		"type": "object",
+		"properties": {
+			"locale": {"type": "string", "pattern": "^[a-z]{2}(-[A-Z]{2})?$"},
+			"phone": {"type": "string"}
+		},
+		"required": ["locale"],
+		"additionalProperties": false
+	}`), 0600))
+
+	config.Default.UserMetadataSchema = schemaPath
+	require.NoError(t, LoadMetadataSchema())
+	defer func() {
+		config.Default.UserMetadataSchema = ""
+		LoadMetadataSchema()
+	}()
+
+	assert.NoError(t, validateMetadata(map[string]interface{}{"locale": "en-GB"}))
+	assert.Error(t, validateMetadata(nil))
+	assert.Error(t, validateMetadata(map[string]interface{}{"locale": "english"}))
+	assert.Error(t, validateMetadata(map[string]interface{}{"locale": "en", "department": "R&D"}))
+
+	for name, backend := range backends {
+		t.Run("backend="+name, func(t *testing.T) {
+			user := UserResource{
+				ID:          strings.ToUpper(name) + "-METADATA",
+				Email:       name + "-metadata@example.com",
+				Firstname:   "Foo",
+				Metadata:    map[string]interface{}{"locale": "en"},
+				AppMetadata: map[string]interface{}{"plan": "free"},
+				CreatedAt:   now(),
+				Version:     1,
+			}
+
+			require.NoError(t, backend.Create(user))
+			found, err := backend.FindByID(user.ID)
+			require.NoError(t, err)
+			assert.Equal(t, user.Metadata, found.Metadata)
+			assert.Equal(t, user.AppMetadata, found.AppMetadata)
+		})
+	}
+
+	// Users cannot change their app metadata.
+	db, _ := util.GetDatabase()
+	require.NotNil(t, db)
+	c := NewController()
+	user, err := c.FindUserResourceByID("SQL-METADATA")
+	require.NoError(t, err)
+
+	changed := *user
+	changed.Metadata = nil
+	changed.AppMetadata = map[string]interface{}{"plan": "enterprise"}
+	updated, err := c.Update(changed, &user.Version)
+	require.NoError(t, err)
+	assert.Equal(t, user.Metadata, updated.Metadata)
+	assert.Equal(t, user.AppMetadata, updated.AppMetadata)
+
+	changed.Metadata = map[string]interface{}{"locale": "invalid"}
+	_, err = c.Update(changed, nil)
+	assert.Error(t, err)
+
+	updated, err = c.UpdateAppMetadata(user.ID, map[string]interface{}{"plan": "enterprise"}, &updated.Version)
+	require.NoError(t, err)
+	assert.Equal(t, "enterprise", updated.AppMetadata["plan"])
+}
@@ -0,0 +1,143 @@
+package users
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+const (
+	// PurgeInterval is the interval between purges of deleted resources.
+	PurgeInterval = time.Hour
+)
+
+var (
+	// ErrorRetentionExpired occurs when restoring a resource after its retention period.
+	ErrorRetentionExpired = errors.New("users: retention period has expired. resource cannot be restored")
+
+	purgeHooks []func(user UserResource) error
+)
+
+// OnPurge registers a function for removing the data linked to a user resource (from
+// other domains) when the resource is purged. If the function fails, the resource isn't
+// purged, and it'll be retried in the next purge.
+func OnPurge(hook func(user UserResource) error) {
+	purgeHooks = append(purgeHooks, hook)
+}
+
+// RestoreUserResource which has been deleted within the retention period. If a version is
+// given, then it should match the current version of the resource.
+func (c *Controller) RestoreUserResource(id string, version *int) (*UserResource, error) {
+	backend := getBackend()
+	resource, err := backend.FindByID(id)
+	if err == ErrorResourceNotFound {
+		return nil, errors.New("users: resource doesn't exist for ID")
+	} else if err != nil {
+		return nil, err
+	}
+
+	if resource.DeletedAt == nil {
+		return nil, errors.New("users: resource hasn't been deleted")
+	}
+
+	if err := util.CheckVersion(version, resource.Version); err != nil {
+		return nil, err
+	}
+
+	if time.Since(*resource.DeletedAt) > config.Default.UserRetentionPeriod {
+		return nil, ErrorRetentionExpired
+	}
+
+	restored := *resource
+	restored.DeletedAt = nil
+	restored.Version++
+
+	if err := backend.Update(*resource, restored); err != nil {
+		return nil, err
+	}
+
+	return &restored, nil
+}
+
+// PurgeDeletedResources permanently removes the resources (and the data linked to them)
+// which have been deleted before the retention period. This returns the number of purged
+// resources.
+func (c *Controller) PurgeDeletedResources() (int, error) {
+	backend := getBackend()
+	cutoff := now().Add(-config.Default.UserRetentionPeriod)
+	query := ListQuery{Limit: MaxListLimit, Deleted: true, DeletedBefore: &cutoff}
+
+	purged := 0
+	for {
+		page, err := backend.List(query)
+		if err != nil {
+			return purged, err
+		}
+
+		for _, user := range page.Users {
+			if err := purgeResource(backend, user); err != nil {
+				log.Printf("users: error purging resource %s: %s", user.ID, err)
+				continue
+			}
+
+			purged++
+		}
+
+		if page.NextCursor == "" {
+			return purged, nil
+		}
+
+		query.Cursor = page.NextCursor
+	}
+}
+
+// PurgeUserResource permanently removes the given resource (and the data linked to it) right
+// away, without deleting it first (e.g., for undoing an import which couldn't be completed).
+func (c *Controller) PurgeUserResource(user UserResource) error {
+	return purgeResource(getBackend(), user)
+}
+
+// purgeResource removes the data linked to the user, followed by the resource itself.
+func purgeResource(backend Backend, user UserResource) error {
+	for _, hook := range purgeHooks {
+		if err := hook(user); err != nil {
+			return err
+		}
+	}
+
+	// Any pending tokens (and codes) of the user (for verifying emails or resetting the secret)
+	// are removed as well.
+	if err := util.RevokeTokens(func(token util.Token) bool { return token.Subject == user.ID }); err != nil {
+		return err
+	}
+
+	if err := util.RevokeCodes(func(token util.Token) bool { return token.Subject == user.ID }); err != nil {
+		return err
+	}
+
+	return backend.Remove(user)
+}
+
+// RunPurges periodically, until the process exits.
+func (c *Controller) RunPurges() {
+	for {
+		if purged, err := c.PurgeDeletedResources(); err != nil {
+			log.Println("users: error purging deleted resources: " + err.Error())
+		} else if purged > 0 {
+			log.Printf("users: purged %d deleted resources", purged)
+		}
+
+		if err := util.PurgeExpiredTokens(); err != nil {
+			log.Println("users: error purging expired tokens: " + err.Error())
+		}
+
+		if err := util.PurgeExpiredCodes(); err != nil {
+			log.Println("users: error purging expired codes: " + err.Error())
+		}
+
+		time.Sleep(PurgeInterval)
+	}
+}
@@ -0,0 +1,89 @@
+package users
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/omnijar/arusha/config"
+	"gitlab.com/omnijar/arusha/util"
+)
+
+func TestSoftDeleteAndPurge(t *testing.T) {
+	config.Default.DatabaseURL = util.StoreMemory
+	require.NoError(t, util.InitializeStore())
+
+	c := NewController()
+	user := UserResource{
+		ID:        "PURGE-TEST",
+		Email:     "purge-test@example.com",
+		Firstname: "Foo",
+		CreatedAt: now(),
+		Version:   1,
+	}
+
+	require.NoError(t, getBackend().Create(user))
+	token, err := util.MintToken(nil, util.TokenPurposeResetSecret, user.ID, "")
+	require.NoError(t, err)
+
+	var purgedIDs []string
+	OnPurge(func(user UserResource) error {
+		purgedIDs = append(purgedIDs, user.ID)
+		return nil
+	})
+
+	ok, err := util.TouchLoginSession(user.ID, "client")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	config.Default.UserRetentionPeriod = time.Hour
+	stale := 0
+	_, err = c.RemoveUserResource(user.ID, &stale)
+	assert.Equal(t, util.ErrorPreconditionFailed, err)
+
+	deleted, err := c.RemoveUserResource(user.ID, nil)
+	require.NoError(t, err)
+	assert.NotNil(t, deleted.DeletedAt)
+
+	// Deleted users cannot skip logins remembered by Hydra.
+	ok, err = util.TouchLoginSession(user.ID, "client")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	_, err = c.FindUserResourceByID(user.ID)
+	assert.Error(t, err)
+	_, err = c.FindUserResourceByEmail(user.Email)
+	assert.Error(t, err)
+
+	// Resources within the retention period shouldn't be purged.
+	purged, err := c.PurgeDeletedResources()
+	require.NoError(t, err)
+	assert.Equal(t, 0, purged)
+
+	restored, err := c.RestoreUserResource(user.ID, &deleted.Version)
+	require.NoError(t, err)
+	assert.Nil(t, restored.DeletedAt)
+
+	found, err := c.FindUserResourceByEmail(user.Email)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, found.ID)
+
+	_, err = c.RemoveUserResource(user.ID, nil)
+	require.NoError(t, err)
+
+	config.Default.UserRetentionPeriod = 0
+	_, err = c.RestoreUserResource(user.ID, nil)
+	assert.Equal(t, ErrorRetentionExpired, err)
+
+	purged, err = c.PurgeDeletedResources()
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	assert.Equal(t, []string{user.ID}, purgedIDs)
+
+	_, err = getBackend().FindByID(user.ID)
+	assert.Equal(t, ErrorResourceNotFound, err)
+
+	_, err = util.LookupToken(util.TokenPurposeResetSecret, token)
+	assert.Equal(t, util.ErrorTokenInvalid, err)
+}
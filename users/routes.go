@@ -2,7 +2,11 @@ package users
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"gitlab.com/omnijar/arusha/util"
@@ -13,6 +17,31 @@ const (
 	UsersPath = "/users"
 	// UserPath for modifying a single user resource.
 	UserPath = UsersPath + "/:id"
+	// UserRestorePath for restoring a deleted user resource.
+	UserRestorePath = UserPath + "/restore"
+	// UserAppMetadataPath for modifying the app metadata of a user resource. This should only
+	// be allowed for admins.
+	UserAppMetadataPath = UserPath + "/app-metadata"
+	// CursorParameter in URL query for the page of user resources.
+	CursorParameter = "cursor"
+	// LimitParameter in URL query for the number of user resources in a page.
+	LimitParameter = "limit"
+	// EmailParameter in URL query for filtering user resources by email prefix.
+	EmailParameter = "email"
+	// FirstnameParameter in URL query for filtering user resources by first name.
+	FirstnameParameter = "firstName"
+	// LastnameParameter in URL query for filtering user resources by last name.
+	LastnameParameter = "lastName"
+	// VerifiedParameter in URL query for filtering user resources by verification status.
+	VerifiedParameter = "verified"
+	// CreatedAfterParameter in URL query for filtering user resources created at or after a time.
+	CreatedAfterParameter = "createdAfter"
+	// CreatedBeforeParameter in URL query for filtering user resources created at or before a time.
+	CreatedBeforeParameter = "createdBefore"
+	// SearchParameter in URL query for searching user resources by their names.
+	SearchParameter = "q"
+	// DeletedParameter in URL query for listing deleted user resources.
+	DeletedParameter = "deleted"
 )
 
 var (
@@ -36,6 +65,10 @@ func (h *RouteHandler) SetRoutes(r *httprouter.Router) {
 	r.GET(UserPath, h.Get)
 	r.PUT(UserPath, h.Update)
 	r.DELETE(UserPath, h.Remove)
+	r.OPTIONS(UserRestorePath, util.PassEmptyBody)
+	r.POST(UserRestorePath, h.Restore)
+	r.OPTIONS(UserAppMetadataPath, util.PassEmptyBody)
+	r.PUT(UserAppMetadataPath, h.UpdateAppMetadata)
 }
 
 // Get returns the existing user data.
@@ -48,18 +81,77 @@ func (h *RouteHandler) Get(w http.ResponseWriter, r *http.Request, params httpro
 		return
 	}
 
+	util.SetETag(w, resource.Version)
 	json.NewEncoder(w).Encode(resource)
 }
 
-// List all user resources.
+// List a page of user resources matching the filters in the URL query. The page can be
+// specified with the `cursor` and `limit` parameters, and the response has the cursor for
+// the next page along with the total number of matching resources.
 func (h *RouteHandler) List(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	resources, err := controller.FetchAllResources()
+	query, err := parseListQuery(r.URL.Query())
 	if err != nil {
 		util.RespondHTTPError(w, err, http.StatusBadRequest)
 		return
 	}
 
-	json.NewEncoder(w).Encode(resources)
+	page, err := controller.ListResources(*query)
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(page)
+}
+
+// parseListQuery from the parameters in the URL query.
+func parseListQuery(values url.Values) (*ListQuery, error) {
+	query := &ListQuery{
+		Cursor:      values.Get(CursorParameter),
+		EmailPrefix: values.Get(EmailParameter),
+		Firstname:   values.Get(FirstnameParameter),
+		Lastname:    values.Get(LastnameParameter),
+		Search:      values.Get(SearchParameter),
+	}
+
+	if limit := values.Get(LimitParameter); limit != "" {
+		var err error
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			return nil, fmt.Errorf("invalid value for '%s' in URL", LimitParameter)
+		}
+	}
+
+	if verified := values.Get(VerifiedParameter); verified != "" {
+		value, err := strconv.ParseBool(verified)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for '%s' in URL", VerifiedParameter)
+		}
+
+		query.Verified = &value
+	}
+
+	if deleted := values.Get(DeletedParameter); deleted != "" {
+		var err error
+		if query.Deleted, err = strconv.ParseBool(deleted); err != nil {
+			return nil, fmt.Errorf("invalid value for '%s' in URL", DeletedParameter)
+		}
+	}
+
+	for param, field := range map[string]**time.Time{
+		CreatedAfterParameter:  &query.CreatedAfter,
+		CreatedBeforeParameter: &query.CreatedBefore,
+	} {
+		if value := values.Get(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for '%s' in URL (expected RFC 3339 time)", param)
+			}
+
+			*field = &t
+		}
+	}
+
+	return query, nil
 }
 
 // Add appends a new user resource.
@@ -84,7 +176,8 @@ func (h *RouteHandler) Add(w http.ResponseWriter, r *http.Request, params httpro
 	json.NewEncoder(w).Encode(resource)
 }
 
-// Update modifies a user resource.
+// Update modifies a user resource. If the If-Match header is set, then it should match the
+// current version of the resource.
 func (h *RouteHandler) Update(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	var resource UserResource
 	if r.Body == nil {
@@ -97,26 +190,91 @@ func (h *RouteHandler) Update(w http.ResponseWriter, r *http.Request, params htt
 		return
 	}
 
+	version, err := util.ParseIfMatch(r)
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
 	resource.ID = params.ByName("id")
-	_, err := controller.Update(resource)
+	updated, err := controller.Update(resource, version)
 
+	if err != nil {
+		util.RespondHTTPError(w, err, util.StatusCodeForError(err, http.StatusBadRequest))
+		return
+	}
+
+	util.SetETag(w, updated.Version)
+	json.NewEncoder(w).Encode(updated)
+}
+
+// Remove the user corresponding to the given ID. If the If-Match header is set, then it
+// should match the current version of the resource.
+func (h *RouteHandler) Remove(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id := params.ByName("id")
+
+	version, err := util.ParseIfMatch(r)
 	if err != nil {
 		util.RespondHTTPError(w, err, http.StatusBadRequest)
 		return
 	}
 
+	resource, err := controller.RemoveUserResource(id, version)
+	if err != nil {
+		util.RespondHTTPError(w, err, util.StatusCodeForError(err, http.StatusBadRequest))
+		return
+	}
+
 	json.NewEncoder(w).Encode(resource)
 }
 
-// Remove the user corresponding to the given ID.
-func (h *RouteHandler) Remove(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+// Restore the deleted user corresponding to the given ID. If the If-Match header is set, then
+// it should match the current version of the resource.
+func (h *RouteHandler) Restore(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	id := params.ByName("id")
 
-	resource, err := controller.RemoveUserResource(id)
+	version, err := util.ParseIfMatch(r)
 	if err != nil {
 		util.RespondHTTPError(w, err, http.StatusBadRequest)
 		return
 	}
 
+	resource, err := controller.RestoreUserResource(id, version)
+	if err != nil {
+		util.RespondHTTPError(w, err, util.StatusCodeForError(err, http.StatusBadRequest))
+		return
+	}
+
+	util.SetETag(w, resource.Version)
+	json.NewEncoder(w).Encode(resource)
+}
+
+// UpdateAppMetadata replaces the app metadata of a user resource. If the If-Match header is set,
+// then it should match the current version of the resource.
+func (h *RouteHandler) UpdateAppMetadata(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var appMetadata map[string]interface{}
+	if r.Body == nil {
+		util.RespondHTTPError(w, util.ErrorHTTPNoBody, http.StatusBadRequest)
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&appMetadata); err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	version, err := util.ParseIfMatch(r)
+	if err != nil {
+		util.RespondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	resource, err := controller.UpdateAppMetadata(params.ByName("id"), appMetadata, version)
+	if err != nil {
+		util.RespondHTTPError(w, err, util.StatusCodeForError(err, http.StatusBadRequest))
+		return
+	}
+
+	util.SetETag(w, resource.Version)
 	json.NewEncoder(w).Encode(resource)
 }
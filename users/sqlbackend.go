@@ -0,0 +1,431 @@
+package users
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	"gitlab.com/omnijar/arusha/util"
+)
+
+const (
+	userColumns = "id, email, verified, first_name, last_name, created_at, version, deleted_at, metadata, app_metadata, sealed"
+)
+
+var (
+	likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+)
+
+// SQLBackend keeps user resources in a SQL database. Emails are indexed by the database
+// (instead of a separate index), so that lookups and uniqueness checks are consistent.
+type SQLBackend struct {
+	db     *sql.DB
+	driver string
+}
+
+// Create a new resource.
+func (b *SQLBackend) Create(user UserResource) error {
+	user.syncEmails()
+	for _, email := range user.Emails {
+		if _, err := b.FindByEmail(email.Address); err == nil {
+			return ErrorEmailExists
+		} else if err != ErrorResourceNotFound {
+			return err
+		}
+	}
+
+	metadata, appMetadata, sealed, err := encodeMetadata(user)
+	if err != nil {
+		return err
+	}
+
+	return b.inTransaction(func(tx *sql.Tx) error {
+		query := util.RebindQuery(b.driver, `INSERT INTO arusha_users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+		_, err := tx.Exec(query, user.ID, user.Email, user.Verified, user.Firstname, user.Lastname, user.CreatedAt.UnixNano(),
+			user.Version, nullableTime(user.DeletedAt), metadata, appMetadata, sealed)
+		if err != nil {
+			return err
+		}
+
+		return b.insertEmails(tx, user)
+	})
+}
+
+// Update an existing resource.
+func (b *SQLBackend) Update(oldResource, newResource UserResource) error {
+	oldResource.syncEmails()
+	newResource.syncEmails()
+	for _, email := range newResource.Emails {
+		if oldResource.FindEmail(email.Address) != nil {
+			continue
+		}
+
+		if _, err := b.FindByEmail(email.Address); err == nil {
+			return ErrorEmailExists
+		} else if err != ErrorResourceNotFound {
+			return err
+		}
+	}
+
+	metadata, appMetadata, sealed, err := encodeMetadata(newResource)
+	if err != nil {
+		return err
+	}
+
+	return b.inTransaction(func(tx *sql.Tx) error {
+		query := util.RebindQuery(b.driver, `UPDATE arusha_users SET email = ?, verified = ?, first_name = ?, last_name = ?, version = ?,
+			deleted_at = ?, metadata = ?, app_metadata = ?, sealed = ? WHERE id = ? AND version = ?`)
+		result, err := tx.Exec(query, newResource.Email, newResource.Verified, newResource.Firstname, newResource.Lastname,
+			newResource.Version, nullableTime(newResource.DeletedAt), metadata, appMetadata, sealed, newResource.ID,
+			oldResource.Version)
+		if err != nil {
+			return err
+		}
+
+		// The row isn't updated if someone else has modified it in the meantime.
+		if count, err := result.RowsAffected(); err != nil {
+			return err
+		} else if count == 0 {
+			return util.ErrorPreconditionFailed
+		}
+
+		query = util.RebindQuery(b.driver, `DELETE FROM arusha_user_emails WHERE user_id = ?`)
+		if _, err := tx.Exec(query, newResource.ID); err != nil {
+			return err
+		}
+
+		return b.insertEmails(tx, newResource)
+	})
+}
+
+// Remove an existing resource.
+func (b *SQLBackend) Remove(user UserResource) error {
+	return b.inTransaction(func(tx *sql.Tx) error {
+		query := util.RebindQuery(b.driver, `DELETE FROM arusha_user_emails WHERE user_id = ?`)
+		if _, err := tx.Exec(query, user.ID); err != nil {
+			return err
+		}
+
+		query = util.RebindQuery(b.driver, `DELETE FROM arusha_users WHERE id = ? AND version = ?`)
+		result, err := tx.Exec(query, user.ID, user.Version)
+		if err != nil {
+			return err
+		}
+
+		if count, err := result.RowsAffected(); err != nil {
+			return err
+		} else if count == 0 {
+			return util.ErrorPreconditionFailed
+		}
+
+		return nil
+	})
+}
+
+// FindByID gets the resource for the given ID.
+func (b *SQLBackend) FindByID(id string) (*UserResource, error) {
+	query := util.RebindQuery(b.driver, `SELECT `+userColumns+` FROM arusha_users WHERE id = ?`)
+	return b.findResource(query, id)
+}
+
+// FindByEmail gets the resource for the given email.
+func (b *SQLBackend) FindByEmail(email string) (*UserResource, error) {
+	query := util.RebindQuery(b.driver, `SELECT `+userColumns+` FROM arusha_users
+		WHERE id = (SELECT user_id FROM arusha_user_emails WHERE address = ?)`)
+	return b.findResource(query, email)
+}
+
+// findResource using the given query, along with its emails.
+func (b *SQLBackend) findResource(query string, args ...interface{}) (*UserResource, error) {
+	resource, err := b.scanResource(b.db.QueryRow(query, args...))
+	if err != nil {
+		return nil, err
+	}
+
+	resources := []UserResource{*resource}
+	if err := b.loadEmails(resources); err != nil {
+		return nil, err
+	}
+
+	return &resources[0], nil
+}
+
+// insertEmails of the resource in the transaction.
+func (b *SQLBackend) insertEmails(tx *sql.Tx, user UserResource) error {
+	query := util.RebindQuery(b.driver, `INSERT INTO arusha_user_emails (address, user_id, verified, is_primary, position)
+		VALUES (?, ?, ?, ?, ?)`)
+	for i, email := range user.Emails {
+		if _, err := tx.Exec(query, email.Address, user.ID, email.Verified, email.Primary, i); util.IsUniqueViolation(err) {
+			return ErrorEmailExists // added concurrently, after the check in `Create` or `Update`
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadEmails for the given resources.
+func (b *SQLBackend) loadEmails(users []UserResource) error {
+	if len(users) == 0 {
+		return nil
+	}
+
+	indices := make(map[string]int)
+	args := make([]interface{}, len(users))
+	for i, user := range users {
+		indices[user.ID] = i
+		args[i] = user.ID
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(users)), ", ")
+	query := util.RebindQuery(b.driver, `SELECT user_id, address, verified, is_primary FROM arusha_user_emails
+		WHERE user_id IN (`+placeholders+`) ORDER BY user_id, position`)
+
+	rows, err := b.db.Query(query, args...)
+	if err != nil {
+		return b.wrapError(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID string
+		var email UserEmail
+		if err := rows.Scan(&userID, &email.Address, &email.Verified, &email.Primary); err != nil {
+			return b.wrapError(err)
+		}
+
+		user := &users[indices[userID]]
+		user.Emails = append(user.Emails, email)
+	}
+
+	if err := rows.Err(); err != nil {
+		return b.wrapError(err)
+	}
+
+	for i := range users {
+		users[i].syncEmails()
+	}
+
+	return nil
+}
+
+// inTransaction runs the function in a database transaction, which is committed if the
+// function succeeds (and rolled back otherwise).
+func (b *SQLBackend) inTransaction(fn func(tx *sql.Tx) error) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return b.wrapError(err)
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		if err == util.ErrorPreconditionFailed || err == ErrorEmailExists {
+			return err
+		}
+
+		return b.wrapError(err)
+	}
+
+	return b.wrapError(tx.Commit())
+}
+
+// List the resources matching the query.
+func (b *SQLBackend) List(query ListQuery) (*ListPage, error) {
+	createdAt, id, err := decodeCursor(query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	filters, args := b.filterClauses(query)
+	where := ""
+	if len(filters) > 0 {
+		where = " WHERE " + strings.Join(filters, " AND ")
+	}
+
+	page := &ListPage{Users: *new([]UserResource)}
+	countQuery := util.RebindQuery(b.driver, `SELECT COUNT(*) FROM arusha_users`+where)
+	if err := b.db.QueryRow(countQuery, args...).Scan(&page.Total); err != nil {
+		return nil, b.wrapError(err)
+	}
+
+	filters = append(filters, "(created_at > ? OR (created_at = ? AND id > ?))")
+	// Fetch an extra resource for checking whether there's a next page.
+	args = append(args, createdAt, createdAt, id, query.Limit+1)
+
+	statement := util.RebindQuery(b.driver, `SELECT `+userColumns+` FROM arusha_users
+		WHERE `+strings.Join(filters, " AND ")+` ORDER BY created_at, id LIMIT ?`)
+
+	rows, err := b.db.Query(statement, args...)
+	if err != nil {
+		return nil, b.wrapError(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		resource, err := b.scanResource(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		page.Users = append(page.Users, *resource)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, b.wrapError(err)
+	}
+
+	if len(page.Users) > query.Limit {
+		page.Users = page.Users[:query.Limit]
+		page.NextCursor = encodeCursor(page.Users[len(page.Users)-1])
+	}
+
+	if err := b.loadEmails(page.Users); err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// filterClauses returns the SQL conditions (and their arguments) for the filters in the query.
+func (b *SQLBackend) filterClauses(query ListQuery) ([]string, []interface{}) {
+	filters := *new([]string)
+	args := *new([]interface{})
+
+	if query.Deleted {
+		filters = append(filters, "deleted_at IS NOT NULL")
+	} else {
+		filters = append(filters, "deleted_at IS NULL")
+	}
+
+	if query.DeletedBefore != nil {
+		filters = append(filters, "deleted_at <= ?")
+		args = append(args, query.DeletedBefore.UnixNano())
+	}
+
+	if query.EmailPrefix != "" {
+		filters = append(filters, `id IN (SELECT user_id FROM arusha_user_emails WHERE address LIKE ? ESCAPE '\')`)
+		args = append(args, escapeLike(query.EmailPrefix)+"%")
+	}
+
+	if query.Firstname != "" {
+		filters = append(filters, "LOWER(first_name) = ?")
+		args = append(args, strings.ToLower(query.Firstname))
+	}
+
+	if query.Lastname != "" {
+		filters = append(filters, "LOWER(last_name) = ?")
+		args = append(args, strings.ToLower(query.Lastname))
+	}
+
+	if query.Verified != nil {
+		filters = append(filters, "verified = ?")
+		args = append(args, *query.Verified)
+	}
+
+	if query.CreatedAfter != nil {
+		filters = append(filters, "created_at >= ?")
+		args = append(args, query.CreatedAfter.UnixNano())
+	}
+
+	if query.CreatedBefore != nil {
+		filters = append(filters, "created_at <= ?")
+		args = append(args, query.CreatedBefore.UnixNano())
+	}
+
+	for _, term := range query.searchTerms() {
+		pattern := "%" + escapeLike(term) + "%"
+		filters = append(filters, `(LOWER(first_name) LIKE ? ESCAPE '\' OR LOWER(last_name) LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern)
+	}
+
+	return filters, args
+}
+
+// escapeLike escapes the wildcards of LIKE patterns in the given string.
+func escapeLike(value string) string {
+	return likeEscaper.Replace(value)
+}
+
+// scanner is implemented by both `sql.Row` and `sql.Rows`.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func (b *SQLBackend) scanResource(row scanner) (*UserResource, error) {
+	var resource UserResource
+	var createdAt int64
+	var deletedAt sql.NullInt64
+	var metadata, appMetadata, sealed sql.NullString
+
+	err := row.Scan(&resource.ID, &resource.Email, &resource.Verified, &resource.Firstname, &resource.Lastname, &createdAt,
+		&resource.Version, &deletedAt, &metadata, &appMetadata, &sealed)
+	if err == sql.ErrNoRows {
+		return nil, ErrorResourceNotFound
+	} else if err != nil {
+		return nil, b.wrapError(err)
+	}
+
+	resource.CreatedAt = time.Unix(0, createdAt).UTC()
+	if deletedAt.Valid {
+		t := time.Unix(0, deletedAt.Int64).UTC()
+		resource.DeletedAt = &t
+	}
+
+	for value, field := range map[*sql.NullString]interface{}{
+		&metadata:    &resource.Metadata,
+		&appMetadata: &resource.AppMetadata,
+		&sealed:      &resource.Sealed,
+	} {
+		if value.Valid {
+			if err := json.Unmarshal([]byte(value.String), field); err != nil {
+				return nil, b.wrapError(err)
+			}
+		}
+	}
+
+	return &resource, nil
+}
+
+// encodeMetadata (and the sealed data) of the resource to their stored forms.
+func encodeMetadata(user UserResource) (interface{}, interface{}, interface{}, error) {
+	var encoded [3]interface{}
+	for i, value := range []interface{}{user.Metadata, user.AppMetadata, user.Sealed} {
+		if reflect.ValueOf(value).IsNil() {
+			continue
+		}
+
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		encoded[i] = string(data)
+	}
+
+	return encoded[0], encoded[1], encoded[2], nil
+}
+
+// nullableTime converts an optional time to its stored form.
+func nullableTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+
+	return t.UnixNano()
+}
+
+// wrapError logs the database error and hides its details from the caller.
+func (b *SQLBackend) wrapError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	log.Println("users: database error: " + err.Error())
+	return util.ErrorDatabase
+}
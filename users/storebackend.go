@@ -0,0 +1,182 @@
+package users
+
+import (
+	"sort"
+
+	"gitlab.com/omnijar/arusha/util"
+)
+
+// StoreBackend keeps user resources in the key/value store. Listing resources requires
+// fetching all of them, so this should only be used for small deployments.
+type StoreBackend struct{}
+
+// Create a new resource.
+func (b *StoreBackend) Create(user UserResource) error {
+	user.syncEmails()
+	for _, email := range user.Emails {
+		if err := b.checkEmailAvailable(email.Address, user.ID); err != nil {
+			return err
+		}
+	}
+
+	tx := util.NewStoreTransaction()
+	if err := tx.Set(util.GetStore(usersPath), user.ID, user); err != nil {
+		return err
+	}
+
+	for _, email := range user.Emails {
+		if err := tx.Set(util.GetStore(emailsPath), email.Address, user.ID); err != nil {
+			return tx.RollbackOnError(err)
+		}
+	}
+
+	return nil
+}
+
+// Update an existing resource.
+func (b *StoreBackend) Update(oldResource, newResource UserResource) error {
+	// NOTE: This only narrows the window for concurrent modifications (see `util.CheckVersion`).
+	current, err := b.FindByID(oldResource.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := util.CheckVersion(&oldResource.Version, current.Version); err != nil {
+		return err
+	}
+
+	oldResource.syncEmails()
+	newResource.syncEmails()
+
+	tx := util.NewStoreTransaction()
+	emailStore := util.GetStore(emailsPath)
+
+	for _, email := range newResource.Emails {
+		if oldResource.FindEmail(email.Address) != nil {
+			continue
+		}
+
+		if err := b.checkEmailAvailable(email.Address, newResource.ID); err != nil {
+			return tx.RollbackOnError(err)
+		}
+
+		if err := tx.Set(emailStore, email.Address, newResource.ID); err != nil {
+			return tx.RollbackOnError(err)
+		}
+	}
+
+	for _, email := range oldResource.Emails {
+		if newResource.FindEmail(email.Address) != nil {
+			continue
+		}
+
+		if err := tx.Remove(emailStore, email.Address); err != nil {
+			return tx.RollbackOnError(err)
+		}
+	}
+
+	return tx.RollbackOnError(tx.Set(util.GetStore(usersPath), newResource.ID, newResource))
+}
+
+// Remove an existing resource.
+func (b *StoreBackend) Remove(user UserResource) error {
+	current, err := b.FindByID(user.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := util.CheckVersion(&user.Version, current.Version); err != nil {
+		return err
+	}
+
+	tx := util.NewStoreTransaction()
+	for _, email := range current.Emails {
+		if err := tx.Remove(util.GetStore(emailsPath), email.Address); err != nil {
+			return tx.RollbackOnError(err)
+		}
+	}
+
+	return tx.RollbackOnError(tx.Remove(util.GetStore(usersPath), user.ID))
+}
+
+// checkEmailAvailable returns `ErrorEmailExists` if the email belongs to another resource.
+func (b *StoreBackend) checkEmailAvailable(email, id string) error {
+	var userID string
+	if err := util.GetStore(emailsPath).Get(email, &userID); err == util.ErrorKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	} else if userID != id {
+		return ErrorEmailExists
+	}
+
+	return nil
+}
+
+// FindByID gets the resource for the given ID.
+func (b *StoreBackend) FindByID(id string) (*UserResource, error) {
+	var resource UserResource
+	if err := util.GetStore(usersPath).Get(id, &resource); err == util.ErrorKeyNotFound {
+		return nil, ErrorResourceNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	resource.syncEmails()
+	return &resource, nil
+}
+
+// FindByEmail gets the resource for the given email.
+func (b *StoreBackend) FindByEmail(email string) (*UserResource, error) {
+	var userID string
+	if err := util.GetStore(emailsPath).Get(email, &userID); err == util.ErrorKeyNotFound {
+		return nil, ErrorResourceNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return b.FindByID(userID)
+}
+
+// List the resources matching the query.
+func (b *StoreBackend) List(query ListQuery) (*ListPage, error) {
+	createdAt, id, err := decodeCursor(query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := util.GetStore(usersPath).List()
+	if err != nil {
+		return nil, err
+	}
+
+	page := &ListPage{Users: *new([]UserResource)}
+	for _, userID := range ids {
+		resource, err := b.FindByID(userID)
+		if err == ErrorResourceNotFound {
+			continue // removed while listing
+		} else if err != nil {
+			return nil, err
+		}
+
+		if !query.Matches(*resource) {
+			continue
+		}
+
+		page.Total++
+		if isAfterCursor(*resource, createdAt, id) {
+			page.Users = append(page.Users, *resource)
+		}
+	}
+
+	sort.Slice(page.Users, func(i, j int) bool {
+		return isAfterCursor(page.Users[j], page.Users[i].CreatedAt.UnixNano(), page.Users[i].ID)
+	})
+
+	if len(page.Users) > query.Limit {
+		page.Users = page.Users[:query.Limit]
+		page.NextCursor = encodeCursor(page.Users[len(page.Users)-1])
+	}
+
+	return page, nil
+}
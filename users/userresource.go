@@ -3,18 +3,40 @@ package users
 import (
 	"errors"
 	"strings"
+	"time"
 
 	"gitlab.com/omnijar/arusha/util"
 )
 
+// UserEmail is one of the email addresses of an user, along with its verification status.
+type UserEmail struct {
+	Address  string `json:"address"`
+	Verified bool   `json:"verified"`
+	Primary  bool   `json:"primary"`
+}
+
 // UserResource identifies an user. It contains the ID, name(s) and email(s) of an user.
-// FIXME: Email and Verified fields should merge into an array.
+// An user can have several emails (exactly one of which is primary), and the Email and
+// Verified fields mirror the primary email.
+// Metadata has the extra attributes of the user (validated against the configured schema),
+// and AppMetadata has the attributes which can only be set by admins.
+// Sealed has the encrypted personal data (emails, names and metadata) of stored resources,
+// and it's never set for resources returned by the controller.
+// The version is incremented on every update (for detecting concurrent modifications).
+// Deleted resources are kept (with their deletion time) until they're purged.
 type UserResource struct {
-	ID        string `json:"id"`
-	Email     string `json:"email"`
-	Verified  bool   `json:"verified"`
-	Firstname string `json:"firstName"`
-	Lastname  string `json:"lastName,omitempty"`
+	ID          string                 `json:"id"`
+	Email       string                 `json:"email"`
+	Verified    bool                   `json:"verified"`
+	Emails      []UserEmail            `json:"emails"`
+	Firstname   string                 `json:"firstName"`
+	Lastname    string                 `json:"lastName,omitempty"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	AppMetadata map[string]interface{} `json:"appMetadata,omitempty"`
+	CreatedAt   time.Time              `json:"createdAt"`
+	DeletedAt   *time.Time             `json:"deletedAt,omitempty"`
+	Version     int                    `json:"version"`
+	Sealed      *util.SealedData       `json:"sealed,omitempty"`
 }
 
 // Validate validates the user account for possible errors.
@@ -22,9 +44,36 @@ func (u *UserResource) Validate() error {
 	u.ID = strings.ToUpper(u.ID)
 	u.Email = strings.ToLower(u.Email)
 	u.Verified = false // User shouldn't be able to do this.
+	u.Sealed = nil
 
-	if !util.IsValidEmail(u.Email) {
-		return errors.New("account: invalid email")
+	if len(u.Emails) == 0 {
+		u.Emails = []UserEmail{{Address: u.Email, Primary: true}}
+	}
+
+	primaries := 0
+	seen := make(map[string]bool)
+	for i := range u.Emails {
+		email := &u.Emails[i]
+		email.Address = strings.ToLower(email.Address)
+		email.Verified = false
+
+		if !util.IsValidEmail(email.Address) {
+			return errors.New("account: invalid email")
+		}
+
+		if seen[email.Address] {
+			return errors.New("account: duplicate email")
+		}
+
+		seen[email.Address] = true
+		if email.Primary {
+			primaries++
+			u.Email = email.Address
+		}
+	}
+
+	if primaries != 1 {
+		return errors.New("account: exactly one email should be primary")
 	}
 
 	if u.Firstname == "" {
@@ -33,3 +82,35 @@ func (u *UserResource) Validate() error {
 
 	return nil
 }
+
+// FindEmail returns the given email of the user (or nil if the user doesn't have it).
+func (u *UserResource) FindEmail(address string) *UserEmail {
+	for i := range u.Emails {
+		if u.Emails[i].Address == address {
+			return &u.Emails[i]
+		}
+	}
+
+	return nil
+}
+
+// IsVerifiedEmail checks whether the given email belongs to the user and has been verified.
+func (u *UserResource) IsVerifiedEmail(address string) bool {
+	email := u.FindEmail(address)
+	return email != nil && email.Verified
+}
+
+// syncEmails fills the emails of resources which were stored before users could have
+// several emails, and updates the Email and Verified fields from the primary email.
+func (u *UserResource) syncEmails() {
+	if len(u.Emails) == 0 {
+		u.Emails = []UserEmail{{Address: u.Email, Verified: u.Verified, Primary: true}}
+		return
+	}
+
+	for _, email := range u.Emails {
+		if email.Primary {
+			u.Email, u.Verified = email.Address, email.Verified
+		}
+	}
+}
@@ -8,8 +8,12 @@ func InitializeClients() error {
 		return errors.New("clients: error initializing mailgun. " + err.Error())
 	}
 
-	if err := InitializeVaultClient(); err != nil {
-		return errors.New("clients: error initializing vault. " + err.Error())
+	if err := InitializeStore(); err != nil {
+		return errors.New("clients: error initializing store. " + err.Error())
+	}
+
+	if err := InitializeEncryption(); err != nil {
+		return errors.New("clients: error initializing encryption. " + err.Error())
 	}
 
 	if err := VerifyHydraEndpoint(); err != nil {
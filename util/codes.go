@@ -0,0 +1,212 @@
+package util
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"gitlab.com/omnijar/arusha/config"
+)
+
+const (
+	// CodesPath has the numeric codes sent by the service, keyed by the hashes of their purposes
+	// and identifiers.
+	CodesPath = "/codes"
+
+	codeSaltBytes = 16
+)
+
+var (
+	// ErrorCodeInvalid occurs when a code is wrong, has expired, or has run out of attempts.
+	ErrorCodeInvalid = errors.New("code: invalid or expired code")
+)
+
+// codeRecord of a code sent for a purpose. Codes are short enough to be typed, so unlike tokens,
+// they're looked up by their identifier (e.g., an email), and each one only allows a few attempts.
+type codeRecord struct {
+	Token
+	Salt     string `json:"salt"`
+	Hash     string `json:"hash"`
+	Attempts int    `json:"attempts"`
+}
+
+// MintCode for the given purpose and identifier (usually an email), along with the subject and
+// value (like `MintToken`). Any previous code for the same purpose and identifier is replaced,
+// but its wrong attempts are carried over (until it would have expired), so that minting new
+// codes doesn't allow more guesses. If a transaction is given, then the code is stored through it.
+func MintCode(tx *StoreTransaction, purpose, identifier, subject, value string) (string, error) {
+	length := config.Default.EmailCodeLength
+	if length <= 0 {
+		length = config.DefaultEmailCodeLength
+	}
+
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(length)), nil)
+	number, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+
+	salt := make([]byte, codeSaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	token, err := newToken(purpose, subject, value, CodeTTL())
+	if err != nil {
+		return "", err
+	}
+
+	digits := fmt.Sprintf("%0*d", length, number.Int64())
+	record := codeRecord{Token: token, Salt: hex.EncodeToString(salt)}
+	record.Hash = hashCode(record.Salt, digits)
+
+	store := GetStore(CodesPath)
+	var previous codeRecord
+	if err := store.Get(codeKey(purpose, identifier), &previous); err == nil && time.Now().Before(previous.ExpiresAt) {
+		record.Attempts = previous.Attempts
+	} else if err != nil && err != ErrorKeyNotFound {
+		return "", err
+	}
+
+	if tx != nil {
+		return digits, tx.Set(store, codeKey(purpose, identifier), record)
+	}
+
+	return digits, store.Set(codeKey(purpose, identifier), record)
+}
+
+// CodeTTL from the configuration (or the default).
+func CodeTTL() time.Duration {
+	if config.Default.EmailCodeTTL <= 0 {
+		return config.DefaultEmailCodeTTL
+	}
+
+	return config.Default.EmailCodeTTL
+}
+
+// CheckCode for the given purpose and identifier without consuming it. Wrong codes use up one
+// of the attempts, and the code stops working once it runs out of them. It's still kept until
+// it expires, so that the attempts carry over to new codes (see `MintCode`).
+func CheckCode(purpose, identifier, digits string) (*Token, error) {
+	return verifyCode(purpose, identifier, digits, false)
+}
+
+// ConsumeCode for the given purpose and identifier. Like `ConsumeToken`, the code can only be
+// used once (even with concurrent requests).
+func ConsumeCode(purpose, identifier, digits string) (*Token, error) {
+	return verifyCode(purpose, identifier, digits, true)
+}
+
+// RevokeCode for the given purpose and identifier.
+func RevokeCode(purpose, identifier string) error {
+	return GetStore(CodesPath).Remove(codeKey(purpose, identifier))
+}
+
+// RevokeCodes matching the given function. Expired codes are removed as well. Like
+// `RevokeTokens`, the function should match values with `HasValue`.
+func RevokeCodes(matches func(token Token) bool) error {
+	store := GetStore(CodesPath)
+	keys, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		var record codeRecord
+		if err := store.Get(key, &record); err == ErrorKeyNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if matches(record.Token) || !now.Before(record.ExpiresAt) {
+			if err := store.Remove(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// PurgeExpiredCodes from the store.
+func PurgeExpiredCodes() error {
+	return RevokeCodes(func(token Token) bool { return false })
+}
+
+// verifyCode and keep it (with the updated attempts) unless it has been consumed. The code is
+// taken out of the store while it's checked, so concurrent attempts fail instead of racing
+// for the remaining attempts.
+func verifyCode(purpose, identifier, digits string, consume bool) (*Token, error) {
+	store := GetStore(CodesPath)
+	key := codeKey(purpose, identifier)
+
+	var record codeRecord
+	if err := takeValue(store, key, &record); err == ErrorKeyNotFound {
+		return nil, ErrorCodeInvalid
+	} else if err != nil {
+		return nil, err
+	}
+
+	if record.Purpose != purpose || !time.Now().Before(record.ExpiresAt) {
+		return nil, ErrorCodeInvalid
+	} else if record.Attempts >= maxCodeAttempts() {
+		return nil, putBackCode(store, key, record)
+	}
+
+	digits = strings.Replace(strings.TrimSpace(digits), " ", "", -1)
+	if subtle.ConstantTimeCompare([]byte(hashCode(record.Salt, digits)), []byte(record.Hash)) == 1 {
+		if !consume {
+			if err := store.Set(key, record); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := record.openValue(); err != nil {
+			return nil, err
+		}
+
+		return &record.Token, nil
+	}
+
+	record.Attempts++
+	return nil, putBackCode(store, key, record)
+}
+
+// putBackCode after a wrong (or exhausted) attempt, and return the error for the attempt.
+func putBackCode(store Store, key string, record codeRecord) error {
+	if err := store.Set(key, record); err != nil {
+		return err
+	}
+
+	return ErrorCodeInvalid
+}
+
+// maxCodeAttempts from the configuration (or the default).
+func maxCodeAttempts() int {
+	if config.Default.EmailCodeAttempts <= 0 {
+		return config.DefaultEmailCodeAttempts
+	}
+
+	return config.Default.EmailCodeAttempts
+}
+
+// codeKey for the given purpose and identifier, so that identifiers aren't stored in plain text.
+// This is a blind index, so that identifiers cannot be guessed from the keys (once encryption
+// is enabled).
+func codeKey(purpose, identifier string) string {
+	return BlindIndex(purpose + "\x00" + strings.ToLower(identifier))
+}
+
+// hashCode along with its salt. Codes have little entropy, so this only keeps them from being
+// read off the store - the attempts and the TTL are what protect them.
+func hashCode(salt, digits string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(salt+digits)))
+}
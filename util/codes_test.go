@@ -0,0 +1,61 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/omnijar/arusha/config"
+)
+
+func TestCodes(t *testing.T) {
+	config.Default.DatabaseURL = StoreMemory
+	require.NoError(t, InitializeStore())
+	config.Default.EmailCodeLength, config.Default.EmailCodeAttempts = 8, 3
+	defer func() { config.Default.EmailCodeLength, config.Default.EmailCodeAttempts = 0, 0 }()
+
+	code, err := MintCode(nil, TokenPurposeVerifyEmail, "codes@example.com", "CODES", "codes@example.com")
+	require.NoError(t, err)
+	assert.Len(t, code, 8)
+
+	// Neither the code nor the identifier is stored in plain text.
+	keys, err := GetStore(CodesPath).List()
+	require.NoError(t, err)
+	assert.Equal(t, []string{codeKey(TokenPurposeVerifyEmail, "codes@example.com")}, keys)
+	var record codeRecord
+	require.NoError(t, GetStore(CodesPath).Get(keys[0], &record))
+	assert.NotEqual(t, code, record.Hash)
+
+	_, err = CheckCode(TokenPurposeResetSecret, "codes@example.com", code)
+	assert.Equal(t, ErrorCodeInvalid, err)
+	found, err := CheckCode(TokenPurposeVerifyEmail, "Codes@example.com", code)
+	require.NoError(t, err)
+	assert.Equal(t, "CODES", found.Subject)
+	_, err = ConsumeCode(TokenPurposeVerifyEmail, "codes@example.com", code)
+	require.NoError(t, err)
+	_, err = CheckCode(TokenPurposeVerifyEmail, "codes@example.com", code)
+	assert.Equal(t, ErrorCodeInvalid, err, "codes shouldn't be used twice")
+
+	// Codes stop working after too many wrong attempts, even if they're minted again.
+	code, err = MintCode(nil, TokenPurposeVerifyEmail, "codes@example.com", "CODES", "codes@example.com")
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = CheckCode(TokenPurposeVerifyEmail, "codes@example.com", "x")
+		assert.Equal(t, ErrorCodeInvalid, err)
+	}
+
+	_, err = CheckCode(TokenPurposeVerifyEmail, "codes@example.com", code)
+	assert.Equal(t, ErrorCodeInvalid, err)
+	code, err = MintCode(nil, TokenPurposeVerifyEmail, "codes@example.com", "CODES", "codes@example.com")
+	require.NoError(t, err)
+	_, err = CheckCode(TokenPurposeVerifyEmail, "codes@example.com", code)
+	assert.Equal(t, ErrorCodeInvalid, err)
+
+	// Codes are purged along with their subjects.
+	_, err = MintCode(nil, TokenPurposeVerifyEmail, "codes@example.com", "CODES", "codes@example.com")
+	require.NoError(t, err)
+	require.NoError(t, RevokeCodes(func(token Token) bool { return token.Subject == "CODES" }))
+	keys, err = GetStore(CodesPath).List()
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
@@ -0,0 +1,245 @@
+package util
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+
+	// Database drivers supported by Arusha.
+	"github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	// DriverPostgres is the driver name for PostgreSQL databases.
+	DriverPostgres = "postgres"
+	// DriverSQLite is the driver name for SQLite databases (useful for local setup).
+	DriverSQLite = "sqlite3"
+)
+
+var (
+	// ErrorDatabase occurs when a database query fails.
+	ErrorDatabase = errors.New("database: error performing query")
+
+	database       *sql.DB
+	databaseDriver string
+)
+
+// IsDatabaseURL checks whether the given URL refers to a SQL database.
+func IsDatabaseURL(url string) bool {
+	driver, _ := parseDatabaseURL(url)
+	return driver != ""
+}
+
+// parseDatabaseURL into the driver name and the data source name for that driver.
+func parseDatabaseURL(url string) (string, string) {
+	parts := strings.SplitN(url, "://", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+
+	switch parts[0] {
+	case "postgres", "postgresql":
+		return DriverPostgres, url
+	case "sqlite", "sqlite3":
+		return DriverSQLite, parts[1]
+	default:
+		return "", ""
+	}
+}
+
+// InitializeDatabase connects to the SQL database in the given URL. This doesn't check
+// the schema version, see `CheckSchemaVersion` for that.
+func InitializeDatabase(url string) error {
+	driver, source := parseDatabaseURL(url)
+	if driver == "" {
+		return errors.New("database: unsupported database URL")
+	}
+
+	db, err := sql.Open(driver, source)
+	if err != nil {
+		return errors.New("database: error opening database. " + err.Error())
+	}
+
+	if err = db.Ping(); err != nil {
+		return errors.New("database: error connecting to database. " + err.Error())
+	}
+
+	database = db
+	databaseDriver = driver
+	log.Printf("database: connected to %s database", driver)
+	return nil
+}
+
+// CloseDatabase closes the connection to the SQL database (if any).
+func CloseDatabase() error {
+	if database == nil {
+		return nil
+	}
+
+	err := database.Close()
+	database = nil
+	databaseDriver = ""
+	return err
+}
+
+// GetDatabase returns the SQL database and its driver name (if Arusha has been
+// configured to use one).
+func GetDatabase() (*sql.DB, string) {
+	return database, databaseDriver
+}
+
+// IsUniqueViolation checks whether the given error comes from a query violating a unique
+// constraint of the database.
+func IsUniqueViolation(err error) bool {
+	if pqErr, ok := err.(*pq.Error); ok {
+		return pqErr.Code == "23505" // unique_violation
+	}
+
+	return isSQLiteUniqueViolation(err)
+}
+
+// RebindQuery replaces the `?` placeholders in a query with the ones supported
+// by the given driver.
+func RebindQuery(driver, query string) string {
+	if driver != DriverPostgres {
+		return query
+	}
+
+	var builder strings.Builder
+	idx := 0
+	for _, char := range query {
+		if char == '?' {
+			idx++
+			builder.WriteString("$" + strconv.Itoa(idx))
+			continue
+		}
+
+		builder.WriteRune(char)
+	}
+
+	return builder.String()
+}
+
+// SQLStore for storing values in a SQL database. Values are stored in their JSON form.
+type SQLStore struct {
+	path   string
+	db     *sql.DB
+	driver string
+}
+
+// Set value for a given key.
+func (s *SQLStore) Set(key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	query := RebindQuery(s.driver, `INSERT INTO arusha_store (path, name, value) VALUES (?, ?, ?)
+		ON CONFLICT (path, name) DO UPDATE SET value = excluded.value`)
+	if _, err = s.db.Exec(query, s.path, key, string(data)); err != nil {
+		log.Println("database: Failed to write key " + key + ": " + err.Error())
+		return errors.New("database: error writing value for key")
+	}
+
+	return nil
+}
+
+// Get the value for a key.
+func (s *SQLStore) Get(key string, value interface{}) error {
+	var data string
+	query := RebindQuery(s.driver, `SELECT value FROM arusha_store WHERE path = ? AND name = ?`)
+	err := s.db.QueryRow(query, s.path, key).Scan(&data)
+	if err == sql.ErrNoRows {
+		return ErrorKeyNotFound
+	} else if err != nil {
+		log.Println("database: Failed to fetch value for key " + key + ": " + err.Error())
+		return errors.New("database: error reading value for key")
+	}
+
+	return json.Unmarshal([]byte(data), value)
+}
+
+// Remove the value corresponding to a key.
+func (s *SQLStore) Remove(key string) error {
+	query := RebindQuery(s.driver, `DELETE FROM arusha_store WHERE path = ? AND name = ?`)
+	if _, err := s.db.Exec(query, s.path, key); err != nil {
+		log.Println("database: Error removing value for key " + key + ": " + err.Error())
+		return errors.New("database: error removing value for key")
+	}
+
+	return nil
+}
+
+// Take the value for a key and remove it. If the key is removed concurrently, then only one
+// of the callers gets the value.
+func (s *SQLStore) Take(key string, value interface{}) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.New("database: error taking value for key")
+	}
+
+	defer tx.Rollback()
+
+	var data string
+	query := RebindQuery(s.driver, `SELECT value FROM arusha_store WHERE path = ? AND name = ?`)
+	if err := tx.QueryRow(query, s.path, key).Scan(&data); err == sql.ErrNoRows {
+		return ErrorKeyNotFound
+	} else if err != nil {
+		log.Println("database: Failed to fetch value for key " + key + ": " + err.Error())
+		return errors.New("database: error taking value for key")
+	}
+
+	query = RebindQuery(s.driver, `DELETE FROM arusha_store WHERE path = ? AND name = ?`)
+	result, err := tx.Exec(query, s.path, key)
+	if err != nil {
+		log.Println("database: Error removing value for key " + key + ": " + err.Error())
+		return errors.New("database: error taking value for key")
+	}
+
+	if removed, err := result.RowsAffected(); err != nil || removed == 0 {
+		return ErrorKeyNotFound
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.New("database: error taking value for key")
+	}
+
+	return json.Unmarshal([]byte(data), value)
+}
+
+// List the keys under this store's path.
+func (s *SQLStore) List() ([]string, error) {
+	query := RebindQuery(s.driver, `SELECT name FROM arusha_store WHERE path = ? ORDER BY name`)
+	rows, err := s.db.Query(query, s.path)
+	if err != nil {
+		log.Println("database: Error listing keys for " + s.path + ": " + err.Error())
+		return nil, errors.New("database: error listing keys")
+	}
+
+	defer rows.Close()
+
+	keys := *new([]string)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// GetSQLStore for the given path.
+func GetSQLStore(path string) *SQLStore {
+	return &SQLStore{
+		path:   rootPath + path,
+		db:     database,
+		driver: databaseDriver,
+	}
+}
@@ -0,0 +1,13 @@
+//go:build cgo
+// +build cgo
+
+package util
+
+import sqlite3 "github.com/mattn/go-sqlite3"
+
+// isSQLiteUniqueViolation checks whether the given error is a unique constraint failure of SQLite.
+func isSQLiteUniqueViolation(err error) bool {
+	sqliteErr, ok := err.(sqlite3.Error)
+	return ok && (sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+		sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+}
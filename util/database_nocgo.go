@@ -0,0 +1,9 @@
+//go:build !cgo
+// +build !cgo
+
+package util
+
+// isSQLiteUniqueViolation always fails, since SQLite is only supported in builds with cgo enabled.
+func isSQLiteUniqueViolation(err error) bool {
+	return false
+}
@@ -40,43 +40,71 @@ func InitializeMailgunClient() error {
 }
 
 // SendVerificationMail with the given token (added to the configured URL as query parameter)
+// and code to the the given mail.
+func SendVerificationMail(recipient, token, code string) {
+	link := mailLink(config.Default.EmailVerificationURL, url.Values{"verify": {token}})
+	body := fmt.Sprintf("Hi! To complete your registration process, please click on this link - %s "+
+		"(or enter the code %s within %s).", link, code, CodeTTL())
+	sendMail(recipient, "Please verify your account", body)
+}
+
+// SendSecretResetMail with the given token (added to the configured URL as query parameter)
 // to the the given mail.
-func SendVerificationMail(recipient, token string) {
-	u, _ := url.Parse(config.Default.EmailVerificationURL)
-	q := u.Query()
-	q.Add("verify", token)
-	u.RawQuery = q.Encode()
+func SendSecretResetMail(recipient, token string) {
+	link := mailLink(config.Default.TokenVerificationURL, url.Values{"verify": {token}})
+	body := fmt.Sprintf("Hi! To reset the password of your account, please click on this link - %s", link)
+	sendMail(recipient, "[Password reset]", body)
+}
 
-	fmt.Println("Verification link:", u.String())
+// SendLoginLinkMail with the given token and login challenge (added to the configured URL as
+// query parameters) and code to the the given mail.
+func SendLoginLinkMail(recipient, token, code, loginChallenge string) {
+	link := mailLink(config.Default.LoginLinkURL, url.Values{"verify": {token}, "login_challenge": {loginChallenge}})
 
-	sender := "postmaster@" + mailgunDomain
-	subject := "Please verify your account"
-	body := fmt.Sprintf("Hi! To complete your registration process, please click on this link - %s", u.String())
+	body := fmt.Sprintf("Hi! To log in to your account, please click on this link - %s (or enter the code %s "+
+		"within %s). If you didn't try to log in, you can ignore this mail.", link, code, CodeTTL())
+	sendMail(recipient, "[Login link]", body)
+}
 
-	message := mailgunClient.NewMessage(sender, subject, body, recipient)
-	_, _, err := mailgunClient.Send(message)
-	if err != nil {
-		log.Printf("Error sending mail: %s", err.Error())
-	}
+// SendSecretChangedMail to the given mail, after the user has changed their secret.
+func SendSecretChangedMail(recipient string) {
+	body := "Hi! The password of your account has just been changed, and you have been logged out everywhere. " +
+		"If this wasn't you, please reset your password and contact support."
+	sendMail(recipient, "[Password changed]", body)
 }
 
-// SendSecretResetMail with the given token (added to the configured URL as query parameter)
-// to the the given mail.
-func SendSecretResetMail(recipient, token string) {
-	u, _ := url.Parse(config.Default.TokenVerificationURL)
+// SendRecoveryCodeUsedMail to the given mail, after one of the user's recovery codes has been
+// used for logging in.
+func SendRecoveryCodeUsedMail(recipient string, remaining int) {
+	body := fmt.Sprintf("Hi! One of your recovery codes has just been used to log in to your account, "+
+		"and you have %d left. If this wasn't you, please reset your password and contact support.", remaining)
+	sendMail(recipient, "[Recovery code used]", body)
+}
+
+// mailLink with the given parameters added to the URL query.
+func mailLink(base string, params url.Values) string {
+	u, _ := url.Parse(base)
 	q := u.Query()
-	q.Add("verify", token)
-	u.RawQuery = q.Encode()
+	for key, values := range params {
+		for _, value := range values {
+			q.Add(key, value)
+		}
+	}
 
-	fmt.Println("Verification link:", u.String())
+	u.RawQuery = q.Encode()
+	return u.String()
+}
 
-	sender := "postmaster@" + mailgunDomain
-	subject := "[Password reset]"
-	body := fmt.Sprintf("Hi! To reset the password of your account, please click on this link - %s", u.String())
+// sendMail through Mailgun. If the client hasn't been initialized (e.g., in tests), then the
+// mail is only logged.
+func sendMail(recipient, subject, body string) {
+	if mailgunClient == nil {
+		log.Printf("Mailgun client not initialized, skipping mail %q to %s", subject, recipient)
+		return
+	}
 
-	message := mailgunClient.NewMessage(sender, subject, body, recipient)
-	_, _, err := mailgunClient.Send(message)
-	if err != nil {
+	message := mailgunClient.NewMessage("postmaster@"+mailgunDomain, subject, body, recipient)
+	if _, _, err := mailgunClient.Send(message); err != nil {
 		log.Printf("Error sending mail: %s", err.Error())
 	}
 }
@@ -0,0 +1,429 @@
+package util
+
+import (
+	"container/list"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gitlab.com/omnijar/arusha/config"
+)
+
+const (
+	// KeyProviderFile is the prefix of the encryption key setting for using a local key file.
+	KeyProviderFile = "file:"
+	// KeyProviderVaultTransit is the prefix of the encryption key setting for using a key in
+	// Vault's transit engine.
+	KeyProviderVaultTransit = "vault-transit:"
+
+	encryptionPath  = "/encryption"
+	indexKeyName    = "index-key"
+	dataKeySize     = 32
+	vaultTransitAPI = "transit"
+	// dataKeyCacheSize is the number of unwrapped data keys kept in memory, so that going through
+	// many records (e.g., when searching users) doesn't unwrap each key with Vault every time.
+	dataKeyCacheSize = 10000
+)
+
+var (
+	// ErrorEncryptionNotInitialized occurs when encryption is used without a key.
+	ErrorEncryptionNotInitialized = errors.New("encryption: not initialized")
+	// ErrorDecryption occurs when the data (or its key) cannot be decrypted.
+	ErrorDecryption = errors.New("encryption: error decrypting data")
+
+	keyEncryptionKey KeyEncryptionKey
+	blindIndexKey    []byte
+	dataKeys         = newDataKeyCache(dataKeyCacheSize)
+)
+
+// KeyEncryptionKey wraps (encrypts) and unwraps the data keys used for encrypting data.
+// Wrapped keys carry the version of the key which wrapped them, so that keys can be rotated
+// without breaking older data.
+type KeyEncryptionKey interface {
+	// Wrap the data key with the current version of the key.
+	Wrap(dataKey []byte) (string, error)
+	// Unwrap a data key wrapped by any version of the key.
+	Unwrap(wrapped string) ([]byte, error)
+}
+
+// SealedData is encrypted with its own data key, which is stored (wrapped) along with it.
+type SealedData struct {
+	Key  string `json:"key"`
+	Data string `json:"data"`
+}
+
+// InitializeEncryption with the configured key (if any). This also loads the key for blind
+// indexes (or creates one, on first use), so the store should be initialized first.
+func InitializeEncryption() error {
+	keyEncryptionKey = nil
+	blindIndexKey = nil
+	dataKeys = newDataKeyCache(dataKeyCacheSize)
+
+	setting := config.Default.EncryptionKey
+	switch {
+	case setting == "":
+		return nil
+	case strings.HasPrefix(setting, KeyProviderFile):
+		key, err := loadFileKey(strings.TrimPrefix(setting, KeyProviderFile))
+		if err != nil {
+			return err
+		}
+
+		keyEncryptionKey = key
+	case strings.HasPrefix(setting, KeyProviderVaultTransit):
+		if vaultClient == nil {
+			if err := InitializeVaultClient(); err != nil {
+				return err
+			}
+		}
+
+		keyEncryptionKey = &vaultTransitKey{name: strings.TrimPrefix(setting, KeyProviderVaultTransit)}
+	default:
+		return errors.New("encryption: unknown key provider in " + config.EnvEncryptionKey)
+	}
+
+	var err error
+	if blindIndexKey, err = loadBlindIndexKey(); err != nil {
+		keyEncryptionKey = nil
+		return err
+	}
+
+	log.Println("encryption: enabled for user data")
+	return nil
+}
+
+// IsEncryptionEnabled checks whether a key has been configured for encrypting data.
+func IsEncryptionEnabled() bool {
+	return keyEncryptionKey != nil
+}
+
+// Seal the data with a new data key.
+func Seal(plaintext []byte) (*SealedData, error) {
+	if keyEncryptionKey == nil {
+		return nil, ErrorEncryptionNotInitialized
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := encryptWithKey(dataKey, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := keyEncryptionKey.Wrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKeys.add(wrapped, dataKey)
+	return &SealedData{Key: wrapped, Data: base64.StdEncoding.EncodeToString(ciphertext)}, nil
+}
+
+// Open the sealed data.
+func Open(sealed SealedData) ([]byte, error) {
+	if keyEncryptionKey == nil {
+		return nil, ErrorEncryptionNotInitialized
+	}
+
+	dataKey, cached := dataKeys.get(sealed.Key)
+	if !cached {
+		var err error
+		if dataKey, err = keyEncryptionKey.Unwrap(sealed.Key); err != nil {
+			return nil, err
+		}
+
+		dataKeys.add(sealed.Key, dataKey)
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(sealed.Data)
+	if err != nil {
+		return nil, ErrorDecryption
+	}
+
+	return decryptWithKey(dataKey, ciphertext)
+}
+
+// BlindIndex of a value, for looking up encrypted data. This is a keyed hash (HMAC-SHA256),
+// so it cannot be reversed (or computed) without the key.
+func BlindIndex(value string) string {
+	mac := hmac.New(sha256.New, blindIndexKey)
+	mac.Write([]byte(value))
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+// RewrapBlindIndexKey with the current version of the key encryption key (after rotation).
+func RewrapBlindIndexKey() error {
+	if keyEncryptionKey == nil {
+		return ErrorEncryptionNotInitialized
+	}
+
+	wrapped, err := keyEncryptionKey.Wrap(blindIndexKey)
+	if err != nil {
+		return err
+	}
+
+	return GetStore(encryptionPath).Set(indexKeyName, wrapped)
+}
+
+// loadBlindIndexKey from the store, or create one if it doesn't exist. The key is wrapped
+// by the key encryption key, and it never changes (otherwise the indexes would break).
+func loadBlindIndexKey() ([]byte, error) {
+	store := GetStore(encryptionPath)
+
+	var wrapped string
+	if err := store.Get(indexKeyName, &wrapped); err == nil {
+		return keyEncryptionKey.Unwrap(wrapped)
+	} else if err != ErrorKeyNotFound {
+		return nil, err
+	}
+
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	wrapped, err := keyEncryptionKey.Wrap(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := store.Set(indexKeyName, wrapped); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// encryptWithKey using AES-GCM. The nonce is prepended to the ciphertext.
+func encryptWithKey(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decryptWithKey the data encrypted by `encryptWithKey`.
+func decryptWithKey(key, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrorDecryption
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil || len(ciphertext) < aead.NonceSize() {
+		return nil, ErrorDecryption
+	}
+
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrorDecryption
+	}
+
+	return plaintext, nil
+}
+
+// fileKey has the versions of a key loaded from a local file. Each line in the file has a
+// version and a base64-encoded 256-bit key (`<version>:<key>`), and the latest version is
+// used for wrapping. Keys are rotated by adding a line with a new version.
+type fileKey struct {
+	keys    map[int][]byte
+	current int
+}
+
+func loadFileKey(path string) (*fileKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("encryption: cannot read key file: " + err.Error())
+	}
+
+	key := &fileKey{keys: make(map[int][]byte)}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		version, err := strconv.Atoi(parts[0])
+		if len(parts) != 2 || err != nil || version <= 0 {
+			return nil, errors.New("encryption: invalid line in key file (expected '<version>:<key>')")
+		}
+
+		value, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(value) != dataKeySize {
+			return nil, fmt.Errorf("encryption: key version %d should be a base64-encoded 256-bit key", version)
+		}
+
+		key.keys[version] = value
+		if version > key.current {
+			key.current = version
+		}
+	}
+
+	if key.current == 0 {
+		return nil, errors.New("encryption: key file doesn't have any keys")
+	}
+
+	return key, nil
+}
+
+// Wrap the data key with the latest version.
+func (k *fileKey) Wrap(dataKey []byte) (string, error) {
+	ciphertext, err := encryptWithKey(k.keys[k.current], dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("file:v%d:%s", k.current, base64.StdEncoding.EncodeToString(ciphertext)), nil
+}
+
+// Unwrap the data key with the version which wrapped it.
+func (k *fileKey) Unwrap(wrapped string) ([]byte, error) {
+	parts := strings.SplitN(wrapped, ":", 3)
+	if len(parts) != 3 || parts[0] != "file" || !strings.HasPrefix(parts[1], "v") {
+		return nil, ErrorDecryption
+	}
+
+	version, err := strconv.Atoi(parts[1][1:])
+	if err != nil {
+		return nil, ErrorDecryption
+	}
+
+	key, exists := k.keys[version]
+	if !exists {
+		return nil, fmt.Errorf("encryption: key version %d doesn't exist in key file", version)
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrorDecryption
+	}
+
+	return decryptWithKey(key, ciphertext)
+}
+
+// vaultTransitKey uses a named key in Vault's transit engine. Vault keeps the versions of
+// the key (and adds them to the ciphertext), so keys are rotated in Vault.
+type vaultTransitKey struct {
+	name string
+}
+
+// Wrap the data key with the latest version of the key in Vault.
+func (k *vaultTransitKey) Wrap(dataKey []byte) (string, error) {
+	secret, err := vaultClient.Logical().Write(vaultTransitAPI+"/encrypt/"+k.name, map[string]interface{}{
+		"plaintext": base64.StdEncoding.EncodeToString(dataKey),
+	})
+
+	if err != nil || secret == nil {
+		log.Printf("vault: error encrypting with transit key %s: %v", k.name, err)
+		return "", errors.New("encryption: error wrapping data key")
+	}
+
+	ciphertext, ok := secret.Data["ciphertext"].(string)
+	if !ok {
+		return "", errors.New("encryption: error wrapping data key")
+	}
+
+	return ciphertext, nil
+}
+
+// Unwrap the data key with Vault.
+func (k *vaultTransitKey) Unwrap(wrapped string) ([]byte, error) {
+	secret, err := vaultClient.Logical().Write(vaultTransitAPI+"/decrypt/"+k.name, map[string]interface{}{
+		"ciphertext": wrapped,
+	})
+
+	if err != nil || secret == nil {
+		log.Printf("vault: error decrypting with transit key %s: %v", k.name, err)
+		return nil, ErrorDecryption
+	}
+
+	plaintext, ok := secret.Data["plaintext"].(string)
+	if !ok {
+		return nil, ErrorDecryption
+	}
+
+	dataKey, err := base64.StdEncoding.DecodeString(plaintext)
+	if err != nil {
+		return nil, ErrorDecryption
+	}
+
+	return dataKey, nil
+}
+
+// dataKeyCache keeps the recently used data keys (keyed by their wrapped forms), and drops the
+// least recently used ones beyond its size.
+type dataKeyCache struct {
+	lock    sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// dataKeyEntry in the cache's order.
+type dataKeyEntry struct {
+	wrapped string
+	key     []byte
+}
+
+// newDataKeyCache with the given size.
+func newDataKeyCache(size int) *dataKeyCache {
+	return &dataKeyCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get the data key for the wrapped one (if it's in the cache).
+func (c *dataKeyCache) get(wrapped string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, exists := c.entries[wrapped]
+	if !exists {
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	return element.Value.(*dataKeyEntry).key, true
+}
+
+// add the data key for the wrapped one.
+func (c *dataKeyCache) add(wrapped string, key []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, exists := c.entries[wrapped]; exists {
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[wrapped] = c.order.PushFront(&dataKeyEntry{wrapped: wrapped, key: key})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dataKeyEntry).wrapped)
+	}
+}
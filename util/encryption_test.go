@@ -0,0 +1,173 @@
+package util
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/omnijar/arusha/config"
+)
+
+// writeKeyFile with the given versions of keys.
+func writeKeyFile(t *testing.T, path string, keys map[int][]byte) {
+	contents := "# Arusha encryption keys\n"
+	for version, key := range keys {
+		contents += fmt.Sprintf("%d:%s\n", version, base64.StdEncoding.EncodeToString(key))
+	}
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0600))
+}
+
+// newKey returns a random 256-bit key.
+func newKey(t *testing.T) []byte {
+	key := make([]byte, dataKeySize)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return key
+}
+
+func TestEncryptionWithKeyFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "arusha-key")
+	require.NoError(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	config.Default.DatabaseURL = StoreMemory
+	require.NoError(t, InitializeStore())
+	defer func() {
+		config.Default.EncryptionKey = ""
+		InitializeEncryption()
+	}()
+
+	config.Default.EncryptionKey = ""
+	require.NoError(t, InitializeEncryption())
+	assert.False(t, IsEncryptionEnabled())
+	_, err = Seal([]byte("foo"))
+	assert.Equal(t, ErrorEncryptionNotInitialized, err)
+
+	keys := map[int][]byte{1: newKey(t)}
+	writeKeyFile(t, file.Name(), keys)
+	config.Default.EncryptionKey = KeyProviderFile + file.Name()
+	require.NoError(t, InitializeEncryption())
+	assert.True(t, IsEncryptionEnabled())
+
+	sealed, err := Seal([]byte("foo@example.com"))
+	require.NoError(t, err)
+	assert.NotContains(t, sealed.Data, "foo")
+	index := BlindIndex("foo@example.com")
+	assert.NotEqual(t, index, BlindIndex("bar@example.com"))
+
+	// Rotating the key keeps the older data (and the blind indexes) working.
+	keys[2] = newKey(t)
+	writeKeyFile(t, file.Name(), keys)
+	require.NoError(t, InitializeEncryption())
+	plaintext, err := Open(*sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "foo@example.com", string(plaintext))
+	assert.Equal(t, index, BlindIndex("foo@example.com"))
+
+	rotated, err := Seal(plaintext)
+	require.NoError(t, err)
+	assert.Contains(t, rotated.Key, "file:v2:")
+	require.NoError(t, RewrapBlindIndexKey())
+
+	tampered := *rotated
+	tampered.Data = sealed.Data
+	_, err = Open(tampered)
+	assert.Equal(t, ErrorDecryption, err)
+
+	// Once the older data has been rewrapped, the older version can be removed.
+	delete(keys, 1)
+	writeKeyFile(t, file.Name(), keys)
+	require.NoError(t, InitializeEncryption())
+	assert.Equal(t, index, BlindIndex("foo@example.com"))
+	_, err = Open(*rotated)
+	assert.NoError(t, err)
+	_, err = Open(*sealed)
+	assert.Error(t, err)
+
+	config.Default.EncryptionKey = "foo:bar"
+	assert.Error(t, InitializeEncryption())
+	assert.False(t, IsEncryptionEnabled())
+}
+
+func TestEncryptedTokens(t *testing.T) {
+	file, err := ioutil.TempFile("", "arusha-key")
+	require.NoError(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	config.Default.DatabaseURL = StoreMemory
+	require.NoError(t, InitializeStore())
+	defer func() {
+		config.Default.EncryptionKey = ""
+		InitializeEncryption()
+	}()
+
+	// The blind index key from other tests is wrapped with another key.
+	require.NoError(t, GetStore(encryptionPath).Remove(indexKeyName))
+	writeKeyFile(t, file.Name(), map[int][]byte{1: newKey(t)})
+	config.Default.EncryptionKey = KeyProviderFile + file.Name()
+	require.NoError(t, InitializeEncryption())
+
+	// Values are sealed in the store, and opened when the tokens are used.
+	token, err := MintToken(nil, TokenPurposeVerifyEmail, "SEALED", "sealed@example.com")
+	require.NoError(t, err)
+	var record Token
+	require.NoError(t, GetStore(TokensPath).Get(hashToken(token), &record))
+	assert.Empty(t, record.Value)
+	assert.NotContains(t, record.SealedValue.Data, "sealed")
+	assert.True(t, record.HasValue("sealed@example.com"))
+	assert.False(t, record.HasValue("other@example.com"))
+
+	found, err := ConsumeToken(TokenPurposeVerifyEmail, token)
+	require.NoError(t, err)
+	assert.Equal(t, "sealed@example.com", found.Value)
+
+	// Codes are keyed by the blind index of their identifiers.
+	code, err := MintCode(nil, TokenPurposeVerifyEmail, "sealed@example.com", "SEALED", "sealed@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, BlindIndex(TokenPurposeVerifyEmail+"\x00sealed@example.com"), codeKey(TokenPurposeVerifyEmail, "Sealed@example.com"))
+	found, err = ConsumeCode(TokenPurposeVerifyEmail, "sealed@example.com", code)
+	require.NoError(t, err)
+	assert.Equal(t, "sealed@example.com", found.Value)
+}
+
+// countingKey counts the data keys unwrapped by the key it wraps.
+type countingKey struct {
+	KeyEncryptionKey
+	unwrapped int
+}
+
+func (k *countingKey) Unwrap(wrapped string) ([]byte, error) {
+	k.unwrapped++
+	return k.KeyEncryptionKey.Unwrap(wrapped)
+}
+
+func TestDataKeyCache(t *testing.T) {
+	key := &fileKey{keys: map[int][]byte{1: newKey(t)}, current: 1}
+	counting := &countingKey{KeyEncryptionKey: key}
+	keyEncryptionKey, dataKeys = counting, newDataKeyCache(2)
+	defer func() { keyEncryptionKey, dataKeys = nil, newDataKeyCache(dataKeyCacheSize) }()
+
+	sealed := make([]*SealedData, 3)
+	for i := range sealed {
+		var err error
+		sealed[i], err = Seal([]byte(fmt.Sprintf("user-%d@example.com", i)))
+		require.NoError(t, err)
+	}
+
+	// Only the least recently used keys are unwrapped again.
+	for _, i := range []int{2, 1, 0, 0, 1} {
+		plaintext, err := Open(*sealed[i])
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("user-%d@example.com", i), string(plaintext))
+	}
+
+	assert.Equal(t, 1, counting.unwrapped)
+}
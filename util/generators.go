@@ -14,7 +14,8 @@ func GenerateRandomUUID() string {
 	return uuid.New().String()
 }
 
-// GenerateRandomToken generates a random alphanumeric token.
+// GenerateRandomToken generates a random alphanumeric token (see `MintToken` for tokens sent
+// to users).
 func GenerateRandomToken() string {
 	return RandomAlphaNumeric(TokenLength)
 }
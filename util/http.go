@@ -3,9 +3,13 @@ package util
 import (
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
+	"gitlab.com/omnijar/arusha/config"
 )
 
 var (
@@ -21,6 +25,10 @@ var (
 	ErrorMissingToken = errors.New("missing access token for resource")
 	// ErrorRBACNotInitialized for uninitialized Keto.
 	ErrorRBACNotInitialized = errors.New("access control engine not initialized")
+	// ErrorPreconditionFailed occurs when the resource has been modified since it was fetched.
+	ErrorPreconditionFailed = errors.New("resource has been modified. please fetch it again")
+	// ErrorInvalidIfMatch for malformed If-Match headers.
+	ErrorInvalidIfMatch = errors.New("invalid If-Match header")
 )
 
 // RespondMissingQueryParameterError for a request.
@@ -38,6 +46,97 @@ func RespondHTTPError(w http.ResponseWriter, err error, code int) {
 	http.Error(w, fmt.Sprintf(`{"status": "error", "message": "%s"}`, err.Error()), code)
 }
 
+// ClientAddress of the request. Arusha runs behind a proxy, which sets the X-Real-IP header
+// (see deploy/nginx), so the header is preferred over the address of the connection - but only
+// when the connection comes from a trusted proxy, as anyone else could set it.
+func ClientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !isTrustedProxy(host) {
+		return host
+	}
+
+	if address := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); address != nil {
+		return address.String()
+	}
+
+	return host
+}
+
+// isTrustedProxy checks whether the address belongs to one of the configured trusted proxies.
+func isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range config.Default.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// BearerToken in the Authorization header of the request (or an empty string, if it's missing).
+func BearerToken(r *http.Request) string {
+	token := r.Header.Get("Authorization")
+	if len(token) > 7 && strings.EqualFold(token[:7], "Bearer ") {
+		return token[7:]
+	}
+
+	return ""
+}
+
 // PassEmptyBody for the specified route.
 func PassEmptyBody(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 }
+
+// SetETag header for the given version of a resource.
+func SetETag(w http.ResponseWriter, version int) {
+	w.Header().Set("ETag", fmt.Sprintf(`"%d"`, version))
+}
+
+// ParseIfMatch gets the version of a resource from the If-Match header in the request.
+// If the header is missing (or matches any version), then this returns nil.
+func ParseIfMatch(r *http.Request) (*int, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return nil, nil
+	}
+
+	version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(header, "W/"), `"`))
+	if err != nil {
+		return nil, ErrorInvalidIfMatch
+	}
+
+	return &version, nil
+}
+
+// CheckVersion of a resource against the expected version (if any).
+//
+// NOTE: Neither the store nor Keto supports conditional writes, so checking the version before
+// writing only narrows the window for concurrent modifications - another write can still land
+// between the check and the write. Only the SQL backend of users checks the version atomically.
+func CheckVersion(expected *int, current int) error {
+	if expected != nil && *expected != current {
+		return ErrorPreconditionFailed
+	}
+
+	return nil
+}
+
+// StatusCodeForError returns the HTTP status code for common errors, or the given
+// default code.
+func StatusCodeForError(err error, code int) int {
+	switch err {
+	case ErrorPreconditionFailed:
+		return http.StatusPreconditionFailed
+	default:
+		return code
+	}
+}
@@ -0,0 +1,32 @@
+package util
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/omnijar/arusha/config"
+)
+
+func TestClientAddress(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	defer func() { config.Default.TrustedProxies = nil }()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.2:4321"
+	r.Header.Set("X-Real-IP", "203.0.113.7")
+
+	// The header is ignored unless the connection comes from a trusted proxy.
+	assert.Equal(t, "10.0.0.2", ClientAddress(r))
+
+	config.Default.TrustedProxies = []*net.IPNet{proxies}
+	assert.Equal(t, "203.0.113.7", ClientAddress(r))
+
+	r.Header.Set("X-Real-IP", "not an address")
+	assert.Equal(t, "10.0.0.2", ClientAddress(r))
+
+	r.RemoteAddr = "198.51.100.1:4321"
+	r.Header.Set("X-Real-IP", "203.0.113.7")
+	assert.Equal(t, "198.51.100.1", ClientAddress(r))
+}
@@ -3,10 +3,13 @@ package util
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/ory/hydra/sdk/go/hydra"
 	hydraAPI "github.com/ory/hydra/sdk/go/hydra/swagger"
@@ -19,9 +22,12 @@ const (
 	EnvHydraPublicURL = "HYDRA_PUBLIC_URL"
 	// EnvHydraPrivateURL for setting hydra's internal URL.
 	EnvHydraPrivateURL = "HYDRA_PRIVATE_URL"
-	// SessionPeriodSeconds to remember a login.
-	// FIXME: Move this to command.
-	SessionPeriodSeconds = 8 * 3600
+	// ACRSingleFactor is the `acr` value of logins with a single factor (e.g., the secret).
+	ACRSingleFactor = "arusha:1fa"
+	// ACRMultiFactor is the `acr` value of logins which have been verified with a second factor.
+	ACRMultiFactor = "arusha:mfa"
+
+	rootClientID = "arusha-root"
 )
 
 var (
@@ -53,16 +59,55 @@ func VerifyHydraEndpoint() error {
 	return err
 }
 
-// InitializeRootHydraClient for use by controller.
-func InitializeRootHydraClient(scopes []string) error {
+// InitializeRootHydraClient for use by controller. This replaces the existing client (if any),
+// with the given secret (or a new one, if it's empty), and returns the secret so that other
+// hosts can load the client later (see `LoadRootHydraClient`). Replacing the client breaks the
+// hosts using its previous secret, so this should only be done when initializing the scopes.
+func InitializeRootHydraClient(scopes []string, secret string) (string, error) {
 	log.Printf("hydra: creating root client for self with scopes %v", scopes)
 
-	// FIXME: This always creates a new client.
+	api := hydraAPI.NewOAuth2ApiWithBasePath(hydraPrivateEndpoint)
+
+	// Delete existing client
+	_, _ = api.DeleteOAuth2Client(rootClientID)
+
+	client, _, err := api.CreateOAuth2Client(rootClientConfig(scopes, secret))
+	if err != nil {
+		return "", errors.New("hydra: error creating client. " + err.Error())
+	}
 
+	return client.ClientSecret, setRootHydraClient(client, scopes)
+}
+
+// LoadRootHydraClient with the secret from `InitializeRootHydraClient`. The client is reused
+// if it exists, so that restarting a host doesn't break the others. It's only created if it
+// doesn't exist (e.g., in a new Hydra database).
+func LoadRootHydraClient(scopes []string, secret string) error {
 	api := hydraAPI.NewOAuth2ApiWithBasePath(hydraPrivateEndpoint)
-	clientConfig := hydraAPI.OAuth2Client{
-		Id:            "arusha-root",
-		ClientSecret:  "",
+	client, response, err := api.GetOAuth2Client(rootClientID)
+	if err != nil {
+		return errors.New("hydra: error fetching client. " + err.Error())
+	}
+
+	if response.StatusCode == http.StatusNotFound {
+		log.Printf("hydra: root client doesn't exist, creating it with scopes %v", scopes)
+		if client, _, err = api.CreateOAuth2Client(rootClientConfig(scopes, secret)); err != nil {
+			return errors.New("hydra: error creating client. " + err.Error())
+		}
+	} else if response.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("hydra: error fetching client: status %d", response.StatusCode)
+	}
+
+	// Hydra only keeps the hash of the secret.
+	client.ClientSecret = secret
+	return setRootHydraClient(client, scopes)
+}
+
+// rootClientConfig for the given scopes and secret (Hydra generates one, if it's empty).
+func rootClientConfig(scopes []string, secret string) hydraAPI.OAuth2Client {
+	return hydraAPI.OAuth2Client{
+		Id:            rootClientID,
+		ClientSecret:  secret,
 		ResponseTypes: []string{"code", "id_token"},
 		Scope:         strings.Join(scopes, " "),
 		GrantTypes:    []string{"authorization_code", "client_credentials"},
@@ -70,16 +115,13 @@ func InitializeRootHydraClient(scopes []string) error {
 		ClientName:    "arusha",
 		Public:        false,
 	}
+}
 
-	// Delete existing client
-	_, _ = api.DeleteOAuth2Client("arusha-root")
+// setRootHydraClient for the SDK and the OAuth2 flow.
+func setRootHydraClient(client *hydraAPI.OAuth2Client, scopes []string) error {
+	hydraOAuth2Client = client
 
 	var err error
-	hydraOAuth2Client, _, err = api.CreateOAuth2Client(clientConfig)
-	if err != nil {
-		return errors.New("hydra: error creating client. " + err.Error())
-	}
-
 	hydraClient, err = hydra.NewSDK(&hydra.Configuration{
 		EndpointURL:  hydraPrivateEndpoint,
 		ClientID:     hydraOAuth2Client.Id,
@@ -91,7 +133,7 @@ func InitializeRootHydraClient(scopes []string) error {
 		return errors.New("hydra: error initializing client. " + err.Error())
 	}
 
-	log.Printf("hydra: created client (id: %s) with scopes %v", hydraOAuth2Client.Id, scopes)
+	log.Printf("hydra: using client (id: %s) with scopes %v", hydraOAuth2Client.Id, scopes)
 
 	oauth2Config = &oauth2.Config{
 		ClientID:     hydraOAuth2Client.Id,
@@ -129,46 +171,69 @@ type HydraRedirectResponse struct {
 
 // GetLoginRequest for the given challenge ID. This fetches the request and reuses
 func GetLoginRequest(challenge string) (*HydraRedirectResponse, error) {
+	_, redirect, err := getLoginRequest(challenge)
+	return redirect, err
+}
+
+// getLoginRequest for the given challenge ID, and accept it if Hydra remembers the login. If
+// the subject's sessions have been idle for too long, then the remembered login is revoked and
+// the request is rejected instead, so that the user has to log in again.
+func getLoginRequest(challenge string) (*hydraAPI.LoginRequest, *HydraRedirectResponse, error) {
 	if hydraClient == nil {
-		return nil, ErrorOAuthNotInitialized
+		return nil, nil, ErrorOAuthNotInitialized
 	}
 
 	loginRequest, _, err := hydraClient.OAuth2Api.GetLoginRequest(challenge)
 	if err != nil {
 		log.Printf("hydra: error getting login request. " + err.Error())
-		return nil, ErrorOAuthFetch
+		return nil, nil, ErrorOAuthFetch
 	}
 
-	if loginRequest.Skip {
-		completion, _, err := hydraClient.OAuth2Api.AcceptLoginRequest(challenge, hydraAPI.AcceptLoginRequest{
-			Subject: loginRequest.Subject,
-		})
+	if !loginRequest.Skip {
+		return loginRequest, nil, nil
+	}
 
-		if err != nil {
-			log.Printf("hydra: error accepting login request. " + err.Error())
-			return nil, ErrorOAuthFetch
+	if active, err := TouchLoginSession(loginRequest.Subject, loginRequest.Client.Id); err != nil {
+		return nil, nil, err
+	} else if !active {
+		log.Printf("hydra: sessions of %s are idle (or the subject is inactive), rejecting login request %s", loginRequest.Subject, challenge)
+		if err := revokeLoginSessions(loginRequest.Subject); err != nil {
+			return nil, nil, err
 		}
 
-		return &HydraRedirectResponse{
-			Subject:     loginRequest.Subject,
-			RedirectURL: completion.RedirectTo,
-		}, nil
+		redirect, err := RejectLoginRequest(challenge, "session has expired")
+		return loginRequest, redirect, err
+	}
+
+	completion, _, err := hydraClient.OAuth2Api.AcceptLoginRequest(challenge, hydraAPI.AcceptLoginRequest{
+		Subject: loginRequest.Subject,
+	})
+
+	if err != nil {
+		log.Printf("hydra: error accepting login request. " + err.Error())
+		return nil, nil, ErrorOAuthFetch
 	}
 
-	return nil, nil
+	return loginRequest, &HydraRedirectResponse{
+		Subject:     loginRequest.Subject,
+		RedirectURL: completion.RedirectTo,
+	}, nil
 }
 
-// AcceptLoginRequest for a given challenge with the given subject (which is the user's ID).
-func AcceptLoginRequest(challenge, subject string) (*HydraRedirectResponse, error) {
-	redirect, err := GetLoginRequest(challenge)
+// AcceptLoginRequest for a given challenge with the given subject (which is the user's ID) and
+// the authentication context class (`acr`) of the login. The login is remembered for the
+// session lifetime, and it's added to the subject's sessions.
+func AcceptLoginRequest(challenge, subject, acr string) (*HydraRedirectResponse, error) {
+	loginRequest, redirect, err := getLoginRequest(challenge)
 	if redirect != nil || err != nil {
 		return redirect, err
 	}
 
 	completion, _, err := hydraClient.OAuth2Api.AcceptLoginRequest(challenge, hydraAPI.AcceptLoginRequest{
 		Subject:     subject,
+		Acr:         acr,
 		Remember:    true,
-		RememberFor: SessionPeriodSeconds,
+		RememberFor: int64(SessionLifetime() / time.Second),
 	})
 
 	if err != nil {
@@ -176,6 +241,10 @@ func AcceptLoginRequest(challenge, subject string) (*HydraRedirectResponse, erro
 		return nil, ErrorOAuthFetch
 	}
 
+	if err := addLoginSession(subject, loginRequest.Client.Id, acr); err != nil {
+		log.Printf("hydra: error adding login session of %s: %s", subject, err)
+	}
+
 	return &HydraRedirectResponse{
 		Subject:     subject,
 		RedirectURL: completion.RedirectTo,
@@ -284,6 +353,71 @@ func RevokeToken(token string) error {
 	return nil
 }
 
+// ListConsentSessions of the given subject.
+func ListConsentSessions(subject string) ([]ConsentSession, error) {
+	if hydraClient == nil {
+		return nil, ErrorOAuthNotInitialized
+	}
+
+	previous, _, err := hydraClient.OAuth2Api.ListUserConsentSessions(subject)
+	if err != nil {
+		log.Printf("hydra: error listing consent sessions: %s", err)
+		return nil, ErrorOAuthFetch
+	}
+
+	sessions := *new([]ConsentSession)
+	for _, session := range previous {
+		sessions = append(sessions, ConsentSession{
+			Client:        session.ConsentRequest.Client.Id,
+			ClientName:    session.ConsentRequest.Client.ClientName,
+			GrantedScopes: session.GrantScope,
+		})
+	}
+
+	return sessions, nil
+}
+
+// RevokeConsentSession of the given subject with a client, along with the access and refresh
+// tokens issued to the client.
+func RevokeConsentSession(subject, client string) error {
+	if hydraClient == nil {
+		return ErrorOAuthNotInitialized
+	}
+
+	if _, err := hydraClient.OAuth2Api.RevokeUserClientConsentSessions(subject, client); err != nil {
+		log.Printf("hydra: error revoking consent session: %s", err)
+		return errors.New("error revoking session")
+	}
+
+	return nil
+}
+
+// RevokeSessions of the given subject - the remembered logins, and the consent sessions along
+// with the access and refresh tokens issued for them. Hydra revokes tokens by their consent
+// sessions, so this also revokes the token of the current session.
+func RevokeSessions(subject string) error {
+	if hydraClient == nil {
+		return ErrorOAuthNotInitialized
+	}
+
+	if _, err := hydraClient.OAuth2Api.RevokeAllUserConsentSessions(subject); err != nil {
+		log.Printf("hydra: error revoking consent sessions: %s", err)
+		return errors.New("error revoking sessions")
+	}
+
+	return revokeLoginSessions(subject)
+}
+
+// revokeLoginSessions of the given subject. Hydra only revokes these all at once.
+func revokeLoginSessions(subject string) error {
+	if _, err := hydraClient.OAuth2Api.RevokeUserLoginCookieSession(subject); err != nil {
+		log.Printf("hydra: error revoking login sessions: %s", err)
+		return errors.New("error revoking sessions")
+	}
+
+	return RemoveLoginSessions(subject)
+}
+
 // AuthorizeToken to identify the subject.
 func AuthorizeToken(token string) (*string, error) {
 	if token == "" {
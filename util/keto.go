@@ -29,6 +29,9 @@ const (
 )
 
 var (
+	// ErrorRoleNotFound occurs when deleting a role which doesn't exist in Keto.
+	ErrorRoleNotFound = errors.New("keto: role doesn't exist")
+
 	ketoEndpoint string
 	ketoClient   *keto.CodeGenSDK
 )
@@ -128,7 +131,8 @@ func UpdateRole(roleID, id, description string, members, scopes []string) error
 	return nil
 }
 
-// DeleteRole corresponding to an ID.
+// DeleteRole corresponding to an ID, along with its policy. If neither of them exists, then
+// this fails with `ErrorRoleNotFound`.
 func DeleteRole(id string) error {
 	if oauth2Config == nil {
 		return ErrorOAuthNotInitialized
@@ -139,15 +143,28 @@ func DeleteRole(id string) error {
 	}
 
 	response, err := ketoClient.RoleApi.DeleteRole(id)
-	if err != nil || response.StatusCode >= http.StatusBadRequest {
-		log.Printf("keto: error deleting role on update: %s", err)
-		return errors.New("keto: role doesn't exist")
+	if err != nil {
+		log.Printf("keto: error deleting role %s: %s", id, err)
+		return errors.New("keto: error deleting role")
+	}
+
+	roleMissing := response.StatusCode == http.StatusNotFound
+	if !roleMissing && response.StatusCode >= http.StatusBadRequest {
+		log.Printf("keto: error deleting role %s: status %d", id, response.StatusCode)
+		return errors.New("keto: error deleting role")
 	}
 
 	response, err = ketoClient.PolicyApi.DeletePolicy(RolePolicyPrefix + id)
-	if err != nil || response.StatusCode >= http.StatusBadRequest {
+	if err != nil {
 		log.Printf("keto: error deleting policy for role '%s': %s", id, err)
-		return errors.New("keto: policy doesn't exist")
+		return errors.New("keto: error deleting policy")
+	} else if response.StatusCode == http.StatusNotFound {
+		if roleMissing {
+			return ErrorRoleNotFound
+		}
+	} else if response.StatusCode >= http.StatusBadRequest {
+		log.Printf("keto: error deleting policy for role '%s': status %d", id, response.StatusCode)
+		return errors.New("keto: error deleting policy")
 	}
 
 	log.Printf("keto: deleted policy for role %s", id)
@@ -156,10 +173,6 @@ func DeleteRole(id string) error {
 
 // ListRolesAndPolicies from keto for constructing Arusha roles.
 func ListRolesAndPolicies() ([]ketoAPI.Role, []ketoAPI.Policy, error) {
-	if oauth2Config == nil {
-		return nil, nil, ErrorOAuthNotInitialized
-	}
-
 	if ketoClient == nil {
 		return nil, nil, ErrorRBACNotInitialized
 	}
@@ -186,7 +199,7 @@ func ListRolesAndPolicies() ([]ketoAPI.Role, []ketoAPI.Policy, error) {
 		rolePolicies = append(rolePolicies, policy)
 	}
 
-	return roles, policies, nil
+	return roles, rolePolicies, nil
 }
 
 // GetRolePolicyPair for constructing an Arusha role.
@@ -239,7 +252,7 @@ func IsSubjectAuthorized(subject, scope string) (bool, error) {
 		return false, ErrorRBACNotInitialized
 	}
 
-	log.Println("keto: authorizing subject %s for performing action on scope %s", subject, scope)
+	log.Printf("keto: authorizing subject %s for performing action on scope %s", subject, scope)
 
 	response, _, err := ketoClient.WardenApi.IsSubjectAuthorized(ketoAPI.WardenSubjectAuthorizationRequest{
 		Action:   StubAction,
@@ -272,3 +285,30 @@ func ListRolesForSubject(subject string) ([]string, error) {
 
 	return roleIds, nil
 }
+
+// RemoveSubjectFromRoles removes the subject from all the roles it's a member of.
+func RemoveSubjectFromRoles(subject string) error {
+	if ketoClient == nil {
+		return ErrorRBACNotInitialized
+	}
+
+	roleIDs, err := ListRolesForSubject(subject)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range roleIDs {
+		response, err := ketoClient.RoleApi.RemoveMembersFromRole(id, ketoAPI.RoleMembers{
+			Members: []string{subject},
+		})
+
+		if err != nil {
+			return fmt.Errorf("keto: error removing subject from role '%s': %s", id, err)
+		} else if response.StatusCode >= http.StatusBadRequest {
+			return fmt.Errorf("keto: error removing subject from role '%s': status %d", id, response.StatusCode)
+		}
+	}
+
+	log.Printf("keto: removed subject %s from %d roles", subject, len(roleIDs))
+	return nil
+}
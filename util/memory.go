@@ -0,0 +1,93 @@
+package util
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	memoryLock sync.RWMutex
+	memoryData = make(map[string][]byte)
+)
+
+// MemoryStore keeps values in this process. Values are stored in their JSON form, so that
+// callers get a copy (and the same decoding behavior as other backends) on every read.
+type MemoryStore struct {
+	path string
+}
+
+// Set value for a given key.
+func (m *MemoryStore) Set(key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	memoryLock.Lock()
+	defer memoryLock.Unlock()
+
+	memoryData[m.path+"/"+key] = data
+	return nil
+}
+
+// Get the value for a key.
+func (m *MemoryStore) Get(key string, value interface{}) error {
+	memoryLock.RLock()
+	data, exists := memoryData[m.path+"/"+key]
+	memoryLock.RUnlock()
+
+	if !exists {
+		return ErrorKeyNotFound
+	}
+
+	return json.Unmarshal(data, value)
+}
+
+// Take the value for a key and remove it.
+func (m *MemoryStore) Take(key string, value interface{}) error {
+	memoryLock.Lock()
+	data, exists := memoryData[m.path+"/"+key]
+	delete(memoryData, m.path+"/"+key)
+	memoryLock.Unlock()
+
+	if !exists {
+		return ErrorKeyNotFound
+	}
+
+	return json.Unmarshal(data, value)
+}
+
+// Remove the value corresponding to a key.
+func (m *MemoryStore) Remove(key string) error {
+	memoryLock.Lock()
+	defer memoryLock.Unlock()
+
+	delete(memoryData, m.path+"/"+key)
+	return nil
+}
+
+// List the keys under this store's path.
+func (m *MemoryStore) List() ([]string, error) {
+	prefix := m.path + "/"
+	keys := *new([]string)
+
+	memoryLock.RLock()
+	for key := range memoryData {
+		if strings.HasPrefix(key, prefix) && !strings.Contains(key[len(prefix):], "/") {
+			keys = append(keys, key[len(prefix):])
+		}
+	}
+	memoryLock.RUnlock()
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// GetMemoryStore for the given path.
+func GetMemoryStore(path string) *MemoryStore {
+	return &MemoryStore{
+		path: rootPath + path,
+	}
+}
@@ -0,0 +1,39 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStore(t *testing.T) {
+	type resource struct {
+		ID    string `json:"id"`
+		Email string `json:"email"`
+	}
+
+	store := GetMemoryStore("/test-resources")
+	other := GetMemoryStore("/test-resources/nested")
+
+	var value resource
+	assert.Equal(t, ErrorKeyNotFound, store.Get("foo", &value))
+
+	assert.NoError(t, store.Set("foo", resource{ID: "FOO", Email: "foo@example.com"}))
+	assert.NoError(t, store.Set("bar", resource{ID: "BAR", Email: "bar@example.com"}))
+	assert.NoError(t, other.Set("baz", "baz"))
+
+	assert.NoError(t, store.Get("foo", &value))
+	assert.Equal(t, "FOO", value.ID)
+	assert.Equal(t, "foo@example.com", value.Email)
+
+	keys, err := store.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bar", "foo"}, keys)
+
+	assert.NoError(t, store.Remove("foo"))
+	assert.Equal(t, ErrorKeyNotFound, store.Get("foo", &value))
+
+	keys, err = store.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bar"}, keys)
+}
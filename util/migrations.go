@@ -0,0 +1,318 @@
+package util
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	// ErrorSchemaOutdated occurs when the database schema is behind the one required
+	// by this build. Running `arusha migrate up` fixes it.
+	ErrorSchemaOutdated = errors.New("database: schema is outdated. please run 'arusha migrate up' before starting arusha")
+	// ErrorDatabaseNotInitialized occurs when Arusha isn't configured with a SQL database.
+	ErrorDatabaseNotInitialized = errors.New("database: not initialized (DATABASE_URL doesn't point to a SQL database)")
+)
+
+// Migration is a versioned change to the database schema. Versions are sequential and
+// start from 1. Once released, a migration should never be changed - add a new one instead.
+type Migration struct {
+	Version     int
+	Description string
+	Up          []string
+	Down        []string
+}
+
+// MigrationStatus of a migration in the database.
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// migrations for the tables used by Arusha (in order).
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "create key/value store and users tables",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS arusha_store (
+				path VARCHAR(255) NOT NULL,
+				name VARCHAR(255) NOT NULL,
+				value TEXT NOT NULL,
+				PRIMARY KEY (path, name)
+			)`,
+			`CREATE TABLE IF NOT EXISTS arusha_users (
+				id VARCHAR(64) PRIMARY KEY,
+				email VARCHAR(255) NOT NULL,
+				verified BOOLEAN NOT NULL DEFAULT FALSE,
+				first_name VARCHAR(255) NOT NULL,
+				last_name VARCHAR(255) NOT NULL DEFAULT '',
+				created_at BIGINT NOT NULL
+			)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS arusha_users_email_idx ON arusha_users (email)`,
+			`CREATE INDEX IF NOT EXISTS arusha_users_created_at_idx ON arusha_users (created_at, id)`,
+		},
+		Down: []string{
+			`DROP TABLE arusha_users`,
+			`DROP TABLE arusha_store`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "add version to users",
+		Up: []string{
+			`ALTER TABLE arusha_users ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+		},
+		Down: []string{
+			`ALTER TABLE arusha_users DROP COLUMN version`,
+		},
+	},
+	{
+		Version:     3,
+		Description: "add soft-delete time to users",
+		Up: []string{
+			`ALTER TABLE arusha_users ADD COLUMN deleted_at BIGINT`,
+			`CREATE INDEX IF NOT EXISTS arusha_users_deleted_at_idx ON arusha_users (deleted_at)`,
+		},
+		Down: []string{
+			`DROP INDEX arusha_users_deleted_at_idx`,
+			`ALTER TABLE arusha_users DROP COLUMN deleted_at`,
+		},
+	},
+	{
+		Version:     4,
+		Description: "add multiple emails for users",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS arusha_user_emails (
+				address VARCHAR(255) PRIMARY KEY,
+				user_id VARCHAR(64) NOT NULL REFERENCES arusha_users (id) ON DELETE CASCADE,
+				verified BOOLEAN NOT NULL DEFAULT FALSE,
+				is_primary BOOLEAN NOT NULL DEFAULT FALSE,
+				position INTEGER NOT NULL DEFAULT 0
+			)`,
+			`CREATE INDEX IF NOT EXISTS arusha_user_emails_user_id_idx ON arusha_user_emails (user_id)`,
+			`INSERT INTO arusha_user_emails (address, user_id, verified, is_primary, position)
+				SELECT email, id, verified, TRUE, 0 FROM arusha_users`,
+		},
+		Down: []string{
+			`DROP TABLE arusha_user_emails`,
+		},
+	},
+	{
+		Version:     5,
+		Description: "add metadata to users",
+		Up: []string{
+			`ALTER TABLE arusha_users ADD COLUMN metadata TEXT`,
+			`ALTER TABLE arusha_users ADD COLUMN app_metadata TEXT`,
+		},
+		Down: []string{
+			`ALTER TABLE arusha_users DROP COLUMN app_metadata`,
+			`ALTER TABLE arusha_users DROP COLUMN metadata`,
+		},
+	},
+	{
+		Version:     6,
+		Description: "add encrypted personal data to users",
+		Up: []string{
+			`ALTER TABLE arusha_users ADD COLUMN sealed TEXT`,
+		},
+		Down: []string{
+			`ALTER TABLE arusha_users DROP COLUMN sealed`,
+		},
+	},
+}
+
+// LatestSchemaVersion required by this build.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+func ensureMigrationsTable() error {
+	_, err := database.Exec(`CREATE TABLE IF NOT EXISTS arusha_schema_migrations (
+		version INTEGER PRIMARY KEY,
+		description VARCHAR(255) NOT NULL,
+		applied_at BIGINT NOT NULL
+	)`)
+
+	if err != nil {
+		return errors.New("database: error creating migrations table. " + err.Error())
+	}
+
+	return nil
+}
+
+// SchemaVersion of the connected database (0 if no migrations have been applied).
+func SchemaVersion() (int, error) {
+	if database == nil {
+		return 0, ErrorDatabaseNotInitialized
+	}
+
+	if err := ensureMigrationsTable(); err != nil {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	if err := database.QueryRow(`SELECT MAX(version) FROM arusha_schema_migrations`).Scan(&version); err != nil {
+		return 0, errors.New("database: error fetching schema version. " + err.Error())
+	}
+
+	return int(version.Int64), nil
+}
+
+// CheckSchemaVersion ensures that the database schema is the one required by this build.
+// A database ahead of this build is allowed (it happens during rolling deploys), since
+// migrations are expected to be backwards compatible.
+func CheckSchemaVersion() error {
+	version, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	if latest := LatestSchemaVersion(); version < latest {
+		log.Printf("database: schema version is %d, but this build requires version %d", version, latest)
+		return ErrorSchemaOutdated
+	} else if version > latest {
+		log.Printf("database: schema version %d is newer than this build (version %d)", version, latest)
+	}
+
+	return nil
+}
+
+// ListMigrations along with the time they were applied (if they were).
+func ListMigrations() ([]MigrationStatus, error) {
+	if _, err := SchemaVersion(); err != nil {
+		return nil, err
+	}
+
+	rows, err := database.Query(`SELECT version, applied_at FROM arusha_schema_migrations`)
+	if err != nil {
+		return nil, errors.New("database: error fetching migrations. " + err.Error())
+	}
+
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+
+		applied[version] = time.Unix(0, appliedAt)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	statuses := *new([]MigrationStatus)
+	for _, migration := range migrations {
+		status := MigrationStatus{Migration: migration}
+		if appliedAt, exists := applied[migration.Version]; exists {
+			status.AppliedAt = &appliedAt
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// MigrateUp applies the pending migrations up to the given version (or all of them if the
+// version is zero), and returns the applied migrations.
+func MigrateUp(target int) ([]Migration, error) {
+	version, err := SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	if target <= 0 {
+		target = LatestSchemaVersion()
+	}
+
+	applied := *new([]Migration)
+	for _, migration := range migrations {
+		if migration.Version <= version || migration.Version > target {
+			continue
+		}
+
+		err := runMigration(migration, migration.Up, func(tx *sql.Tx) error {
+			_, err := tx.Exec(RebindQuery(databaseDriver, `INSERT INTO arusha_schema_migrations (version, description, applied_at) VALUES (?, ?, ?)`),
+				migration.Version, migration.Description, time.Now().UnixNano())
+			return err
+		})
+
+		if err != nil {
+			return applied, err
+		}
+
+		log.Printf("database: applied migration %d (%s)", migration.Version, migration.Description)
+		applied = append(applied, migration)
+	}
+
+	return applied, nil
+}
+
+// MigrateDown rolls back the given number of applied migrations (latest first), and returns
+// the migrations which have been rolled back.
+func MigrateDown(steps int) ([]Migration, error) {
+	version, err := SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	if version > LatestSchemaVersion() {
+		return nil, fmt.Errorf("database: schema version %d is unknown to this build", version)
+	}
+
+	reverted := *new([]Migration)
+	for i := len(migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+		migration := migrations[i]
+		if migration.Version > version {
+			continue
+		}
+
+		err := runMigration(migration, migration.Down, func(tx *sql.Tx) error {
+			_, err := tx.Exec(RebindQuery(databaseDriver, `DELETE FROM arusha_schema_migrations WHERE version = ?`), migration.Version)
+			return err
+		})
+
+		if err != nil {
+			return reverted, err
+		}
+
+		log.Printf("database: rolled back migration %d (%s)", migration.Version, migration.Description)
+		reverted = append(reverted, migration)
+	}
+
+	return reverted, nil
+}
+
+// runMigration runs the given statements and records the change in a single transaction.
+func runMigration(migration Migration, statements []string, record func(tx *sql.Tx) error) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return errors.New("database: error starting migration. " + err.Error())
+	}
+
+	for _, statement := range statements {
+		if _, err = tx.Exec(statement); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("database: error in migration %d: %s", migration.Version, err)
+		}
+	}
+
+	if err = record(tx); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("database: error recording migration %d: %s", migration.Version, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("database: error committing migration %d: %s", migration.Version, err)
+	}
+
+	return nil
+}
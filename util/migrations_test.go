@@ -0,0 +1,54 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrations(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("arusha-%s.db", uuid.New()))
+	defer os.Remove(path)
+
+	require.NoError(t, InitializeDatabase("sqlite://"+path))
+	defer CloseDatabase()
+
+	version, err := SchemaVersion()
+	require.NoError(t, err)
+	assert.Equal(t, 0, version)
+	assert.Equal(t, ErrorSchemaOutdated, CheckSchemaVersion())
+
+	applied, err := MigrateUp(0)
+	require.NoError(t, err)
+	assert.Len(t, applied, len(migrations))
+	assert.NoError(t, CheckSchemaVersion())
+
+	statuses, err := ListMigrations()
+	require.NoError(t, err)
+	for _, status := range statuses {
+		assert.NotNil(t, status.AppliedAt)
+	}
+
+	// Applying again shouldn't do anything.
+	applied, err = MigrateUp(0)
+	require.NoError(t, err)
+	assert.Empty(t, applied)
+
+	reverted, err := MigrateDown(len(migrations))
+	require.NoError(t, err)
+	assert.Len(t, reverted, len(migrations))
+
+	version, err = SchemaVersion()
+	require.NoError(t, err)
+	assert.Equal(t, 0, version)
+
+	// Migrations should be re-applicable after rolling back.
+	_, err = MigrateUp(0)
+	require.NoError(t, err)
+	assert.NoError(t, CheckSchemaVersion())
+}
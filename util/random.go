@@ -1,36 +1,24 @@
 package util
 
 import (
-	"math/rand"
-	"time"
+	"crypto/rand"
+	"math/big"
 )
 
-// Based on benchmark in https://stackoverflow.com/a/31832326/2313792
-
-var src = rand.NewSource(time.Now().UnixNano())
-
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 
-const (
-	letterIdxBits = 6                    // 6 bits to represent a letter index
-	letterIdxMask = 1<<letterIdxBits - 1 // All 1-bits, as many as letterIdxBits
-	letterIdxMax  = 63 / letterIdxBits   // # of letter indices fitting in 63 bits
-)
-
-// RandomAlphaNumeric string generator.
+// RandomAlphaNumeric string generator. The characters are drawn from a CSPRNG, so the strings
+// can be used as secrets.
 func RandomAlphaNumeric(n int) string {
 	b := make([]byte, n)
-	// A src.Int63() generates 63 random bits, enough for letterIdxMax characters!
-	for i, cache, remain := n-1, src.Int63(), letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = src.Int63(), letterIdxMax
-		}
-		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
-			b[i] = letterBytes[idx]
-			i--
+	max := big.NewInt(int64(len(letterBytes)))
+	for i := range b {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic("random: error reading from CSPRNG: " + err.Error())
 		}
-		cache >>= letterIdxBits
-		remain--
+
+		b[i] = letterBytes[idx.Int64()]
 	}
 
 	return string(b)
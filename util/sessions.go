@@ -0,0 +1,152 @@
+package util
+
+import (
+	"time"
+
+	"gitlab.com/omnijar/arusha/config"
+)
+
+const (
+	// SessionsPath has the login sessions of subjects (see `LoginSession`).
+	SessionsPath = "/sessions"
+)
+
+var (
+	isSubjectActive = func(subject string) (bool, error) { return true, nil }
+)
+
+// LoginSession of a subject, for each login accepted by the service. Hydra remembers logins with
+// a cookie, but it doesn't tell which login a remembered one comes from, so these are only kept
+// for listing (they cannot be revoked one by one).
+type LoginSession struct {
+	Client          string    `json:"client"`
+	ACR             string    `json:"acr"`
+	AuthenticatedAt time.Time `json:"authenticatedAt"`
+	ExpiresAt       time.Time `json:"expiresAt"`
+}
+
+// loginSessions of a subject, along with the last time that any of them has been used (for the
+// idle timeout, which applies to all of them together).
+type loginSessions struct {
+	Logins     []LoginSession `json:"logins"`
+	LastUsedAt time.Time      `json:"lastUsedAt"`
+}
+
+// ConsentSession of a subject with a client, along with the tokens issued to the client.
+type ConsentSession struct {
+	Client        string   `json:"client"`
+	ClientName    string   `json:"clientName"`
+	GrantedScopes []string `json:"grantedScopes"`
+}
+
+// SessionLifetime from the configuration (or the default). Logins aren't remembered beyond this.
+func SessionLifetime() time.Duration {
+	if config.Default.SessionLifetime <= 0 {
+		return config.DefaultSessionLifetime
+	}
+
+	return config.Default.SessionLifetime
+}
+
+// ListLoginSessions of the given subject which haven't expired. None are listed once they've been
+// idle for too long.
+func ListLoginSessions(subject string) ([]LoginSession, error) {
+	sessions, err := loadLoginSessions(subject)
+	if err != nil {
+		return nil, err
+	} else if isIdle(sessions, time.Now()) {
+		return *new([]LoginSession), nil
+	}
+
+	return sessions.Logins, nil
+}
+
+// RemoveLoginSessions of the given subject (after revoking them in Hydra).
+func RemoveLoginSessions(subject string) error {
+	return GetStore(SessionsPath).Remove(subject)
+}
+
+// addLoginSession for a login accepted for the subject. Expired sessions are removed as well.
+func addLoginSession(subject, client, acr string) error {
+	sessions, err := loadLoginSessions(subject)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	sessions.Logins = append(sessions.Logins, LoginSession{
+		Client:          client,
+		ACR:             acr,
+		AuthenticatedAt: now,
+		ExpiresAt:       now.Add(SessionLifetime()),
+	})
+
+	sessions.LastUsedAt = now
+	return storeLoginSessions(subject, sessions)
+}
+
+// SetSubjectCheck for refusing the remembered logins of subjects which aren't active anymore
+// (e.g., deleted users).
+func SetSubjectCheck(check func(subject string) (bool, error)) {
+	isSubjectActive = check
+}
+
+// TouchLoginSession of the subject when Hydra skips a remembered login, and check whether the
+// login can be skipped. It cannot, if the subject isn't active (see `SetSubjectCheck`), or if
+// the subject's sessions have been idle for too long (Hydra
+// doesn't tell which of them the remembered login comes from, so they're idle together). Remembered
+// logins without a (live) session are from before sessions were kept, so they're added.
+func TouchLoginSession(subject, client string) (bool, error) {
+	if active, err := isSubjectActive(subject); err != nil || !active {
+		return false, err
+	}
+
+	sessions, err := loadLoginSessions(subject)
+	if err != nil {
+		return false, err
+	} else if len(sessions.Logins) == 0 {
+		return true, addLoginSession(subject, client, "")
+	}
+
+	now := time.Now().UTC()
+	if isIdle(sessions, now) {
+		return false, nil
+	}
+
+	sessions.LastUsedAt = now
+	return true, storeLoginSessions(subject, sessions)
+}
+
+// isIdle checks whether the sessions haven't been used for longer than the idle timeout (if any).
+func isIdle(sessions *loginSessions, now time.Time) bool {
+	idle := config.Default.SessionIdleTimeout
+	return idle > 0 && !now.Before(sessions.LastUsedAt.Add(idle))
+}
+
+// loadLoginSessions of the subject, without the expired ones.
+func loadLoginSessions(subject string) (*loginSessions, error) {
+	var sessions loginSessions
+	if err := GetStore(SessionsPath).Get(subject, &sessions); err != nil && err != ErrorKeyNotFound {
+		return nil, err
+	}
+
+	live := *new([]LoginSession)
+	now := time.Now()
+	for _, session := range sessions.Logins {
+		if now.Before(session.ExpiresAt) {
+			live = append(live, session)
+		}
+	}
+
+	sessions.Logins = live
+	return &sessions, nil
+}
+
+// storeLoginSessions of the subject.
+func storeLoginSessions(subject string, sessions *loginSessions) error {
+	if len(sessions.Logins) == 0 {
+		return GetStore(SessionsPath).Remove(subject)
+	}
+
+	return GetStore(SessionsPath).Set(subject, sessions)
+}
@@ -0,0 +1,60 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/omnijar/arusha/config"
+)
+
+func TestLoginSessions(t *testing.T) {
+	config.Default.DatabaseURL = StoreMemory
+	require.NoError(t, InitializeStore())
+	config.Default.SessionLifetime, config.Default.SessionIdleTimeout = time.Hour, 10*time.Minute
+	defer func() { config.Default.SessionLifetime, config.Default.SessionIdleTimeout = 0, 0 }()
+
+	// Remembered logins from before sessions were kept are adopted.
+	ok, err := TouchLoginSession("SESSIONS", "client")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	require.NoError(t, addLoginSession("SESSIONS", "other", "1"))
+
+	sessions, err := ListLoginSessions("SESSIONS")
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+	assert.Equal(t, "other", sessions[1].Client)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), sessions[1].ExpiresAt, time.Minute)
+
+	// Remembered logins keep the sessions from being idle.
+	record, err := loadLoginSessions("SESSIONS")
+	require.NoError(t, err)
+	record.LastUsedAt = time.Now().Add(-5 * time.Minute)
+	require.NoError(t, storeLoginSessions("SESSIONS", record))
+	ok, err = TouchLoginSession("SESSIONS", "other")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// Idle sessions aren't listed, and remembered logins are refused once they're idle.
+	record, err = loadLoginSessions("SESSIONS")
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), record.LastUsedAt, time.Minute)
+	record.LastUsedAt = time.Now().Add(-time.Hour)
+	require.NoError(t, storeLoginSessions("SESSIONS", record))
+	sessions, err = ListLoginSessions("SESSIONS")
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+	ok, err = TouchLoginSession("SESSIONS", "client")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// Expired sessions are dropped.
+	record.Logins[0].ExpiresAt = time.Now().Add(-time.Minute)
+	require.NoError(t, storeLoginSessions("SESSIONS", record))
+	record, err = loadLoginSessions("SESSIONS")
+	require.NoError(t, err)
+	assert.Len(t, record.Logins, 1)
+
+	require.NoError(t, RemoveLoginSessions("SESSIONS"))
+}
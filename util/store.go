@@ -0,0 +1,96 @@
+package util
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"gitlab.com/omnijar/arusha/config"
+)
+
+const (
+	// StoreVault is the database URL for using Vault as the backing store.
+	StoreVault = "vault"
+	// StoreMemory is the database URL for using a process-local store (useful for testing).
+	StoreMemory = "memory"
+
+	// Any other database URL (`postgres://...` or `sqlite://...`) uses a SQL database.
+)
+
+var (
+	// ErrorKeyNotFound occurs when a key doesn't exist in the store.
+	ErrorKeyNotFound = errors.New("store: key doesn't exist")
+	// ErrorStoreNotInitialized for uninitialized store.
+	ErrorStoreNotInitialized = errors.New("store: backend not initialized")
+
+	storeBackend func(path string) Store
+)
+
+// Store persists values against keys under a path. All implementations should be safe
+// for concurrent use.
+type Store interface {
+	// Get the value for a key and decode it into the given value. If the key doesn't exist,
+	// then `ErrorKeyNotFound` is returned.
+	Get(key string, value interface{}) error
+	// Set the value for a given key.
+	Set(key string, value interface{}) error
+	// Remove the value corresponding to a key.
+	Remove(key string) error
+	// List the keys under this store's path.
+	List() ([]string, error)
+}
+
+// InitializeStore using the configured database URL.
+func InitializeStore() error {
+	switch config.Default.DatabaseURL {
+	case StoreVault:
+		if err := InitializeVaultClient(); err != nil {
+			return err
+		}
+
+		storeBackend = func(path string) Store {
+			return GetVaultClient(path)
+		}
+	case StoreMemory:
+		storeBackend = func(path string) Store {
+			return GetMemoryStore(path)
+		}
+	default:
+		if !IsDatabaseURL(config.Default.DatabaseURL) {
+			return errors.New("store: unsupported database URL")
+		}
+
+		if err := InitializeDatabase(config.Default.DatabaseURL); err != nil {
+			return err
+		}
+
+		if err := CheckSchemaVersion(); err != nil {
+			return err
+		}
+
+		storeBackend = func(path string) Store {
+			return GetSQLStore(path)
+		}
+	}
+
+	log.Printf("store: using %s backend", strings.SplitN(config.Default.DatabaseURL, "://", 2)[0])
+	return nil
+}
+
+// GetStore for use in other controllers.
+func GetStore(path string) Store {
+	if storeBackend == nil {
+		return &nilStore{}
+	}
+
+	return storeBackend(path)
+}
+
+// nilStore fails all operations, so that controllers don't panic when the store hasn't been
+// initialized.
+type nilStore struct{}
+
+func (s *nilStore) Get(key string, value interface{}) error { return ErrorStoreNotInitialized }
+func (s *nilStore) Set(key string, value interface{}) error { return ErrorStoreNotInitialized }
+func (s *nilStore) Remove(key string) error                 { return ErrorStoreNotInitialized }
+func (s *nilStore) List() ([]string, error)                 { return nil, ErrorStoreNotInitialized }
@@ -0,0 +1,250 @@
+package util
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"gitlab.com/omnijar/arusha/config"
+)
+
+const (
+	// TokensPath has the tokens minted by the service, keyed by their hashes.
+	TokensPath = "/tokens"
+	// TokenPurposeVerifyEmail is the purpose of tokens for verifying emails.
+	TokenPurposeVerifyEmail = "verify-email"
+	// TokenPurposeResetSecret is the purpose of tokens for resetting secrets.
+	TokenPurposeResetSecret = "reset-secret"
+	// TokenPurposeLoginLink is the purpose of tokens in emailed login links.
+	TokenPurposeLoginLink = "login-link"
+	// TokenPurposeSecondFactor is the purpose of tokens for logins waiting for a second factor.
+	TokenPurposeSecondFactor = "second-factor"
+	// TokenPurposeWebAuthnRegistration is the purpose of challenges for registering WebAuthn
+	// credentials.
+	TokenPurposeWebAuthnRegistration = "webauthn-registration"
+	// TokenPurposeWebAuthnAssertion is the purpose of challenges for logging in with WebAuthn
+	// credentials.
+	TokenPurposeWebAuthnAssertion = "webauthn-assertion"
+
+	// ceremonyTokenTTL is short, since the user is in the middle of logging in (or registering
+	// a second factor).
+	ceremonyTokenTTL = 10 * time.Minute
+
+	tokenBytes = TokenLength / 2
+)
+
+var (
+	// ErrorTokenInvalid occurs when a token doesn't exist, has expired, or has another purpose.
+	ErrorTokenInvalid = errors.New("token: invalid or expired token")
+
+	// takeLock serializes `takeValue` for stores which cannot remove values atomically.
+	takeLock sync.Mutex
+)
+
+// Token minted for a purpose. Only the hash of the token is stored (as the key), so the token
+// itself only exists in the message sent to the user. If encryption is enabled, then the value
+// is sealed, and only its blind index is kept in plain text (see `HasValue`).
+type Token struct {
+	Purpose     string      `json:"purpose"`
+	Subject     string      `json:"subject"`
+	Value       string      `json:"value,omitempty"`
+	ValueIndex  string      `json:"valueIndex,omitempty"`
+	SealedValue *SealedData `json:"sealedValue,omitempty"`
+	ExpiresAt   time.Time   `json:"expiresAt"`
+}
+
+// HasValue checks whether the token has been minted with the given value. Unlike comparing
+// `Value`, this works for sealed values as well (e.g., in `RevokeTokens`).
+func (t *Token) HasValue(value string) bool {
+	if t.SealedValue != nil {
+		return t.ValueIndex == BlindIndex(value)
+	}
+
+	return t.Value == value
+}
+
+// Taker is implemented by stores which can remove a key (and return its value) atomically.
+type Taker interface {
+	// Take the value for a key and remove it. If the key doesn't exist (or it has been taken
+	// concurrently), then `ErrorKeyNotFound` is returned.
+	Take(key string, value interface{}) error
+}
+
+// MintToken for the given purpose and subject (usually a user ID), along with a value specific
+// to the purpose (e.g., the email being verified). The token expires after the TTL of its
+// purpose. If a transaction is given, then the token is stored through it.
+func MintToken(tx *StoreTransaction, purpose, subject, value string) (string, error) {
+	data := make([]byte, tokenBytes)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+
+	token := hex.EncodeToString(data)
+	record, err := newToken(purpose, subject, value, TokenTTL(purpose))
+	if err != nil {
+		return "", err
+	}
+
+	store := GetStore(TokensPath)
+	if tx != nil {
+		return token, tx.Set(store, hashToken(token), record)
+	}
+
+	return token, store.Set(hashToken(token), record)
+}
+
+// TokenTTL for the given purpose (from the configuration, or the default).
+func TokenTTL(purpose string) time.Duration {
+	ttl, defaultTTL := config.Default.EmailTokenTTL, config.DefaultEmailTokenTTL
+	switch purpose {
+	case TokenPurposeResetSecret:
+		ttl, defaultTTL = config.Default.ResetTokenTTL, config.DefaultResetTokenTTL
+	case TokenPurposeLoginLink:
+		ttl, defaultTTL = config.Default.LoginLinkTTL, config.DefaultLoginLinkTTL
+	case TokenPurposeSecondFactor, TokenPurposeWebAuthnRegistration, TokenPurposeWebAuthnAssertion:
+		ttl, defaultTTL = 0, ceremonyTokenTTL
+	}
+
+	if ttl <= 0 {
+		return defaultTTL
+	}
+
+	return ttl
+}
+
+// LookupToken for the given purpose without consuming it.
+func LookupToken(purpose, token string) (*Token, error) {
+	var record Token
+	if err := GetStore(TokensPath).Get(hashToken(token), &record); err == ErrorKeyNotFound {
+		return nil, ErrorTokenInvalid
+	} else if err != nil {
+		return nil, err
+	}
+
+	if record.Purpose != purpose || !time.Now().Before(record.ExpiresAt) {
+		return nil, ErrorTokenInvalid
+	}
+
+	if err := record.openValue(); err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// ConsumeToken for the given purpose. The token is removed as it's read, so that it can only be
+// used once (even with concurrent requests). Tokens for other purposes are left as they are.
+func ConsumeToken(purpose, token string) (*Token, error) {
+	if _, err := LookupToken(purpose, token); err != nil {
+		return nil, err
+	}
+
+	var record Token
+	if err := takeValue(GetStore(TokensPath), hashToken(token), &record); err == ErrorKeyNotFound {
+		return nil, ErrorTokenInvalid
+	} else if err != nil {
+		return nil, err
+	}
+
+	if record.Purpose != purpose || !time.Now().Before(record.ExpiresAt) {
+		return nil, ErrorTokenInvalid
+	}
+
+	if err := record.openValue(); err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// RevokeTokens matching the given function. Expired tokens are removed as well. The values of
+// the tokens aren't opened, so the function should match them with `HasValue`.
+func RevokeTokens(matches func(token Token) bool) error {
+	store := GetStore(TokensPath)
+	keys, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		var record Token
+		if err := store.Get(key, &record); err == ErrorKeyNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if matches(record) || !now.Before(record.ExpiresAt) {
+			if err := store.Remove(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// PurgeExpiredTokens from the store.
+func PurgeExpiredTokens() error {
+	return RevokeTokens(func(token Token) bool { return false })
+}
+
+// newToken for the given purpose, subject and value, which expires after the given TTL. The value
+// is sealed if encryption is enabled.
+func newToken(purpose, subject, value string, ttl time.Duration) (Token, error) {
+	record := Token{Purpose: purpose, Subject: subject, Value: value, ExpiresAt: time.Now().UTC().Add(ttl)}
+	if value == "" || !IsEncryptionEnabled() {
+		return record, nil
+	}
+
+	sealed, err := Seal([]byte(value))
+	if err != nil {
+		return record, err
+	}
+
+	record.Value, record.ValueIndex, record.SealedValue = "", BlindIndex(value), sealed
+	return record, nil
+}
+
+// openValue of the token (if it has been sealed).
+func (t *Token) openValue() error {
+	if t.SealedValue == nil {
+		return nil
+	}
+
+	value, err := Open(*t.SealedValue)
+	if err != nil {
+		return err
+	}
+
+	t.Value = string(value)
+	return nil
+}
+
+// takeValue for a key from the store, and remove it. Stores which don't support atomic removals
+// (i.e., Vault) are only protected against concurrent requests within this process, which is why
+// only one host can use Vault at a time (see `LockVaultHost`).
+func takeValue(store Store, key string, value interface{}) error {
+	if taker, ok := store.(Taker); ok {
+		return taker.Take(key, value)
+	}
+
+	takeLock.Lock()
+	defer takeLock.Unlock()
+
+	if err := store.Get(key, value); err != nil {
+		return err
+	}
+
+	return store.Remove(key)
+}
+
+// hashToken for using it as a key. Tokens have enough entropy, so they don't need a slow hash.
+func hashToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
@@ -0,0 +1,99 @@
+package util
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/omnijar/arusha/config"
+)
+
+func TestTokens(t *testing.T) {
+	config.Default.DatabaseURL = StoreMemory
+	require.NoError(t, InitializeStore())
+
+	token, err := MintToken(nil, TokenPurposeResetSecret, "TOKENS", "tokens@example.com")
+	require.NoError(t, err)
+	assert.Len(t, token, TokenLength)
+
+	// Only the hash of the token is stored.
+	keys, err := GetStore(TokensPath).List()
+	require.NoError(t, err)
+	assert.NotContains(t, keys, token)
+	assert.Contains(t, keys, hashToken(token))
+
+	found, err := LookupToken(TokenPurposeResetSecret, token)
+	require.NoError(t, err)
+	assert.Equal(t, "TOKENS", found.Subject)
+	assert.Equal(t, "tokens@example.com", found.Value)
+	assert.WithinDuration(t, time.Now().Add(config.DefaultResetTokenTTL), found.ExpiresAt, time.Minute)
+
+	// Tokens cannot be used for other purposes, and they're kept for their own purpose.
+	_, err = LookupToken(TokenPurposeVerifyEmail, token)
+	assert.Equal(t, ErrorTokenInvalid, err)
+	_, err = ConsumeToken(TokenPurposeVerifyEmail, token)
+	assert.Equal(t, ErrorTokenInvalid, err)
+
+	// Tokens can only be consumed once, even with concurrent requests.
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	consumed := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := ConsumeToken(TokenPurposeResetSecret, token); err == nil {
+				lock.Lock()
+				consumed++
+				lock.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+	assert.Equal(t, 1, consumed)
+	_, err = LookupToken(TokenPurposeResetSecret, token)
+	assert.Equal(t, ErrorTokenInvalid, err)
+	_, err = LookupToken(TokenPurposeResetSecret, "unknown")
+	assert.Equal(t, ErrorTokenInvalid, err)
+}
+
+func TestTokenExpiry(t *testing.T) {
+	config.Default.DatabaseURL = StoreMemory
+	require.NoError(t, InitializeStore())
+	defer func() { config.Default.EmailTokenTTL = 0 }()
+
+	config.Default.EmailTokenTTL = time.Millisecond
+	expired, err := MintToken(nil, TokenPurposeVerifyEmail, "EXPIRY", "expiry@example.com")
+	require.NoError(t, err)
+
+	config.Default.EmailTokenTTL = time.Hour
+	revoked, err := MintToken(nil, TokenPurposeVerifyEmail, "EXPIRY", "expiry@example.com")
+	require.NoError(t, err)
+	kept, err := MintToken(nil, TokenPurposeVerifyEmail, "EXPIRY", "another@example.com")
+	require.NoError(t, err)
+
+	time.Sleep(2 * time.Millisecond)
+	_, err = LookupToken(TokenPurposeVerifyEmail, expired)
+	assert.Equal(t, ErrorTokenInvalid, err)
+	_, err = ConsumeToken(TokenPurposeVerifyEmail, expired)
+	assert.Equal(t, ErrorTokenInvalid, err)
+
+	require.NoError(t, RevokeTokens(func(token Token) bool { return token.HasValue("expiry@example.com") }))
+	_, err = LookupToken(TokenPurposeVerifyEmail, revoked)
+	assert.Equal(t, ErrorTokenInvalid, err)
+	_, err = LookupToken(TokenPurposeVerifyEmail, kept)
+	assert.NoError(t, err)
+
+	config.Default.EmailTokenTTL = time.Millisecond
+	_, err = MintToken(nil, TokenPurposeVerifyEmail, "EXPIRY", "expiry@example.com")
+	require.NoError(t, err)
+	time.Sleep(2 * time.Millisecond)
+	require.NoError(t, PurgeExpiredTokens())
+
+	keys, err := GetStore(TokensPath).List()
+	require.NoError(t, err)
+	assert.Equal(t, []string{hashToken(kept)}, keys)
+}
@@ -0,0 +1,96 @@
+package util
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// StoreTransaction groups writes across stores (which don't support transactions), so that
+// they can be undone if a later step fails. Every write through the transaction records the
+// previous value of the key, and `Rollback` restores those values in reverse order.
+//
+// NOTE: This only protects against partial failures within a process. Concurrent writers to
+// the same keys could still interleave.
+type StoreTransaction struct {
+	undo []func() error
+}
+
+// NewStoreTransaction for grouping store writes.
+func NewStoreTransaction() *StoreTransaction {
+	return &StoreTransaction{}
+}
+
+// snapshot the current value of the key, and return the function for restoring it.
+func (t *StoreTransaction) snapshot(store Store, key string) (func() error, error) {
+	var previous json.RawMessage
+	err := store.Get(key, &previous)
+	if err == ErrorKeyNotFound {
+		return func() error { return store.Remove(key) }, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return func() error { return store.Set(key, previous) }, nil
+}
+
+// Set the value for a key in the given store.
+func (t *StoreTransaction) Set(store Store, key string, value interface{}) error {
+	restore, err := t.snapshot(store, key)
+	if err != nil {
+		return err
+	}
+
+	if err = store.Set(key, value); err != nil {
+		return err
+	}
+
+	t.undo = append(t.undo, restore)
+	return nil
+}
+
+// Remove the value for a key in the given store.
+func (t *StoreTransaction) Remove(store Store, key string) error {
+	restore, err := t.snapshot(store, key)
+	if err != nil {
+		return err
+	}
+
+	if err = store.Remove(key); err != nil {
+		return err
+	}
+
+	t.undo = append(t.undo, restore)
+	return nil
+}
+
+// OnRollback registers a function for undoing a change made outside the stores.
+func (t *StoreTransaction) OnRollback(undo func() error) {
+	t.undo = append(t.undo, undo)
+}
+
+// Rollback all the writes made through this transaction (latest first). All writes are
+// attempted, and the first error (if any) is returned.
+func (t *StoreTransaction) Rollback() error {
+	var firstErr error
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		if err := t.undo[i](); err != nil {
+			log.Println("store: error rolling back write: " + err.Error())
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	t.undo = nil
+	return firstErr
+}
+
+// RollbackOnError rolls back the transaction if the given error isn't nil, and returns
+// the same error. This is useful for returning from functions.
+func (t *StoreTransaction) RollbackOnError(err error) error {
+	if err != nil {
+		t.Rollback()
+	}
+
+	return err
+}
@@ -0,0 +1,46 @@
+package util
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreTransactionRollback(t *testing.T) {
+	store := GetMemoryStore("/test-transaction")
+	require.NoError(t, store.Set("existing", map[string]string{"name": "foo"}))
+	require.NoError(t, store.Set("removed", "bar"))
+
+	tx := NewStoreTransaction()
+	require.NoError(t, tx.Set(store, "existing", map[string]string{"name": "baz"}))
+	require.NoError(t, tx.Set(store, "new", "value"))
+	require.NoError(t, tx.Remove(store, "removed"))
+
+	external := false
+	tx.OnRollback(func() error {
+		external = true
+		return nil
+	})
+
+	err := errors.New("failure")
+	assert.Equal(t, err, tx.RollbackOnError(err))
+	assert.True(t, external)
+
+	var existing map[string]string
+	require.NoError(t, store.Get("existing", &existing))
+	assert.Equal(t, "foo", existing["name"])
+
+	var value string
+	assert.Equal(t, ErrorKeyNotFound, store.Get("new", &value))
+	require.NoError(t, store.Get("removed", &value))
+	assert.Equal(t, "bar", value)
+
+	// Nothing should be rolled back without errors.
+	tx = NewStoreTransaction()
+	require.NoError(t, tx.Set(store, "new", "value"))
+	assert.NoError(t, tx.RollbackOnError(nil))
+	require.NoError(t, store.Get("new", &value))
+	assert.Equal(t, "value", value)
+}
@@ -1,20 +1,38 @@
 package util
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"time"
 
 	vault "github.com/hashicorp/vault/api"
-	"github.com/mitchellh/mapstructure"
+	"gitlab.com/omnijar/arusha/config"
 )
 
 const (
 	rootPath = "/secret/arusha"
+
+	vaultHostsPath   = "/hosts"
+	vaultHostLockKey = "lock"
+	// vaultHostLockTTL after which the lock of a host which has stopped renewing it can be taken.
+	vaultHostLockTTL = 30 * time.Second
 )
 
 var (
 	vaultClient *vault.Client
+	vaultHost   string
+	vaultTicker *time.Ticker
 )
 
+// vaultHostLock of the host using the Vault store.
+type vaultHostLock struct {
+	Host      string    `json:"host"`
+	RenewedAt time.Time `json:"renewedAt"`
+}
+
 // VaultClient for storing secrets in vault.
 type VaultClient struct {
 	path   string
@@ -22,44 +40,79 @@ type VaultClient struct {
 }
 
 // Set value for a given key
-func (v *VaultClient) Set(key string, value interface{}) {
+func (v *VaultClient) Set(key string, value interface{}) error {
 	var secret = make(map[string]interface{})
 	secret["data"] = value
 
 	path := v.path + "/" + key
-	_, err := v.client.Logical().Write(path, secret)
-
-	if err != nil {
+	if _, err := v.client.Logical().Write(path, secret); err != nil {
 		log.Println("vault: Failed to write key " + key + ": " + err.Error())
+		return errors.New("vault: error writing value for key")
 	}
+
+	return nil
 }
 
 // Get the value for a key
-func (v *VaultClient) Get(key string, value interface{}) bool {
+func (v *VaultClient) Get(key string, value interface{}) error {
 	path := v.path + "/" + key
 	secret, err := v.client.Logical().Read(path)
 	if err != nil {
 		log.Println("vault: Failed to fetch value for key " + key + ": " + err.Error())
+		return errors.New("vault: error reading value for key")
 	}
 
 	if secret == nil {
-		return false
+		return ErrorKeyNotFound
+	}
+
+	// Round-trip through JSON, so that values are decoded the same way they were encoded.
+	data, err := json.Marshal(secret.Data["data"])
+	if err == nil {
+		err = json.Unmarshal(data, value)
 	}
 
-	if err := mapstructure.Decode(secret.Data["data"], value); err != nil {
+	if err != nil {
 		log.Println("vault: Failed to decode value for key " + key + ": " + err.Error())
-		return false
+		return errors.New("vault: error decoding value for key")
 	}
 
-	return true
+	return nil
 }
 
 // Remove the value corresponding to a key.
-func (v *VaultClient) Remove(key string) {
+func (v *VaultClient) Remove(key string) error {
 	path := v.path + "/" + key
 	if _, err := v.client.Logical().Delete(path); err != nil {
 		log.Println("vault: Error removing value for key " + key + ": " + err.Error())
+		return errors.New("vault: error removing value for key")
 	}
+
+	return nil
+}
+
+// List the keys under this client's path.
+func (v *VaultClient) List() ([]string, error) {
+	secret, err := v.client.Logical().List(v.path)
+	if err != nil {
+		log.Println("vault: Error listing keys for " + v.path + ": " + err.Error())
+		return nil, errors.New("vault: error listing keys")
+	}
+
+	keys := *new([]string)
+	if secret == nil {
+		return keys, nil
+	}
+
+	if values, ok := secret.Data["keys"].([]interface{}); ok {
+		for _, key := range values {
+			if k, ok := key.(string); ok {
+				keys = append(keys, k)
+			}
+		}
+	}
+
+	return keys, nil
 }
 
 // InitializeVaultClient for route handlers.
@@ -86,3 +139,84 @@ func GetVaultClient(path string) *VaultClient {
 		client: vaultClient,
 	}
 }
+
+// LockVaultHost so that only one host uses the Vault store at a time. Vault's K/V store doesn't
+// support atomic removals, so with several hosts, single-use tokens and codes could be used more
+// than once (see `takeValue`). If another host has the lock, then this waits for it to be
+// released (or to stop being renewed) before giving up, so that a restarted host can take over
+// from the previous one. The lock is renewed while the host runs - errors are retried, and the
+// host only stops if another host has taken the lock in the meantime. Hosts using a SQL database
+// don't need this, so it does nothing for other stores.
+//
+// NOTE: Without conditional writes, hosts starting at the same moment could both get the lock.
+// This only guards against running several hosts by mistake.
+func LockVaultHost() error {
+	if config.Default.DatabaseURL != StoreVault {
+		return nil
+	}
+
+	hostname, _ := os.Hostname()
+	vaultHost = fmt.Sprintf("%s/%s", hostname, RandomAlphaNumeric(8))
+	deadline := time.Now().Add(vaultHostLockTTL)
+	for {
+		holder, err := acquireVaultHostLock()
+		if err != nil {
+			return err
+		} else if holder == "" {
+			break
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("vault: store is being used by host %s. Only one host can use Vault at a time "+
+				"(use a SQL database for running several hosts)", holder)
+		}
+
+		log.Printf("vault: store is being used by host %s, waiting for it to stop", holder)
+		time.Sleep(vaultHostLockTTL / 6)
+	}
+
+	log.Printf("vault: host %s has the store lock (only one host can use Vault at a time)", vaultHost)
+	vaultTicker = time.NewTicker(vaultHostLockTTL / 3)
+	go func() {
+		for range vaultTicker.C {
+			if holder, err := acquireVaultHostLock(); err != nil {
+				log.Printf("vault: error renewing host lock (will retry): %s", err)
+			} else if holder != "" {
+				log.Fatalf("vault: store has been taken over by host %s while this host couldn't renew its lock", holder)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// UnlockVaultHost once the host has stopped, so that another host can start right away.
+func UnlockVaultHost() {
+	if vaultTicker == nil {
+		return
+	}
+
+	vaultTicker.Stop()
+	store := GetVaultClient(vaultHostsPath)
+	var lock vaultHostLock
+	if err := store.Get(vaultHostLockKey, &lock); err != nil || lock.Host != vaultHost {
+		return
+	}
+
+	if err := store.Remove(vaultHostLockKey); err != nil {
+		log.Printf("vault: error releasing host lock: %s", err)
+	}
+}
+
+// acquireVaultHostLock for this host (or renew it), unless another host has it. In that case,
+// the other host is returned.
+func acquireVaultHostLock() (string, error) {
+	store := GetVaultClient(vaultHostsPath)
+
+	var lock vaultHostLock
+	if err := store.Get(vaultHostLockKey, &lock); err != nil && err != ErrorKeyNotFound {
+		return "", err
+	} else if err == nil && lock.Host != vaultHost && time.Since(lock.RenewedAt) < vaultHostLockTTL {
+		return lock.Host, nil
+	}
+
+	return "", store.Set(vaultHostLockKey, vaultHostLock{Host: vaultHost, RenewedAt: time.Now().UTC()})
+}